@@ -0,0 +1,448 @@
+package dmsghttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+)
+
+// BalancePolicy selects the replica of a service which serves a request.
+type BalancePolicy int
+
+// Balance policies.
+const (
+	// RoundRobin cycles through the replicas.
+	RoundRobin BalancePolicy = iota
+	// LeastOutstanding picks the replica with the fewest requests in flight.
+	LeastOutstanding
+	// ConsistentHash maps requests of the same hash key to the same replica.
+	ConsistentHash
+)
+
+// Default balancer settings.
+const (
+	DefaultMaxReplicaFailures = 3
+	DefaultEjectionTime       = 30 * time.Second
+	DefaultHealthInterval     = 10 * time.Second
+
+	hashRingReplicas = 64
+)
+
+// Balancer errors.
+var (
+	ErrUnknownService = errors.New("unknown service")
+	ErrNoReplicas     = errors.New("service has no replicas")
+)
+
+// ServiceConfig describes a logical service which is served by several replicas.
+type ServiceConfig struct {
+	Replicas []dmsg.Addr
+	Policy   BalancePolicy
+
+	// HashKey returns the key of a request for the ConsistentHash policy.
+	// The URL path is used if nil.
+	HashKey func(*http.Request) string
+
+	// MaxFailures is the number of consecutive dmsg errors after which a replica is ejected.
+	// DefaultMaxReplicaFailures is used if zero.
+	MaxFailures int
+
+	// EjectionTime is the time an ejected replica is left out.
+	// DefaultEjectionTime is used if zero.
+	EjectionTime time.Duration
+
+	// HealthPath is periodically requested from every replica if set.
+	// Replicas which fail the probe are ejected, replicas which pass it are restored.
+	HealthPath string
+
+	// HealthInterval is the interval of health probes.
+	// DefaultHealthInterval is used if zero.
+	HealthInterval time.Duration
+
+	// Hedge configures hedged requests. Requests are not hedged by default.
+	Hedge HedgeConfig
+}
+
+// Balancer is a http.RoundTripper which spreads the requests for logical services over their replicas.
+// A service is addressed by its name in the URL host, e.g. "dmsg://billing/invoices".
+// Requests for hosts which are not registered services are passed to the underlying transport unchanged.
+type Balancer struct {
+	rt http.RoundTripper
+
+	mx       sync.RWMutex
+	services map[string]*service
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// NewBalancer creates a Balancer which sends requests through rt, typically a Transport.
+func NewBalancer(rt http.RoundTripper) *Balancer {
+	return &Balancer{
+		rt:       rt,
+		services: make(map[string]*service),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetService registers or replaces a service.
+func (b *Balancer) SetService(name string, conf ServiceConfig) error {
+	if len(conf.Replicas) == 0 {
+		return ErrNoReplicas
+	}
+	s := newService(conf)
+
+	b.mx.Lock()
+	if old, ok := b.services[name]; ok {
+		close(old.done)
+	}
+	b.services[name] = s
+	b.mx.Unlock()
+
+	if conf.HealthPath != "" {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.probeLoop(s)
+		}()
+	}
+	return nil
+}
+
+// RemoveService unregisters a service.
+func (b *Balancer) RemoveService(name string) {
+	b.mx.Lock()
+	if s, ok := b.services[name]; ok {
+		close(s.done)
+		delete(b.services, name)
+	}
+	b.mx.Unlock()
+}
+
+// Replicas returns the replicas of a service along with whether they are currently in use.
+func (b *Balancer) Replicas(name string) (map[dmsg.Addr]bool, error) {
+	s, ok := b.service(name)
+	if !ok {
+		return nil, ErrUnknownService
+	}
+	now := time.Now()
+	out := make(map[dmsg.Addr]bool, len(s.replicas))
+
+	s.mx.Lock()
+	for _, r := range s.replicas {
+		out[r.addr] = !r.ejected(now)
+	}
+	s.mx.Unlock()
+	return out, nil
+}
+
+// Close stops health probes.
+func (b *Balancer) Close() error {
+	b.once.Do(func() { close(b.done) })
+	b.wg.Wait()
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.
+// Idempotent requests which fail with a dmsg error are retried on the other replicas. Other requests are not, as the
+// failed replica may have received them already.
+// Requests of services with hedging enabled may be sent to two replicas at once, see HedgeConfig.
+func (b *Balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s, ok := b.service(req.URL.Host)
+	if !ok {
+		return b.rt.RoundTrip(req)
+	}
+
+	if s.conf.Hedge.Percentile > 0 && len(s.replicas) > 1 && idempotent(req) && rewindable(req) {
+		return b.hedge(s, req)
+	}
+
+	tried := make(map[*replica]bool, len(s.replicas))
+	for {
+		r := s.pick(req, tried)
+		tried[r] = true
+
+		resp, err := b.send(s, r, req, len(tried) > 1)
+		if err == nil {
+			return resp, nil
+		}
+		if !isDmsgError(err) || len(tried) == len(s.replicas) || !idempotent(req) || !rewindable(req) {
+			return nil, err
+		}
+	}
+}
+
+// send sends req to the replica r. With rewind, the body is obtained anew from GetBody, as an earlier attempt
+// consumed it. req itself is not modified.
+func (b *Balancer) send(s *service, r *replica, req *http.Request, rewind bool) (*http.Response, error) {
+	rReq := req.Clone(req.Context())
+	rReq.URL.Host = r.addr.String()
+	rReq.Host = rReq.URL.Host
+	if rewind && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		rReq.Body = body
+	}
+
+	s.begin(r)
+	resp, err := b.rt.RoundTrip(rReq)
+	s.record(r, err)
+	if err != nil {
+		s.end(r)
+		return nil, err
+	}
+
+	// The request is outstanding until its body is closed.
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { s.end(r) }}
+	return resp, nil
+}
+
+func (b *Balancer) service(name string) (*service, bool) {
+	b.mx.RLock()
+	s, ok := b.services[name]
+	b.mx.RUnlock()
+	return s, ok
+}
+
+func (b *Balancer) probeLoop(s *service) {
+	interval := s.conf.HealthInterval
+	if interval == 0 {
+		interval = DefaultHealthInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-s.done:
+			return
+		case <-t.C:
+			for _, r := range s.replicas {
+				s.setHealth(r, b.probe(r, s.conf.HealthPath, interval))
+			}
+		}
+	}
+}
+
+func (b *Balancer) probe(r *replica, path string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, sourceURL(r.addr, path), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := b.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close() //nolint:errcheck
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+type replica struct {
+	addr         dmsg.Addr
+	outstanding  int
+	failures     int
+	ejectedUntil time.Time
+}
+
+func (r *replica) ejected(now time.Time) bool {
+	return now.Before(r.ejectedUntil)
+}
+
+type service struct {
+	conf     ServiceConfig
+	replicas []*replica
+	ring     []ringPoint
+	hedger   *hedger
+	done     chan struct{}
+
+	mx   sync.Mutex
+	next int
+}
+
+type ringPoint struct {
+	hash    uint32
+	replica *replica
+}
+
+func newService(conf ServiceConfig) *service {
+	s := &service{
+		conf:   conf,
+		hedger: newHedger(conf.Hedge),
+		done:   make(chan struct{}),
+	}
+	for _, addr := range conf.Replicas {
+		s.replicas = append(s.replicas, &replica{addr: addr})
+	}
+	if conf.Policy == ConsistentHash {
+		for _, r := range s.replicas {
+			for i := 0; i < hashRingReplicas; i++ {
+				h := ringHash(r.addr.String() + "#" + strconv.Itoa(i))
+				s.ring = append(s.ring, ringPoint{hash: h, replica: r})
+			}
+		}
+		sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	}
+	return s
+}
+
+// pick selects the replica for a request, skipping replicas that were already tried.
+// If all remaining replicas are ejected, they are used regardless.
+func (s *service) pick(req *http.Request, tried map[*replica]bool) *replica {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	usable := func(r *replica, allowEjected bool) bool {
+		return !tried[r] && (allowEjected || !r.ejected(now))
+	}
+
+	for _, allowEjected := range []bool{false, true} {
+		var r *replica
+		switch s.conf.Policy {
+		case LeastOutstanding:
+			r = s.pickLeast(func(r *replica) bool { return usable(r, allowEjected) })
+		case ConsistentHash:
+			r = s.pickHash(req, func(r *replica) bool { return usable(r, allowEjected) })
+		default:
+			r = s.pickNext(func(r *replica) bool { return usable(r, allowEjected) })
+		}
+		if r != nil {
+			return r
+		}
+	}
+	return s.replicas[0]
+}
+
+func (s *service) pickNext(usable func(*replica) bool) *replica {
+	for i := 0; i < len(s.replicas); i++ {
+		r := s.replicas[(s.next+i)%len(s.replicas)]
+		if usable(r) {
+			s.next = (s.next + i + 1) % len(s.replicas)
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *service) pickLeast(usable func(*replica) bool) *replica {
+	var best *replica
+	for i := 0; i < len(s.replicas); i++ {
+		r := s.replicas[(s.next+i)%len(s.replicas)]
+		if usable(r) && (best == nil || r.outstanding < best.outstanding) {
+			best = r
+		}
+	}
+	s.next = (s.next + 1) % len(s.replicas)
+	return best
+}
+
+func (s *service) pickHash(req *http.Request, usable func(*replica) bool) *replica {
+	key := req.URL.Path
+	if s.conf.HashKey != nil {
+		key = s.conf.HashKey(req)
+	}
+	h := ringHash(key)
+	start := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	for i := 0; i < len(s.ring); i++ {
+		if r := s.ring[(start+i)%len(s.ring)].replica; usable(r) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *service) begin(r *replica) {
+	s.mx.Lock()
+	r.outstanding++
+	s.mx.Unlock()
+}
+
+func (s *service) end(r *replica) {
+	s.mx.Lock()
+	r.outstanding--
+	s.mx.Unlock()
+}
+
+// record records the outcome of a round trip to a replica, ejecting it after too many consecutive dmsg errors.
+func (s *service) record(r *replica, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err == nil || !isDmsgError(err) {
+		r.failures = 0
+		return
+	}
+	maxFailures := s.conf.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = DefaultMaxReplicaFailures
+	}
+	if r.failures++; r.failures >= maxFailures {
+		r.failures = 0
+		r.ejectedUntil = time.Now().Add(s.ejectionTime())
+	}
+}
+
+func (s *service) setHealth(r *replica, healthy bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if healthy {
+		r.ejectedUntil = time.Time{}
+		r.failures = 0
+	} else {
+		r.ejectedUntil = time.Now().Add(s.ejectionTime())
+	}
+}
+
+func (s *service) ejectionTime() time.Duration {
+	if s.conf.EjectionTime == 0 {
+		return DefaultEjectionTime
+	}
+	return s.conf.EjectionTime
+}
+
+func ringHash(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// releasingBody calls release once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// isDmsgError reports whether err originates from dmsg, e.g. a failed discovery lookup or stream dial.
+func isDmsgError(err error) bool {
+	var dErr dmsg.Error
+	return errors.As(err, &dErr)
+}
+
+// rewindable reports whether the body of a request can be sent again.
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
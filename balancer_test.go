@@ -0,0 +1,234 @@
+package dmsghttp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// roundTripperFunc adapts a function to a http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func newReplicas(n int) ([]dmsg.Addr, hostRouter) {
+	addrs := make([]dmsg.Addr, n)
+	router := make(hostRouter, n)
+	for i := range addrs {
+		pk, _ := cipher.GenerateKeyPair()
+		addrs[i] = dmsg.Addr{PK: pk, Port: testPort}
+		name := addrs[i].String()
+		router[name] = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(name)) //nolint:errcheck
+		})
+	}
+	return addrs, router
+}
+
+func getBody(t *testing.T, c *http.Client, url string) string {
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(b)
+}
+
+func TestBalancer(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		addrs, router := newReplicas(3)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{Replicas: addrs}))
+
+		c := &http.Client{Transport: b}
+		for i := 0; i < 6; i++ {
+			require.Equal(t, addrs[i%3].String(), getBody(t, c, "dmsg://svc/"))
+		}
+	})
+
+	t.Run("least outstanding", func(t *testing.T) {
+		addrs, router := newReplicas(2)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{Replicas: addrs, Policy: dmsghttp.LeastOutstanding}))
+
+		c := &http.Client{Transport: b}
+
+		// keep the body of the first response open
+		held, err := c.Get("dmsg://svc/")
+		require.NoError(t, err)
+		heldAddr, err := ioutil.ReadAll(held.Body)
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			require.NotEqual(t, string(heldAddr), getBody(t, c, "dmsg://svc/"))
+		}
+		require.NoError(t, held.Body.Close())
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		addrs, router := newReplicas(3)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{Replicas: addrs, Policy: dmsghttp.ConsistentHash}))
+
+		c := &http.Client{Transport: b}
+		seen := make(map[string]bool)
+		for _, p := range []string{"/a", "/b", "/c", "/d", "/e", "/f", "/g", "/h"} {
+			first := getBody(t, c, "dmsg://svc"+p)
+			require.Equal(t, first, getBody(t, c, "dmsg://svc"+p))
+			seen[first] = true
+		}
+		require.True(t, len(seen) > 1)
+	})
+
+	t.Run("ejects replicas with dmsg errors", func(t *testing.T) {
+		addrs, router := newReplicas(2)
+		bad := addrs[0].String()
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == bad {
+				return nil, dmsg.ErrReqNoListener
+			}
+			return router.RoundTrip(req)
+		})
+
+		b := dmsghttp.NewBalancer(rt)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{Replicas: addrs, MaxFailures: 2}))
+
+		c := &http.Client{Transport: b}
+		for i := 0; i < 4; i++ {
+			// failed attempts are retried on the healthy replica
+			require.Equal(t, addrs[1].String(), getBody(t, c, "dmsg://svc/"))
+		}
+
+		replicas, err := b.Replicas("svc")
+		require.NoError(t, err)
+		require.Equal(t, map[dmsg.Addr]bool{addrs[0]: false, addrs[1]: true}, replicas)
+	})
+
+	t.Run("retries do not modify the request", func(t *testing.T) {
+		addrs, router := newReplicas(2)
+		bad := addrs[0].String()
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host == bad {
+				_, _ = ioutil.ReadAll(req.Body) //nolint:errcheck
+				return nil, dmsg.ErrReqNoListener
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, "data", string(body))
+			return router.RoundTrip(req)
+		})
+
+		b := dmsghttp.NewBalancer(rt)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{Replicas: addrs}))
+
+		req, err := http.NewRequest(http.MethodPut, "dmsg://svc/", strings.NewReader("data"))
+		require.NoError(t, err)
+		req.Header.Set("Idempotency-Key", "1")
+		body := req.Body
+		resp, err := b.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.True(t, body == req.Body)
+		require.Equal(t, "svc", req.URL.Host)
+	})
+
+	t.Run("non-idempotent requests are not retried", func(t *testing.T) {
+		addrs, router := newReplicas(2)
+		var (
+			mx       sync.Mutex
+			attempts int
+		)
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mx.Lock()
+			attempts++
+			mx.Unlock()
+			if req.Method == http.MethodPost {
+				return nil, dmsg.ErrSessionClosed
+			}
+			return router.RoundTrip(req)
+		})
+
+		b := dmsghttp.NewBalancer(rt)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{Replicas: addrs}))
+
+		c := &http.Client{Transport: b}
+		_, err := c.Post("dmsg://svc/", "text/plain", strings.NewReader("data"))
+		require.True(t, errors.Is(err, dmsg.ErrSessionClosed), err)
+		mx.Lock()
+		require.Equal(t, 1, attempts)
+		mx.Unlock()
+	})
+
+	t.Run("health probes", func(t *testing.T) {
+		addrs, router := newReplicas(2)
+
+		var (
+			mx      sync.Mutex
+			healthy = true
+		)
+		sick := addrs[1].String()
+		probes := make(hostRouter, len(router))
+		for _, a := range addrs {
+			name := a.String()
+			probes[name] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mx.Lock()
+				ok := healthy || name != sick
+				mx.Unlock()
+				if r.URL.Path == "/health" && !ok {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				router[name].ServeHTTP(w, r)
+			})
+		}
+
+		b := dmsghttp.NewBalancer(probes)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{
+			Replicas:       addrs,
+			HealthPath:     "/health",
+			HealthInterval: 10 * time.Millisecond,
+		}))
+
+		mx.Lock()
+		healthy = false
+		mx.Unlock()
+		require.Eventually(t, func() bool {
+			replicas, err := b.Replicas("svc")
+			return err == nil && !replicas[addrs[1]]
+		}, time.Second, 10*time.Millisecond)
+
+		mx.Lock()
+		healthy = true
+		mx.Unlock()
+		require.Eventually(t, func() bool {
+			replicas, err := b.Replicas("svc")
+			return err == nil && replicas[addrs[1]]
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("unknown hosts pass through", func(t *testing.T) {
+		addrs, router := newReplicas(1)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+
+		c := &http.Client{Transport: b}
+		require.Equal(t, addrs[0].String(), getBody(t, c, "dmsg://"+addrs[0].String()+"/"))
+	})
+}
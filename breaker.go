@@ -0,0 +1,259 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// BreakerState is the state of the circuit of a remote address.
+type BreakerState int
+
+// Breaker states.
+const (
+	// BreakerClosed passes requests.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails requests without sending them.
+	BreakerOpen
+	// BreakerHalfOpen passes a limited number of trial requests, which decide whether to close or open again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// Default breaker settings.
+const (
+	DefaultBreakerFailures = 5
+	DefaultBreakerOpenTime = 30 * time.Second
+)
+
+// ErrCircuitOpen is matched by errors of requests which were not sent as the circuit of their address is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type circuitOpenError struct {
+	addr dmsg.Addr
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%v for %s", ErrCircuitOpen, e.addr)
+}
+
+// Is reports whether target is ErrCircuitOpen.
+func (e *circuitOpenError) Is(target error) bool { return target == ErrCircuitOpen }
+
+// BreakerConfig configures a Breaker.
+type BreakerConfig struct {
+	// MaxFailures is the number of consecutive failures after which the circuit of an address opens.
+	// DefaultBreakerFailures is used if zero.
+	MaxFailures int
+
+	// OpenTime is the time a circuit stays open before it lets trial requests pass.
+	// DefaultBreakerOpenTime is used if zero.
+	OpenTime time.Duration
+
+	// HalfOpenRequests is the number of concurrent trial requests of a half-open circuit. 1 is used if zero.
+	HalfOpenRequests int
+
+	// OnStateChange is called whenever the circuit of an address changes its state, if not nil.
+	OnStateChange func(addr dmsg.Addr, from, to BreakerState)
+}
+
+// Breaker is a http.RoundTripper with a circuit breaker for every remote dmsg address.
+// Only dmsg errors, such as failed discovery lookups or stream dials, and timeouts count as failures. Any response,
+// whatever its status, means the peer is reachable, and cancelled requests decide nothing. Requests for hosts which
+// are not "<pk>:<port>" are passed through, so a Balancer has to come before the Breaker.
+type Breaker struct {
+	rt   http.RoundTripper
+	conf BreakerConfig
+
+	mx       sync.Mutex
+	circuits map[dmsg.Addr]*circuit // only addresses with failures or which are not closed
+}
+
+type circuit struct {
+	state     BreakerState
+	failures  int
+	openUntil time.Time
+	trials    int // trial requests in flight
+}
+
+// stateChange is a state change to report once the lock is released.
+type stateChange struct {
+	addr     dmsg.Addr
+	from, to BreakerState
+}
+
+// NewBreaker creates a Breaker which sends requests through rt, typically a Transport.
+func NewBreaker(rt http.RoundTripper, conf BreakerConfig) *Breaker {
+	if conf.MaxFailures == 0 {
+		conf.MaxFailures = DefaultBreakerFailures
+	}
+	if conf.OpenTime == 0 {
+		conf.OpenTime = DefaultBreakerOpenTime
+	}
+	if conf.HalfOpenRequests == 0 {
+		conf.HalfOpenRequests = 1
+	}
+	return &Breaker{rt: rt, conf: conf, circuits: make(map[dmsg.Addr]*circuit)}
+}
+
+// State returns the state of the circuit of addr.
+func (b *Breaker) State(addr dmsg.Addr) BreakerState {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	c, ok := b.circuits[addr]
+	if !ok {
+		return BreakerClosed
+	}
+	if c.state == BreakerOpen && !time.Now().Before(c.openUntil) {
+		return BreakerHalfOpen
+	}
+	return c.state
+}
+
+// RoundTrip implements http.RoundTripper.
+func (b *Breaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr, err := Transport{}.resolveAddr(req)
+	if err != nil {
+		return b.rt.RoundTrip(req)
+	}
+
+	trial, err := b.allow(addr)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	resp, err := b.rt.RoundTrip(req)
+	b.record(addr, trial, err)
+	return resp, err
+}
+
+func (b *Breaker) requestIdentity(req *http.Request) (cipher.PubKey, bool) {
+	return requestIdentity(b.rt, req)
+}
+
+// allow decides whether a request to addr may be sent. If the request is a trial of a half-open circuit, the circuit
+// is returned.
+func (b *Breaker) allow(addr dmsg.Addr) (*circuit, error) {
+	var changes []stateChange
+	defer func() { b.notify(changes) }()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	c, ok := b.circuits[addr]
+	if !ok {
+		return nil, nil
+	}
+	switch c.state {
+	case BreakerClosed:
+		return nil, nil
+	case BreakerOpen:
+		if time.Now().Before(c.openUntil) {
+			return nil, &circuitOpenError{addr: addr}
+		}
+		changes = append(changes, b.setState(addr, c, BreakerHalfOpen))
+	}
+	if c.trials >= b.conf.HalfOpenRequests {
+		return nil, &circuitOpenError{addr: addr}
+	}
+	c.trials++
+	return c, nil
+}
+
+// record records the outcome of a request to addr. trial is the circuit the request was a trial of, if any.
+// Only trials decide the state of a half-open circuit.
+func (b *Breaker) record(addr dmsg.Addr, trial *circuit, err error) {
+	var changes []stateChange
+	defer func() { b.notify(changes) }()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	// the circuit of a trial may have been opened again or closed by other trials meanwhile
+	if trial != nil {
+		trial.trials--
+	}
+
+	failed := err != nil && isFailure(err)
+	c, ok := b.circuits[addr]
+	if !ok {
+		if !failed {
+			return
+		}
+		c = &circuit{}
+		b.circuits[addr] = c
+	}
+
+	switch c.state {
+	case BreakerClosed:
+		switch {
+		case failed:
+			if c.failures++; c.failures >= b.conf.MaxFailures {
+				changes = append(changes, b.setState(addr, c, BreakerOpen))
+			}
+		case err == nil:
+			delete(b.circuits, addr)
+		}
+	case BreakerHalfOpen:
+		if trial != c {
+			return
+		}
+		switch {
+		case failed:
+			changes = append(changes, b.setState(addr, c, BreakerOpen))
+		case err == nil:
+			changes = append(changes, b.setState(addr, c, BreakerClosed))
+			delete(b.circuits, addr)
+		}
+	}
+}
+
+// isFailure reports whether err of a request counts as a failure of its address: dmsg errors and timeouts, such as
+// an expired dial deadline.
+func isFailure(err error) bool {
+	if isDmsgError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var nErr net.Error
+	return errors.As(err, &nErr) && nErr.Timeout()
+}
+
+// setState changes the state of a circuit. It has to be called with the lock held.
+func (b *Breaker) setState(addr dmsg.Addr, c *circuit, state BreakerState) stateChange {
+	change := stateChange{addr: addr, from: c.state, to: state}
+	c.state = state
+	c.failures = 0
+	if state == BreakerOpen {
+		c.openUntil = time.Now().Add(b.conf.OpenTime)
+	}
+	return change
+}
+
+func (b *Breaker) notify(changes []stateChange) {
+	if b.conf.OnStateChange == nil {
+		return
+	}
+	for _, ch := range changes {
+		b.conf.OnStateChange(ch.addr, ch.from, ch.to)
+	}
+}
@@ -0,0 +1,273 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestBreaker(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	clientPK, _ := cipher.GenerateKeyPair()
+	addr := dmsg.Addr{PK: srvPK, Port: testPort}
+	url := "dmsg://" + addr.String()
+
+	lis, err := lb.Listen(srvPK, testPort)
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) }) //nolint:errcheck
+	mux.HandleFunc("/missing", http.NotFound)
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	var (
+		mx      sync.Mutex
+		changes []string
+	)
+	b := dmsghttp.NewBreaker(lb.Transport(clientPK), dmsghttp.BreakerConfig{
+		MaxFailures: 2,
+		OpenTime:    200 * time.Millisecond,
+		OnStateChange: func(a dmsg.Addr, from, to dmsghttp.BreakerState) {
+			require.Equal(t, addr, a)
+			mx.Lock()
+			changes = append(changes, from.String()+"->"+to.String())
+			mx.Unlock()
+		},
+	})
+	c := &http.Client{Transport: b, Timeout: clientTimeout}
+	getChanges := func() []string {
+		mx.Lock()
+		defer mx.Unlock()
+		return append([]string(nil), changes...)
+	}
+
+	// client errors do not count as failures
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(url + "/missing")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+	require.Equal(t, dmsghttp.BreakerClosed, b.State(addr))
+
+	lb.FailDial(addr, dmsg.ErrDiscEntryNotFound)
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(url + "/")
+		require.True(t, errors.Is(err, dmsg.ErrDiscEntryNotFound), err)
+	}
+	require.Equal(t, dmsghttp.BreakerOpen, b.State(addr))
+	require.Equal(t, []string{"closed->open"}, getChanges())
+
+	// open circuits fail fast, even once the peer is reachable again
+	lb.FailDial(addr, nil)
+	_, err = c.Get(url + "/")
+	require.True(t, errors.Is(err, dmsghttp.ErrCircuitOpen), err)
+	require.False(t, errors.Is(err, dmsg.ErrDiscEntryNotFound), err)
+
+	// a failed trial opens the circuit again
+	lb.FailDial(addr, dmsg.ErrDiscEntryNotFound)
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, dmsghttp.BreakerHalfOpen, b.State(addr))
+	_, err = c.Get(url + "/")
+	require.True(t, errors.Is(err, dmsg.ErrDiscEntryNotFound), err)
+	require.Equal(t, dmsghttp.BreakerOpen, b.State(addr))
+
+	// a successful trial closes it
+	lb.FailDial(addr, nil)
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, "ok", getBody(t, c, url+"/"))
+	require.Equal(t, dmsghttp.BreakerClosed, b.State(addr))
+	require.Equal(t, []string{
+		"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed",
+	}, getChanges())
+}
+
+func TestBreakerHalfOpenRequests(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	h, url, closeSrv := newGatedServer(t, lb, nil)
+	defer closeSrv()
+
+	clientPK, _ := cipher.GenerateKeyPair()
+	var addr dmsg.Addr
+	require.NoError(t, addr.Set(url[len("dmsg://"):len(url)-1]))
+
+	b := dmsghttp.NewBreaker(lb.Transport(clientPK), dmsghttp.BreakerConfig{
+		MaxFailures: 1,
+		OpenTime:    100 * time.Millisecond,
+	})
+	c := &http.Client{Transport: b, Timeout: clientTimeout}
+
+	lb.FailDial(addr, dmsg.ErrDiscEntryNotFound)
+	_, err := c.Get(url)
+	require.Error(t, err)
+	lb.FailDial(addr, nil)
+	time.Sleep(150 * time.Millisecond)
+
+	// the trial request is held by the server, so the circuit lets no other request pass
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.Equal(t, "ok", getBody(t, c, url))
+	}()
+	require.Eventually(t, func() bool {
+		active, _, _ := h.stats()
+		return active == 1
+	}, clientTimeout, 10*time.Millisecond)
+
+	_, err = c.Get(url)
+	require.True(t, errors.Is(err, dmsghttp.ErrCircuitOpen), err)
+
+	close(h.gate)
+	<-done
+	require.Equal(t, dmsghttp.BreakerClosed, b.State(addr))
+	require.Equal(t, "ok", getBody(t, c, url))
+}
+
+func TestBreakerFailures(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	clientPK, _ := cipher.GenerateKeyPair()
+	addr := dmsg.Addr{PK: srvPK, Port: testPort}
+	url := "dmsg://" + addr.String() + "/"
+
+	b := dmsghttp.NewBreaker(lb.Transport(clientPK), dmsghttp.BreakerConfig{MaxFailures: 2})
+	c := &http.Client{Transport: b, Timeout: clientTimeout}
+
+	// cancelled requests do not count
+	lb.FailDial(addr, context.Canceled)
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(url)
+		require.True(t, errors.Is(err, context.Canceled), err)
+	}
+	require.Equal(t, dmsghttp.BreakerClosed, b.State(addr))
+
+	// timeouts do
+	lb.FailDial(addr, context.DeadlineExceeded)
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(url)
+		require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	}
+	require.Equal(t, dmsghttp.BreakerOpen, b.State(addr))
+}
+
+// holdingHandler holds requests until the channel of their path is closed.
+type holdingHandler struct {
+	holds map[string]chan struct{}
+
+	mx     sync.Mutex
+	active int
+}
+
+func (h *holdingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mx.Lock()
+	h.active++
+	h.mx.Unlock()
+
+	<-h.holds[r.URL.Path]
+
+	h.mx.Lock()
+	h.active--
+	h.mx.Unlock()
+	_, _ = w.Write([]byte("ok")) //nolint:errcheck
+}
+
+func TestBreakerTrials(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	clientPK, _ := cipher.GenerateKeyPair()
+	addr := dmsg.Addr{PK: srvPK, Port: testPort}
+	url := "dmsg://" + addr.String()
+
+	lis, err := lb.Listen(srvPK, testPort)
+	require.NoError(t, err)
+	h := &holdingHandler{holds: make(map[string]chan struct{})}
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		h.holds[path] = make(chan struct{})
+	}
+	srv := &http.Server{Handler: h}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	b := dmsghttp.NewBreaker(lb.Transport(clientPK), dmsghttp.BreakerConfig{
+		MaxFailures:      1,
+		OpenTime:         100 * time.Millisecond,
+		HalfOpenRequests: 2,
+	})
+	c := &http.Client{Transport: b, Timeout: clientTimeout}
+
+	// waitActive waits until the server holds n requests.
+	waitActive := func(n int) {
+		deadline := time.Now().Add(clientTimeout)
+		for {
+			h.mx.Lock()
+			active := h.active
+			h.mx.Unlock()
+			if active == n {
+				return
+			}
+			require.True(t, time.Now().Before(deadline), "active requests: %d, want %d", active, n)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// get sends a request which the server holds, and waits until it holds n requests.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	get := func(path string, n int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, "ok", getBody(t, c, url+path))
+		}()
+		waitActive(n)
+	}
+	fail := func() {
+		lb.FailDial(addr, dmsg.ErrDiscEntryNotFound)
+		_, err := c.Get(url + "/")
+		require.True(t, errors.Is(err, dmsg.ErrDiscEntryNotFound), err)
+		lb.FailDial(addr, nil)
+		require.Equal(t, dmsghttp.BreakerOpen, b.State(addr))
+	}
+
+	// a request sent while the circuit was closed neither takes a trial nor decides the half-open circuit
+	get("/a", 1)
+	fail()
+	time.Sleep(150 * time.Millisecond)
+	get("/b", 2)
+	close(h.holds["/a"])
+	waitActive(1)
+	get("/c", 2)
+	require.Equal(t, dmsghttp.BreakerHalfOpen, b.State(addr))
+	_, err = c.Get(url + "/c")
+	require.True(t, errors.Is(err, dmsghttp.ErrCircuitOpen), err)
+
+	close(h.holds["/b"])
+	close(h.holds["/c"])
+	wg.Wait()
+	require.Equal(t, dmsghttp.BreakerClosed, b.State(addr))
+
+	// trials which end after the circuit opened again release their slots
+	fail()
+	time.Sleep(150 * time.Millisecond)
+	get("/d", 1)
+	fail()
+	close(h.holds["/d"])
+	wg.Wait()
+	time.Sleep(150 * time.Millisecond)
+	get("/e", 1)
+	get("/f", 2)
+	close(h.holds["/e"])
+	close(h.holds["/f"])
+	wg.Wait()
+	require.Equal(t, dmsghttp.BreakerClosed, b.State(addr))
+}
@@ -0,0 +1,726 @@
+package dmsghttp
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// Default cache settings.
+const (
+	DefaultCacheEntries      = 1000
+	DefaultCacheMaxEntrySize = 10 << 20
+
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+// Warnings added to stale responses, see RFC 7234 section 5.5.
+const (
+	warnStale              = `110 - "Response is Stale"`
+	warnRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+// SignatureHeader is the response header in which an origin may sign the body of a response, as the hex encoded
+// cipher.Sig of cipher.SignPayload over the body with the secret key of its dmsg address.
+const SignatureHeader = "X-Dmsg-Signature"
+
+// Cache errors.
+var (
+	ErrCacheMiss         = errors.New("not in cache")
+	ErrSignatureMismatch = errors.New("response signature does not match the origin")
+)
+
+// CacheEntry is a response held by a CacheStore. Entries are never modified once stored.
+type CacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Vary holds the values of the request headers named by the Vary header of the response.
+	Vary http.Header
+
+	// RequestTime and ResponseTime are the times the request was sent and the response was received.
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// Origin is the dmsg address the response was received from, as dmsg streams authenticate the public key of the
+	// remote. It is zero for hosts which are not "<pk>:<port>".
+	Origin dmsg.Addr
+
+	// SHA256 is the hex encoded SHA-256 digest of Body. Responses whose body does not match the digest advertised
+	// by the origin in the SHA256Header header fail with ErrDigestMismatch instead of being cached.
+	SHA256 string
+
+	// Signature is the signature of Body by Origin from the SignatureHeader header, if the origin sent one.
+	// Responses whose signature does not verify against the public key of Origin fail with ErrSignatureMismatch
+	// instead of being cached. It is null for unsigned responses and for responses without an Origin.
+	Signature cipher.Sig
+}
+
+// CacheStore holds the entries of a Cache.
+type CacheStore interface {
+	// Get returns the entry of a key or ErrCacheMiss.
+	Get(key string) (*CacheEntry, error)
+	// Put stores an entry, replacing the previous entry of the same key.
+	Put(key string, e *CacheEntry) error
+	// Delete removes the entry of a key, if any.
+	Delete(key string) error
+}
+
+// MemoryCacheStore is a CacheStore which keeps a bounded number of entries in memory, dropping the least recently
+// used entry when full.
+type MemoryCacheStore struct {
+	mx      sync.Mutex
+	entries *lruCache
+}
+
+// NewMemoryCacheStore creates a MemoryCacheStore holding up to maxEntries entries.
+// DefaultCacheEntries is used if maxEntries is zero.
+func NewMemoryCacheStore(maxEntries int) *MemoryCacheStore {
+	if maxEntries == 0 {
+		maxEntries = DefaultCacheEntries
+	}
+	return &MemoryCacheStore{entries: newLRUCache(maxEntries)}
+}
+
+// Get implements CacheStore.
+func (s *MemoryCacheStore) Get(key string) (*CacheEntry, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	v, ok := s.entries.get(key)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return v.(*CacheEntry), nil
+}
+
+// Put implements CacheStore.
+func (s *MemoryCacheStore) Put(key string, e *CacheEntry) error {
+	s.mx.Lock()
+	s.entries.add(key, e)
+	s.mx.Unlock()
+	return nil
+}
+
+// Delete implements CacheStore.
+func (s *MemoryCacheStore) Delete(key string) error {
+	s.mx.Lock()
+	s.entries.remove(key)
+	s.mx.Unlock()
+	return nil
+}
+
+// DiskCacheStore is a CacheStore which keeps every entry in a JSON file of its own, so cached responses survive
+// restarts. The least recently used files are removed when the entries exceed the size limit of the store; the
+// modification times of the files keep track of their use across restarts.
+type DiskCacheStore struct {
+	dir      string
+	maxBytes int64
+
+	mx    sync.Mutex
+	size  int64
+	ll    *list.List               // of *diskCacheFile, most recently used first
+	files map[string]*list.Element // by file name
+}
+
+type diskCacheFile struct {
+	name string
+	size int64
+}
+
+// NewDiskCacheStore opens the store in dir, creating the directory if needed.
+// The entries are limited to maxBytes in total, or not limited if maxBytes is zero.
+func NewDiskCacheStore(dir string, maxBytes int64) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	s := &DiskCacheStore{dir: dir, maxBytes: maxBytes, ll: list.New(), files: make(map[string]*list.Element)}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".json") {
+			s.files[info.Name()] = s.ll.PushFront(&diskCacheFile{name: info.Name(), size: info.Size()})
+			s.size += info.Size()
+		}
+	}
+	s.evict()
+	return s, nil
+}
+
+// Get implements CacheStore.
+func (s *DiskCacheStore) Get(key string) (*CacheEntry, error) {
+	name := s.name(key)
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse cache entry of %s: %v", key, err)
+	}
+
+	s.mx.Lock()
+	if el, ok := s.files[name]; ok {
+		s.ll.MoveToFront(el)
+		now := time.Now()
+		_ = os.Chtimes(filepath.Join(s.dir, name), now, now) //nolint:errcheck
+	}
+	s.mx.Unlock()
+	return &e, nil
+}
+
+// Put implements CacheStore.
+func (s *DiskCacheStore) Put(key string, e *CacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	name := s.name(key)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := writeFileAtomic(filepath.Join(s.dir, name), b); err != nil {
+		return err
+	}
+	if el, ok := s.files[name]; ok {
+		s.size -= el.Value.(*diskCacheFile).size
+		s.ll.Remove(el)
+	}
+	s.files[name] = s.ll.PushFront(&diskCacheFile{name: name, size: int64(len(b))})
+	s.size += int64(len(b))
+	s.evict()
+	return nil
+}
+
+// Delete implements CacheStore.
+func (s *DiskCacheStore) Delete(key string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.remove(s.name(key))
+}
+
+// Size returns the total size of the entries.
+func (s *DiskCacheStore) Size() int64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.size
+}
+
+// evict removes the least recently used files until the entries fit the size limit.
+// It has to be called with the lock held.
+func (s *DiskCacheStore) evict() {
+	for s.maxBytes > 0 && s.size > s.maxBytes {
+		_ = s.remove(s.ll.Back().Value.(*diskCacheFile).name) //nolint:errcheck
+	}
+}
+
+// remove removes a file. It has to be called with the lock held.
+func (s *DiskCacheStore) remove(name string) error {
+	if el, ok := s.files[name]; ok {
+		s.size -= el.Value.(*diskCacheFile).size
+		s.ll.Remove(el)
+		delete(s.files, name)
+	}
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskCacheStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// CacheConfig configures a Cache.
+type CacheConfig struct {
+	// Store holds the cached responses. A MemoryCacheStore with DefaultCacheEntries entries is used if nil.
+	Store CacheStore
+
+	// MaxEntrySize is the size of the largest body which is cached.
+	// DefaultCacheMaxEntrySize is used if zero.
+	MaxEntrySize int64
+
+	// StaleIfError is the stale-if-error window of responses which do not set one in their Cache-Control header:
+	// for that long after they became stale, they are served if the peer cannot be reached or fails with a 5xx
+	// status. Stale responses are not served on errors by default.
+	StaleIfError time.Duration
+
+	// Shared makes the Cache a shared cache, such as a gateway serving several users (RFC 7234 section 3): responses
+	// marked private are not stored, neither are responses to requests with an Authorization header unless they are
+	// marked public, must-revalidate or s-maxage, and s-maxage takes precedence over max-age.
+	Shared bool
+}
+
+// Cache is a http.RoundTripper which caches responses as a private or shared cache following RFC 7234, with the
+// stale-while-revalidate and stale-if-error extensions of RFC 5861.
+// Entries are keyed by the dmsg address and URL of a request. Only GET requests without Range or conditional headers
+// are served from the cache; successful requests with unsafe methods invalidate the entry of their URL.
+type Cache struct {
+	rt   http.RoundTripper
+	conf CacheConfig
+
+	mx           sync.Mutex
+	revalidating map[string]bool
+}
+
+// NewCache creates a Cache which sends requests through rt, typically a Transport.
+func NewCache(rt http.RoundTripper, conf CacheConfig) *Cache {
+	if conf.Store == nil {
+		conf.Store = NewMemoryCacheStore(DefaultCacheEntries)
+	}
+	if conf.MaxEntrySize == 0 {
+		conf.MaxEntrySize = DefaultCacheMaxEntrySize
+	}
+	return &Cache{rt: rt, conf: conf, revalidating: make(map[string]bool)}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := c.key(req)
+	if req.Method != "" && req.Method != http.MethodGet {
+		resp, err := c.rt.RoundTrip(req)
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions &&
+			req.Method != http.MethodTrace && resp.StatusCode < 400 {
+			_ = c.conf.Store.Delete(key) //nolint:errcheck
+		}
+		return resp, err
+	}
+
+	reqCC := requestCacheControl(req)
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" || conditional(req) {
+		return c.rt.RoundTrip(req)
+	}
+
+	e, err := c.conf.Store.Get(key)
+	if err != nil || !e.matches(req) {
+		if reqCC.has("only-if-cached") {
+			return newCacheResponse(req, http.StatusGatewayTimeout), nil
+		}
+		return c.fetch(req, key, reqCC, nil)
+	}
+
+	now := time.Now()
+	respCC := parseCacheControl(e.Header)
+	age, lifetime := e.age(now), e.lifetime(c.conf.Shared)
+	fresh, staleOK := freshness(reqCC, respCC, age, lifetime)
+	noCache := reqCC.has("no-cache") || respCC.has("no-cache")
+
+	switch {
+	case !noCache && fresh:
+		return e.response(req, age, ""), nil
+	case !noCache && staleOK:
+		return e.response(req, age, warnStale), nil
+	case !noCache && !respCC.has("must-revalidate") && respCC.has("stale-while-revalidate") &&
+		age-lifetime <= respCC.seconds("stale-while-revalidate"):
+		c.revalidate(req, key, e)
+		return e.response(req, age, warnStale), nil
+	case reqCC.has("only-if-cached"):
+		return newCacheResponse(req, http.StatusGatewayTimeout), nil
+	}
+	return c.fetch(req, key, reqCC, e)
+}
+
+// fetch sends a request, revalidating the stale entry if not nil, and stores the response if possible.
+func (c *Cache) fetch(req *http.Request, key string, reqCC cacheControl, stale *CacheEntry) (*http.Response, error) {
+	fReq := req
+	if stale != nil {
+		fReq = req.Clone(req.Context())
+		if etag := stale.Header.Get("Etag"); etag != "" {
+			fReq.Header.Set("If-None-Match", etag)
+		}
+		if lm := stale.Header.Get("Last-Modified"); lm != "" {
+			fReq.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	reqTime := time.Now()
+	resp, err := c.rt.RoundTrip(fReq)
+	if err != nil || isServerError(resp.StatusCode) {
+		if stale != nil && c.staleIfError(stale, reqCC) {
+			if resp != nil {
+				_ = resp.Body.Close() //nolint:errcheck
+			}
+			return stale.response(req, stale.age(time.Now()), warnRevalidationFailed), nil
+		}
+		return resp, err
+	}
+	respTime := time.Now()
+
+	if resp.StatusCode == http.StatusNotModified && stale != nil {
+		_ = resp.Body.Close() //nolint:errcheck
+		e := stale.refresh(resp.Header, reqTime, respTime)
+		_ = c.conf.Store.Put(key, e) //nolint:errcheck
+		return e.response(req, e.age(time.Now()), ""), nil
+	}
+	return c.store(req, key, reqCC, resp, reqTime, respTime)
+}
+
+// store stores a response if it may be cached, returning it with its body intact.
+func (c *Cache) store(req *http.Request, key string, reqCC cacheControl, resp *http.Response,
+	reqTime, respTime time.Time) (*http.Response, error) {
+	respCC := parseCacheControl(resp.Header)
+	if respCC.has("no-store") || !cacheableStatus(resp.StatusCode) || resp.Header.Get("Vary") == "*" {
+		return resp, nil
+	}
+	if c.conf.Shared && !sharable(req, respCC) {
+		return resp, nil
+	}
+
+	e := &CacheEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         make(http.Header),
+		RequestTime:  reqTime,
+		ResponseTime: respTime,
+	}
+	if e.lifetime(c.conf.Shared) <= 0 && !e.hasValidators() && !respCC.has("stale-while-revalidate") &&
+		!c.staleIfError(e, reqCC) {
+		return resp, nil
+	}
+	for _, v := range resp.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				e.Vary[name] = req.Header[name]
+			}
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.conf.MaxEntrySize+1))
+	if err != nil {
+		_ = resp.Body.Close() //nolint:errcheck
+		return nil, err
+	}
+	if int64(len(body)) > c.conf.MaxEntrySize {
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return resp, nil
+	}
+	_ = resp.Body.Close() //nolint:errcheck
+
+	sum := sha256.Sum256(body)
+	e.Body, e.SHA256 = body, hex.EncodeToString(sum[:])
+	if advertised := resp.Header.Get(SHA256Header); advertised != "" && !strings.EqualFold(advertised, e.SHA256) {
+		return nil, fmt.Errorf("%w: %s", ErrDigestMismatch, req.URL)
+	}
+	if origin, err := (Transport{}).resolveAddr(req); err == nil {
+		e.Origin = origin
+	}
+	if err := e.verifySignature(resp.Header.Get(SignatureHeader)); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrSignatureMismatch, req.URL, err)
+	}
+	_ = c.conf.Store.Put(key, e) //nolint:errcheck
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// revalidate revalidates a stale entry in the background, unless that is already happening.
+func (c *Cache) revalidate(req *http.Request, key string, stale *CacheEntry) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.revalidating[key] {
+		return
+	}
+	c.revalidating[key] = true
+
+	rReq := req.Clone(context.Background())
+	go func() {
+		defer func() {
+			c.mx.Lock()
+			delete(c.revalidating, key)
+			c.mx.Unlock()
+		}()
+		if resp, err := c.fetch(rReq, key, nil, stale); err == nil {
+			_ = resp.Body.Close() //nolint:errcheck
+		}
+	}()
+}
+
+// staleIfError reports whether a stale entry may be served as the peer failed.
+func (c *Cache) staleIfError(e *CacheEntry, reqCC cacheControl) bool {
+	respCC := parseCacheControl(e.Header)
+	if respCC.has("must-revalidate") || respCC.has("no-cache") {
+		return false
+	}
+	window := c.conf.StaleIfError
+	if respCC.has("stale-if-error") {
+		window = respCC.seconds("stale-if-error")
+	}
+	if reqCC.has("stale-if-error") {
+		window = reqCC.seconds("stale-if-error")
+	}
+	return window > 0 && e.age(time.Now())-e.lifetime(c.conf.Shared) <= window
+}
+
+// freshness reports whether an entry is fresh, and whether it may be served although stale as the request
+// allows it with max-stale.
+func freshness(reqCC, respCC cacheControl, age, lifetime time.Duration) (fresh, staleOK bool) {
+	fresh = age < lifetime
+	if reqCC.has("max-age") && age > reqCC.seconds("max-age") {
+		return false, false
+	}
+	if reqCC.has("min-fresh") && lifetime-age < reqCC.seconds("min-fresh") {
+		fresh = false
+	}
+	if !fresh && reqCC.has("max-stale") && !respCC.has("must-revalidate") {
+		staleOK = reqCC["max-stale"] == "" || age-lifetime <= reqCC.seconds("max-stale")
+	}
+	return fresh, staleOK
+}
+
+// matches reports whether the entry was stored for a request with the same values of the headers named by Vary.
+func (e *CacheEntry) matches(req *http.Request) bool {
+	for name, values := range e.Vary {
+		if strings.Join(values, ",") != strings.Join(req.Header[name], ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// date returns the Date of the response, or the time it was received if it has none.
+func (e *CacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// lifetime returns the freshness lifetime of the entry for a private or shared cache, see RFC 7234 section 4.2.1.
+func (e *CacheEntry) lifetime(shared bool) time.Duration {
+	cc := parseCacheControl(e.Header)
+	if shared && cc.has("s-maxage") {
+		return cc.seconds("s-maxage")
+	}
+	if cc.has("max-age") {
+		return cc.seconds("max-age")
+	}
+	if exp := e.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicallyCacheable(e.StatusCode) {
+		if d := e.date().Sub(lm) / 10; d < maxHeuristicFreshness {
+			return d
+		}
+		return maxHeuristicFreshness
+	}
+	return 0
+}
+
+// age returns the current age of the entry, see RFC 7234 section 4.2.3.
+func (e *CacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	var ageValue time.Duration
+	if s, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && s > 0 {
+		ageValue = time.Duration(s) * time.Second
+	}
+	initial := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if apparent > initial {
+		initial = apparent
+	}
+	return initial + now.Sub(e.ResponseTime)
+}
+
+func (e *CacheEntry) hasValidators() bool {
+	return e.Header.Get("Etag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// verifySignature records the signature sig of the body, hex encoded, after verifying it against the origin.
+// Signatures of responses without an origin can not be verified and are not recorded.
+func (e *CacheEntry) verifySignature(sig string) error {
+	if sig == "" || e.Origin.PK.Null() {
+		return nil
+	}
+	var s cipher.Sig
+	if err := s.UnmarshalText([]byte(sig)); err != nil {
+		return err
+	}
+	if err := cipher.VerifyPubKeySignedPayload(e.Origin.PK, s, e.Body); err != nil {
+		return err
+	}
+	e.Signature = s
+	return nil
+}
+
+// refresh returns a copy of the entry updated with the headers of a 304 Not Modified response.
+func (e *CacheEntry) refresh(h http.Header, reqTime, respTime time.Time) *CacheEntry {
+	refreshed := *e
+	refreshed.Header = e.Header.Clone()
+	for name, values := range h {
+		switch name {
+		case "Content-Length", "Transfer-Encoding", "Connection":
+			continue
+		}
+		refreshed.Header[name] = values
+	}
+	refreshed.RequestTime, refreshed.ResponseTime = reqTime, respTime
+	return &refreshed
+}
+
+// response returns the entry as the response to req.
+func (e *CacheEntry) response(req *http.Request, age time.Duration, warning string) *http.Response {
+	resp := newCacheResponse(req, e.StatusCode)
+	resp.Header = e.Header.Clone()
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if warning != "" {
+		resp.Header.Add("Warning", warning)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(e.Body))
+	resp.ContentLength = int64(len(e.Body))
+	return resp
+}
+
+func newCacheResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// prefixedBody is a response body of which a prefix was already read.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// key identifies the entry of a request by its dmsg address and URL.
+func (c *Cache) key(req *http.Request) string {
+	host := req.URL.Host
+	if addr, err := (Transport{}).resolveAddr(req); err == nil {
+		host = addr.String()
+	}
+	return identityPrefix(c.rt, req) + host + req.URL.RequestURI()
+}
+
+func (c *Cache) requestIdentity(req *http.Request) (cipher.PubKey, bool) {
+	return requestIdentity(c.rt, req)
+}
+
+// conditional reports whether a request carries preconditions, which are left to the server.
+func conditional(req *http.Request) bool {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// heuristicallyCacheable reports whether responses of a status may be cached without explicit freshness,
+// see RFC 7231 section 6.1.
+func heuristicallyCacheable(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// sharable reports whether a shared cache may store a response, see RFC 7234 section 3.
+func sharable(req *http.Request, respCC cacheControl) bool {
+	if respCC.has("private") {
+		return false
+	}
+	return req.Header.Get("Authorization") == "" ||
+		respCC.has("public") || respCC.has("must-revalidate") || respCC.has("s-maxage")
+}
+
+// cacheableStatus reports whether responses of a status are stored.
+func cacheableStatus(status int) bool {
+	return heuristicallyCacheable(status) || status == http.StatusFound || status == http.StatusTemporaryRedirect
+}
+
+func isServerError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cacheControl holds the directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	return cc
+}
+
+// requestCacheControl parses the Cache-Control header of a request, falling back to Pragma: no-cache.
+func requestCacheControl(req *http.Request) cacheControl {
+	cc := parseCacheControl(req.Header)
+	if _, ok := req.Header["Cache-Control"]; !ok && strings.EqualFold(req.Header.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the value of a directive as duration. Missing or invalid values are zero.
+func (cc cacheControl) seconds(directive string) time.Duration {
+	s, err := strconv.ParseInt(cc[directive], 10, 64)
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
@@ -0,0 +1,395 @@
+package dmsghttp_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// originHandler serves a versioned body with configurable headers, counting the requests it receives.
+type originHandler struct {
+	mx       sync.Mutex
+	header   http.Header
+	version  int
+	requests int
+	notMod   int
+}
+
+func (h *originHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.requests++
+	for name, values := range h.header {
+		w.Header()[name] = values
+	}
+	etag := fmt.Sprintf(`"v%d"`, h.version)
+	if h.header.Get("Etag") != "" {
+		w.Header().Set("Etag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			h.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(w, "v%d %s", h.version, r.Header.Get("Accept-Language")) //nolint:errcheck
+}
+
+func (h *originHandler) set(version int, header http.Header) {
+	h.mx.Lock()
+	h.version, h.header = version, header
+	h.mx.Unlock()
+}
+
+func (h *originHandler) stats() (requests, notModified int) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return h.requests, h.notMod
+}
+
+// newCacheOrigin serves an originHandler on a loopback network.
+func newCacheOrigin(t *testing.T, header http.Header) (*dmsghttp.Loopback, dmsg.Addr, *originHandler, func()) {
+	lb := dmsghttp.NewLoopback()
+	pk, _ := cipher.GenerateKeyPair()
+	lis, err := lb.Listen(pk, testPort)
+	require.NoError(t, err)
+
+	h := &originHandler{header: header}
+	srv := &http.Server{Handler: h}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	return lb, dmsg.Addr{PK: pk, Port: testPort}, h, func() { require.NoError(t, srv.Close()) }
+}
+
+func cacheGet(t *testing.T, c *http.Client, url string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp, string(b)
+}
+
+func TestCache(t *testing.T) {
+	clientPK, _ := cipher.GenerateKeyPair()
+
+	t.Run("fresh responses are served from the cache", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=60"}})
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/a"
+
+		_, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v0 ", body)
+		h.set(1, http.Header{"Cache-Control": {"max-age=60"}})
+
+		resp, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v0 ", body)
+		require.NotEmpty(t, resp.Header.Get("Age"))
+
+		// other URLs and no-cache requests go to the origin
+		_, body = cacheGet(t, c, "dmsg://"+addr.String()+"/b", nil)
+		require.Equal(t, "v1 ", body)
+		_, body = cacheGet(t, c, url, http.Header{"Cache-Control": {"no-cache"}})
+		require.Equal(t, "v1 ", body)
+		requests, _ := h.stats()
+		require.Equal(t, 3, requests)
+	})
+
+	t.Run("no-store", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"no-store"}})
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/"
+
+		cacheGet(t, c, url, nil)
+		cacheGet(t, c, url, nil)
+		requests, _ := h.stats()
+		require.Equal(t, 2, requests)
+	})
+
+	t.Run("conditional revalidation", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=0"}, "Etag": {"set"}})
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/"
+
+		_, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v0 ", body)
+		resp, body := cacheGet(t, c, url, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "v0 ", body)
+		_, notModified := h.stats()
+		require.Equal(t, 1, notModified)
+
+		h.set(1, http.Header{"Cache-Control": {"max-age=0"}, "Etag": {"set"}})
+		_, body = cacheGet(t, c, url, nil)
+		require.Equal(t, "v1 ", body)
+	})
+
+	t.Run("stale-if-error", func(t *testing.T) {
+		lb, addr, _, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=0, stale-if-error=60"}})
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/"
+
+		cacheGet(t, c, url, nil)
+		lb.FailDial(addr, dmsg.ErrDiscEntryNotFound)
+		resp, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v0 ", body)
+		require.Contains(t, resp.Header.Get("Warning"), "111")
+
+		// the client may ask for fresher data
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Cache-Control", "stale-if-error=0")
+		_, err = c.Do(req)
+		require.True(t, errors.Is(err, dmsg.ErrDiscEntryNotFound), err)
+	})
+
+	t.Run("default stale-if-error", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, nil)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{
+			StaleIfError: time.Minute,
+		})}
+		url := "dmsg://" + addr.String() + "/"
+
+		cacheGet(t, c, url, nil)
+		h.set(1, nil)
+		_, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v1 ", body)
+
+		lb.FailDial(addr, dmsg.ErrDiscEntryNotFound)
+		_, body = cacheGet(t, c, url, nil)
+		require.Equal(t, "v1 ", body)
+	})
+
+	t.Run("stale-while-revalidate", func(t *testing.T) {
+		header := http.Header{"Cache-Control": {"max-age=0, stale-while-revalidate=60"}}
+		lb, addr, h, closeSrv := newCacheOrigin(t, header)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/"
+
+		cacheGet(t, c, url, nil)
+		h.set(1, header)
+		resp, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v0 ", body)
+		require.Contains(t, resp.Header.Get("Warning"), "110")
+
+		require.Eventually(t, func() bool {
+			requests, _ := h.stats()
+			return requests == 2
+		}, clientTimeout, 10*time.Millisecond)
+		require.Eventually(t, func() bool {
+			_, body := cacheGet(t, c, url, http.Header{"Cache-Control": {"only-if-cached"}})
+			return body == "v1 "
+		}, clientTimeout, 10*time.Millisecond)
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}})
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/"
+
+		_, body := cacheGet(t, c, url, http.Header{"Accept-Language": {"en"}})
+		require.Equal(t, "v0 en", body)
+		_, body = cacheGet(t, c, url, http.Header{"Accept-Language": {"de"}})
+		require.Equal(t, "v0 de", body)
+		requests, _ := h.stats()
+		require.Equal(t, 2, requests)
+	})
+
+	t.Run("unsafe methods invalidate", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=60"}})
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+		url := "dmsg://" + addr.String() + "/"
+
+		cacheGet(t, c, url, nil)
+		h.set(1, http.Header{"Cache-Control": {"max-age=60"}})
+		resp, err := c.Post(url, "text/plain", strings.NewReader("update"))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		_, body := cacheGet(t, c, url, nil)
+		require.Equal(t, "v1 ", body)
+	})
+
+	t.Run("only-if-cached", func(t *testing.T) {
+		lb, addr, _, closeSrv := newCacheOrigin(t, nil)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})}
+
+		resp, _ := cacheGet(t, c, "dmsg://"+addr.String()+"/", http.Header{"Cache-Control": {"only-if-cached"}})
+		require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+
+	t.Run("shared caches", func(t *testing.T) {
+		lb, addr, h, closeSrv := newCacheOrigin(t, nil)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{Shared: true})}
+		auth := http.Header{"Authorization": {"Bearer secret"}}
+
+		// cached returns whether a second request for path is served from the cache
+		cached := func(path string, header, reqHeader http.Header) bool {
+			h.set(0, header)
+			url := "dmsg://" + addr.String() + path
+			cacheGet(t, c, url, reqHeader)
+			before, _ := h.stats()
+			cacheGet(t, c, url, reqHeader)
+			after, _ := h.stats()
+			return before == after
+		}
+
+		require.False(t, cached("/private", http.Header{"Cache-Control": {"private, max-age=60"}}, nil))
+		require.True(t, cached("/public", http.Header{"Cache-Control": {"max-age=60"}}, nil))
+		require.False(t, cached("/auth", http.Header{"Cache-Control": {"max-age=60"}}, auth))
+		require.True(t, cached("/auth-public", http.Header{"Cache-Control": {"public, max-age=60"}}, auth))
+		require.True(t, cached("/auth-s-maxage", http.Header{"Cache-Control": {"s-maxage=60"}}, auth))
+
+		// s-maxage takes precedence over max-age
+		require.False(t, cached("/s-maxage", http.Header{"Cache-Control": {"max-age=60, s-maxage=0"}}, nil))
+
+		// private caches store all of them
+		c.Transport = dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{})
+		require.True(t, cached("/private", http.Header{"Cache-Control": {"private, max-age=60"}}, nil))
+		require.True(t, cached("/auth", http.Header{"Cache-Control": {"max-age=60"}}, auth))
+	})
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_cache")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	lb, addr, h, closeSrv := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=60"}})
+	defer closeSrv()
+	clientPK, _ := cipher.GenerateKeyPair()
+	url := "dmsg://" + addr.String() + "/"
+
+	newClient := func() *http.Client {
+		store, err := dmsghttp.NewDiskCacheStore(dir, 0)
+		require.NoError(t, err)
+		return &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{Store: store})}
+	}
+
+	_, body := cacheGet(t, newClient(), url, nil)
+	require.Equal(t, "v0 ", body)
+
+	// entries survive restarts
+	h.set(1, nil)
+	_, body = cacheGet(t, newClient(), url, nil)
+	require.Equal(t, "v0 ", body)
+	requests, _ := h.stats()
+	require.Equal(t, 1, requests)
+
+	store, err := dmsghttp.NewDiskCacheStore(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, store.Delete(addr.String()+"/"))
+	_, err = store.Get(addr.String() + "/")
+	require.True(t, errors.Is(err, dmsghttp.ErrCacheMiss), err)
+}
+
+func TestDiskCacheStoreEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_cache")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	entry := &dmsghttp.CacheEntry{StatusCode: http.StatusOK, Body: make([]byte, 1000)}
+	probe, err := dmsghttp.NewDiskCacheStore(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, probe.Put("probe", entry))
+	size := probe.Size()
+	require.NoError(t, probe.Delete("probe"))
+
+	// room for two entries
+	store, err := dmsghttp.NewDiskCacheStore(dir, 2*size+size/2)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("a", entry))
+	require.NoError(t, store.Put("b", entry))
+	_, err = store.Get("a")
+	require.NoError(t, err)
+	require.NoError(t, store.Put("c", entry))
+
+	_, err = store.Get("b")
+	require.True(t, errors.Is(err, dmsghttp.ErrCacheMiss), err)
+	for _, key := range []string{"a", "c"} {
+		_, err = store.Get(key)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2*size, store.Size())
+
+	// the size is restored and enforced when the store is opened again
+	reopened, err := dmsghttp.NewDiskCacheStore(dir, size)
+	require.NoError(t, err)
+	require.Equal(t, size, reopened.Size())
+}
+
+func TestCacheSignatures(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	pk, sk := cipher.GenerateKeyPair()
+	_, otherSK := cipher.GenerateKeyPair()
+	lis, err := lb.Listen(pk, testPort)
+	require.NoError(t, err)
+
+	body := []byte("signed")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signer := sk
+		if r.URL.Path == "/forged" {
+			signer = otherSK
+		}
+		if r.URL.Path != "/unsigned" {
+			sig, err := cipher.SignPayload(body, signer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(dmsghttp.SignatureHeader, sig.Hex())
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write(body) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	clientPK, _ := cipher.GenerateKeyPair()
+	store := dmsghttp.NewMemoryCacheStore(0)
+	c := &http.Client{Transport: dmsghttp.NewCache(lb.Transport(clientPK), dmsghttp.CacheConfig{Store: store})}
+	addr := dmsg.Addr{PK: pk, Port: testPort}
+
+	_, got := cacheGet(t, c, "dmsg://"+addr.String()+"/signed", nil)
+	require.Equal(t, string(body), got)
+	e, err := store.Get(addr.String() + "/signed")
+	require.NoError(t, err)
+	require.Equal(t, addr, e.Origin)
+	require.NoError(t, cipher.VerifyPubKeySignedPayload(pk, e.Signature, body))
+
+	cacheGet(t, c, "dmsg://"+addr.String()+"/unsigned", nil)
+	e, err = store.Get(addr.String() + "/unsigned")
+	require.NoError(t, err)
+	require.True(t, e.Signature.Null())
+
+	_, err = c.Get("dmsg://" + addr.String() + "/forged")
+	require.True(t, errors.Is(err, dmsghttp.ErrSignatureMismatch), err)
+	_, err = store.Get(addr.String() + "/forged")
+	require.True(t, errors.Is(err, dmsghttp.ErrCacheMiss), err)
+}
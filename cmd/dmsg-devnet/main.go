@@ -0,0 +1,59 @@
+// Command dmsg-devnet runs a local dmsg network with a discovery, dmsg servers and dmsg clients in one process.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+func main() {
+	servers := flag.Int("servers", 1, "number of dmsg servers")
+	clients := flag.Int("clients", 2, "number of dmsg clients")
+	maxSessions := flag.Int("max-sessions", devnet.DefaultMaxSessions, "number of sessions every dmsg server accepts")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of waiting for the network to be ready")
+	flag.Parse()
+
+	n, err := devnet.Start(devnet.Config{Servers: *servers, MaxSessions: *maxSessions})
+	if err != nil {
+		log.Fatalf("Failed to start devnet: %v", err)
+	}
+	defer func() {
+		if err := n.Close(); err != nil {
+			log.Printf("Failed to close devnet: %v", err)
+		}
+	}()
+
+	// the keys are generated here so that the secret keys can be printed for use by other processes
+	for i := 0; i < *clients; i++ {
+		pk, sk := cipher.GenerateKeyPair()
+		n.AddClientWithKeys(pk, sk)
+		log.Printf("Client %d: pk=%s sk=%s", i, pk, sk)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	err = n.Ready(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Devnet is not ready: %v", err)
+		return
+	}
+
+	log.Printf("Discovery: %s", n.DiscAddr)
+	for i, srv := range n.Servers {
+		log.Printf("Server %d: pk=%s", i, srv.LocalPK())
+	}
+	log.Print("Devnet is ready")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+}
@@ -0,0 +1,44 @@
+// Command dmsg-disc-snapshot exports the entries of a dmsg discovery to a signed snapshot file.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func main() {
+	var (
+		sk      cipher.SecKey
+		clients cipher.PubKeys
+	)
+	discAddr := flag.String("disc", dmsg.DefaultDiscAddr, "comma separated dmsg discovery addresses, in order of preference")
+	out := flag.String("out", "snapshot.json", "file to write the snapshot to")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of discovery lookups")
+	flag.Var(&sk, "sk", "secret key to sign the snapshot with")
+	flag.Var(&clients, "clients", "comma separated public keys of clients to include besides the servers")
+	flag.Parse()
+
+	if sk.Null() {
+		log.Fatal("A secret key is required to sign the snapshot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	s, err := dmsghttp.ExportSnapshot(ctx, dmsghttp.NewDiscovery(strings.Split(*discAddr, ",")...), clients, sk)
+	if err != nil {
+		log.Fatalf("Failed to export snapshot: %v", err)
+	}
+	if err := dmsghttp.WriteSnapshot(*out, s); err != nil {
+		log.Fatalf("Failed to write snapshot: %v", err)
+	}
+	log.Printf("Wrote %d entries signed by %s to %s", len(s.Entries), s.PK, *out)
+}
@@ -0,0 +1,86 @@
+// Command dmsg-http-cache runs a caching gateway for dmsg origins. Clients send their requests through it by setting
+// Transport.Proxy to its address.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func main() {
+	var (
+		sk      cipher.SecKey
+		allowed cipher.PubKeys
+	)
+	dir := flag.String("dir", "dmsg-http-cache", "directory of the cached responses")
+	maxSize := flag.Int64("max-size", 1<<30, "maximum size of the cached responses in bytes (unlimited if 0)")
+	maxEntrySize := flag.Int64("max-entry-size", dmsghttp.DefaultCacheMaxEntrySize, "size of the largest cached body in bytes")
+	staleIfError := flag.Duration("stale-if-error", time.Hour, "time stale responses are served while their origin fails")
+	port := flag.Uint("port", 80, "dmsg port to listen on")
+	discAddr := flag.String("disc", dmsg.DefaultDiscAddr, "comma separated dmsg discovery addresses, in order of preference")
+	flag.Var(&sk, "sk", "secret key of the gateway (random if unset)")
+	flag.Var(&allowed, "allow", "comma separated public keys of allowed clients (all clients if unset)")
+	flag.Parse()
+
+	if *port == 0 || *port > math.MaxUint16 {
+		log.Fatalf("Invalid port: %d", *port)
+	}
+	if sk.Null() {
+		_, sk = cipher.GenerateKeyPair()
+	}
+	pk, err := sk.PubKey()
+	if err != nil {
+		log.Fatalf("Invalid secret key: %v", err)
+	}
+
+	store, err := dmsghttp.NewDiskCacheStore(*dir, *maxSize)
+	if err != nil {
+		log.Fatalf("Failed to open cache directory: %v", err)
+	}
+
+	dc := dmsghttp.NewDiscovery(strings.Split(*discAddr, ",")...)
+	if md, ok := dc.(*dmsghttp.MultiDiscovery); ok {
+		md.OnPartialWrite(func(err *dmsghttp.PartialWriteError) {
+			log.Printf("Failed to update discovery entry: %v", err)
+		})
+	}
+	t := dmsghttp.NewTransport(pk, sk, dc, dmsg.DefaultConfig())
+	defer func() {
+		if err := t.DmsgClient.Close(); err != nil {
+			log.Printf("Failed to close dmsg client: %v", err)
+		}
+	}()
+	cache := dmsghttp.NewCache(t, dmsghttp.CacheConfig{
+		Store:        store,
+		MaxEntrySize: *maxEntrySize,
+		StaleIfError: *staleIfError,
+		Shared:       true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	log.Printf("Caching gateway on dmsg://%s:%d/, caching %d bytes in %s", pk, *port, store.Size(), *dir)
+	if err := dmsghttp.ServeProxy(ctx, t.DmsgClient, uint16(*port), cache, dmsghttp.ProxyConfig{AllowedPKs: allowed}); err != nil {
+		log.Printf("Failed to serve: %v", err)
+	}
+}
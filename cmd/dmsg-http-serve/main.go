@@ -0,0 +1,78 @@
+// Command dmsg-http-serve serves a local directory over dmsg.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func main() {
+	var (
+		sk      cipher.SecKey
+		allowed cipher.PubKeys
+	)
+	dir := flag.String("dir", ".", "directory to serve")
+	port := flag.Uint("port", 80, "dmsg port to listen on")
+	discAddr := flag.String("disc", dmsg.DefaultDiscAddr, "comma separated dmsg discovery addresses, in order of preference")
+	manifest := flag.String("manifest", "", "URL path of the SHA-256 manifest endpoint (disabled if empty)")
+	flag.Var(&sk, "sk", "secret key of the server (random if unset)")
+	flag.Var(&allowed, "allow", "comma separated public keys of allowed clients (all clients if unset)")
+	flag.Parse()
+
+	if *port == 0 || *port > math.MaxUint16 {
+		log.Fatalf("Invalid port: %d", *port)
+	}
+	if sk.Null() {
+		_, sk = cipher.GenerateKeyPair()
+	}
+	pk, err := sk.PubKey()
+	if err != nil {
+		log.Fatalf("Invalid secret key: %v", err)
+	}
+
+	dc := dmsghttp.NewDiscovery(strings.Split(*discAddr, ",")...)
+	if md, ok := dc.(*dmsghttp.MultiDiscovery); ok {
+		md.OnPartialWrite(func(err *dmsghttp.PartialWriteError) {
+			log.Printf("Failed to update discovery entry: %v", err)
+		})
+	}
+	dmsgC := dmsg.NewClient(pk, sk, dc, dmsg.DefaultConfig())
+	go dmsgC.Serve()
+	defer func() {
+		if err := dmsgC.Close(); err != nil {
+			log.Printf("Failed to close dmsg client: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	conf := dmsghttp.FileServerConfig{
+		ManifestPath: *manifest,
+		AllowedPKs:   allowed,
+	}
+
+	log.Printf("Serving %s on dmsg://%s:%d/", *dir, pk, *port)
+	if err := dmsghttp.ServeFileSystem(ctx, dmsgC, uint16(*port), http.Dir(*dir), conf); err != nil {
+		log.Printf("Failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package dmsghttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// DefaultCoalesceVary lists the request headers which distinguish otherwise identical requests by default.
+var DefaultCoalesceVary = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range"}
+
+// DefaultCoalesceMaxBodySize is the default size of the largest response body which is shared by merged requests.
+const DefaultCoalesceMaxBodySize = 4 << 20
+
+// coalesceChunk is the size of the reads from a shared response body.
+const coalesceChunk = 32 << 10
+
+// CoalesceConfig configures a Coalescer.
+type CoalesceConfig struct {
+	// Vary lists the request headers which, besides the dmsg address, method and URL, have to be equal for requests
+	// to be merged. DefaultCoalesceVary is used if nil.
+	Vary []string
+
+	// MaxBodySize is the size of the largest response body which is shared, as shared bodies are kept in memory
+	// until the round trip ends. Bodies of unknown length are read ahead up to this size to find out whether they
+	// fit. DefaultCoalesceMaxBodySize is used if zero.
+	MaxBodySize int64
+}
+
+// Coalescer is a http.RoundTripper which merges concurrent identical GET and HEAD requests without a body into a
+// single round trip, fanning the response out to all of them. Requests which arrive after the response headers
+// start a new round trip. Larger response bodies than MaxBodySize are not shared: the first caller gets the response,
+// while the others fall back to round trips of their own.
+// Every caller may cancel its request or close its body independently; the shared round trip is only canceled once
+// all of its callers are gone. It does not have a deadline of its own, so callers should set one.
+type Coalescer struct {
+	rt      http.RoundTripper
+	vary    []string
+	maxBody int64
+
+	mx    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// NewCoalescer creates a Coalescer which sends requests through rt, typically a Transport.
+func NewCoalescer(rt http.RoundTripper, conf CoalesceConfig) *Coalescer {
+	vary := conf.Vary
+	if vary == nil {
+		vary = DefaultCoalesceVary
+	}
+	c := &Coalescer{rt: rt, maxBody: conf.MaxBodySize, calls: make(map[string]*coalescedCall)}
+	if c.maxBody == 0 {
+		c.maxBody = DefaultCoalesceMaxBodySize
+	}
+	for _, name := range vary {
+		c.vary = append(c.vary, http.CanonicalHeaderKey(name))
+	}
+	return c
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *Coalescer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != "" && req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+		(req.Body != nil && req.Body != http.NoBody) {
+		return c.rt.RoundTrip(req)
+	}
+
+	key := c.key(req)
+	c.mx.Lock()
+	call, ok := c.calls[key]
+	if !ok || !call.acquire() {
+		call = c.start(key, req)
+	}
+	c.mx.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			call.release()
+			return nil, call.err
+		}
+		if resp, ok := call.response(req); ok {
+			return resp, nil
+		}
+		// another caller took the body, which is too large to be shared
+		call.release()
+		return c.rt.RoundTrip(req)
+	case <-req.Context().Done():
+		call.release()
+		return nil, req.Context().Err()
+	}
+}
+
+// start starts the shared round trip of a call, with req as its first caller. It has to be called with the lock held.
+func (c *Coalescer) start(key string, req *http.Request) *coalescedCall {
+	ctx, cancel := context.WithCancel(detachedContext{parent: req.Context()})
+	call := &coalescedCall{done: make(chan struct{}), cancel: cancel, refs: 1}
+	c.calls[key] = call
+
+	sReq := req.Clone(ctx)
+	go func() {
+		resp, err := c.rt.RoundTrip(sReq)
+
+		c.mx.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mx.Unlock()
+
+		call.finish(resp, err, err == nil && c.sharable(sReq, resp))
+	}()
+	return call
+}
+
+// sharable reports whether the body of resp is small enough to be shared. Bodies of unknown length are read ahead to
+// find out, with resp.Body replaced by a body which returns what was read first.
+func (c *Coalescer) sharable(req *http.Request, resp *http.Response) bool {
+	switch {
+	case req.Method == http.MethodHead || resp.ContentLength == 0:
+		return true
+	case resp.ContentLength > 0:
+		return resp.ContentLength <= c.maxBody
+	}
+	prefix, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxBody+1))
+	resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body), Closer: resp.Body}
+	// a failed body is shared, so that the error reaches all callers
+	return err != nil || int64(len(prefix)) <= c.maxBody
+}
+
+// key identifies identical requests.
+func (c *Coalescer) key(req *http.Request) string {
+	host := req.URL.Host
+	if addr, err := (Transport{}).resolveAddr(req); err == nil {
+		host = addr.String()
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var b strings.Builder
+	b.WriteString(identityPrefix(c.rt, req) + method + "\n" + host + "\n" + req.URL.String())
+	for _, name := range c.vary {
+		b.WriteString("\n" + name + ":" + strings.Join(req.Header[name], ","))
+	}
+	return b.String()
+}
+
+func (c *Coalescer) requestIdentity(req *http.Request) (cipher.PubKey, bool) {
+	return requestIdentity(c.rt, req)
+}
+
+// coalescedCall is a round trip shared by several callers.
+type coalescedCall struct {
+	done   chan struct{} // closed once resp and err are set
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+
+	mx        sync.Mutex
+	refs      int  // callers waiting for the response or holding a body
+	abandoned bool // set once all callers are gone
+	body      *sharedBody
+	taken     bool // set once a caller took the body of a response which is not shared
+}
+
+// acquire adds a caller, unless the call was abandoned by its callers.
+func (call *coalescedCall) acquire() bool {
+	call.mx.Lock()
+	defer call.mx.Unlock()
+
+	if call.abandoned {
+		return false
+	}
+	call.refs++
+	return true
+}
+
+// release drops a caller, canceling the round trip once no caller is left.
+func (call *coalescedCall) release() {
+	call.mx.Lock()
+	defer call.mx.Unlock()
+
+	if call.refs--; call.refs == 0 {
+		call.abandoned = true
+		call.cancel()
+		switch {
+		case call.body != nil:
+			call.body.close()
+		case call.resp != nil && !call.taken:
+			_ = call.resp.Body.Close() //nolint:errcheck
+		}
+	}
+}
+
+func (call *coalescedCall) finish(resp *http.Response, err error, shared bool) {
+	call.mx.Lock()
+	call.resp, call.err = resp, err
+	switch {
+	case err != nil:
+		call.cancel()
+	case shared:
+		call.body = newSharedBody(resp.Body)
+		if call.refs == 0 {
+			call.body.close()
+		}
+	case call.refs == 0:
+		_ = resp.Body.Close() //nolint:errcheck
+	}
+	call.mx.Unlock()
+	close(call.done)
+}
+
+// response returns the response of the call for req, with a body of its own. It returns false if the body is not
+// shared and was taken by another caller.
+func (call *coalescedCall) response(req *http.Request) (*http.Response, bool) {
+	resp := new(http.Response)
+	*resp = *call.resp
+	resp.Header = call.resp.Header.Clone()
+	resp.Request = req
+	if call.body != nil {
+		resp.Body = &sharedBodyReader{body: call.body, ctx: req.Context(), release: call.release}
+		return resp, true
+	}
+
+	call.mx.Lock()
+	taken := call.taken
+	call.taken = true
+	call.mx.Unlock()
+	if taken {
+		return nil, false
+	}
+	resp.Body = newCallerBody(req.Context(), call.resp.Body, call.release)
+	return resp, true
+}
+
+// sharedBody reads a response body once, keeping what was read for all of its readers.
+type sharedBody struct {
+	src io.ReadCloser
+
+	mx     sync.Mutex
+	buf    []byte
+	err    error         // set once src is exhausted or failed
+	notify chan struct{} // closed and replaced whenever buf or err change
+}
+
+func newSharedBody(src io.ReadCloser) *sharedBody {
+	b := &sharedBody{src: src, notify: make(chan struct{})}
+	go b.fill()
+	return b
+}
+
+func (b *sharedBody) fill() {
+	p := make([]byte, coalesceChunk)
+	for {
+		n, err := b.src.Read(p)
+
+		b.mx.Lock()
+		b.buf = append(b.buf, p[:n]...)
+		if err != nil {
+			b.err = err
+		}
+		close(b.notify)
+		b.notify = make(chan struct{})
+		b.mx.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close closes the source of the body, which ends fill.
+func (b *sharedBody) close() {
+	_ = b.src.Close() //nolint:errcheck
+}
+
+// sharedBodyReader is the body of a coalesced response returned to one of the callers.
+type sharedBodyReader struct {
+	body    *sharedBody
+	ctx     context.Context
+	off     int
+	once    sync.Once
+	release func()
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	for {
+		r.body.mx.Lock()
+		if r.off < len(r.body.buf) {
+			n := copy(p, r.body.buf[r.off:])
+			r.off += n
+			r.body.mx.Unlock()
+			return n, nil
+		}
+		err, notify := r.body.err, r.body.notify
+		r.body.mx.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-notify:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *sharedBodyReader) Close() error {
+	r.once.Do(r.release)
+	return nil
+}
+
+// callerBody is a response body which is not shared, released once it is closed or the context of its caller is
+// done. The round trip is canceled once its other callers are gone too, which ends pending reads.
+type callerBody struct {
+	io.ReadCloser
+	once    sync.Once
+	closed  chan struct{}
+	release func()
+}
+
+func newCallerBody(ctx context.Context, body io.ReadCloser, release func()) *callerBody {
+	b := &callerBody{ReadCloser: body, closed: make(chan struct{}), release: release}
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.done()
+		case <-b.closed:
+		}
+	}()
+	return b
+}
+
+func (b *callerBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *callerBody) done() {
+	b.once.Do(func() {
+		close(b.closed)
+		b.release()
+	})
+}
+
+// detachedContext carries the values of its parent, but neither its deadline nor its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
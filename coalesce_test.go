@@ -0,0 +1,282 @@
+package dmsghttp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestCoalescer(t *testing.T) {
+	clientPK, _ := cipher.GenerateKeyPair()
+
+	// waitActive waits until the gated handler holds n requests.
+	waitActive := func(h *gatedHandler, n int) {
+		require.Eventually(t, func() bool {
+			active, _, _ := h.stats()
+			return active == n
+		}, clientTimeout, 10*time.Millisecond)
+	}
+
+	t.Run("identical requests share a round trip", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		h, url, closeSrv := newGatedServer(t, lb, nil)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCoalescer(lb.Transport(clientPK), dmsghttp.CoalesceConfig{}),
+			Timeout: clientTimeout}
+
+		var wg sync.WaitGroup
+		get := func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.Equal(t, "ok", getBody(t, c, url))
+			}()
+		}
+		get()
+		waitActive(h, 1)
+		for i := 0; i < 9; i++ {
+			get()
+		}
+		time.Sleep(100 * time.Millisecond) // let the requests join
+		close(h.gate)
+		wg.Wait()
+
+		_, _, order := h.stats()
+		require.Len(t, order, 1)
+
+		// later requests start a new round trip
+		require.Equal(t, "ok", getBody(t, c, url))
+		_, _, order = h.stats()
+		require.Len(t, order, 2)
+	})
+
+	t.Run("vary headers and unsafe methods", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		h, url, closeSrv := newGatedServer(t, lb, nil)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCoalescer(lb.Transport(clientPK), dmsghttp.CoalesceConfig{}),
+			Timeout: clientTimeout}
+
+		var wg sync.WaitGroup
+		do := func(method, lang string) {
+			req, err := http.NewRequest(method, url, nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept-Language", lang)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := c.Do(req)
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+			}()
+		}
+		do(http.MethodGet, "en")
+		do(http.MethodGet, "de")
+		do(http.MethodPost, "en")
+		do(http.MethodPost, "en")
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Language", "en")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// requests of different identities are not merged
+			resp, err := c.Do(req.WithContext(dmsghttp.WithIdentity(context.Background(), clientPK)))
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+		}()
+		waitActive(h, 5)
+		close(h.gate)
+		wg.Wait()
+	})
+
+	t.Run("waiters cancel independently", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		h, url, closeSrv := newGatedServer(t, lb, nil)
+		defer closeSrv()
+		c := &http.Client{Transport: dmsghttp.NewCoalescer(lb.Transport(clientPK), dmsghttp.CoalesceConfig{}),
+			Timeout: clientTimeout}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		canceled := make(chan error)
+		go func() {
+			_, err := c.Do(req.WithContext(ctx))
+			canceled <- err
+		}()
+		waitActive(h, 1)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			require.Equal(t, "ok", getBody(t, c, url))
+		}()
+		time.Sleep(100 * time.Millisecond) // let the request join
+
+		cancel()
+		err = <-canceled
+		require.True(t, errors.Is(err, context.Canceled), err)
+
+		close(h.gate)
+		<-done
+		_, _, order := h.stats()
+		require.Len(t, order, 1)
+	})
+
+	t.Run("round trip is canceled once all waiters are gone", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		srvPK, _ := cipher.GenerateKeyPair()
+		lis, err := lb.Listen(srvPK, testPort)
+		require.NoError(t, err)
+		started, stopped := make(chan struct{}, 1), make(chan struct{})
+		srv := &http.Server{Handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-r.Context().Done()
+			close(stopped)
+		})}
+		go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+		defer func() { require.NoError(t, srv.Close()) }()
+
+		c := &http.Client{Transport: dmsghttp.NewCoalescer(lb.Transport(clientPK), dmsghttp.CoalesceConfig{})}
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequest(http.MethodGet, "dmsg://"+dmsg.Addr{PK: srvPK, Port: testPort}.String()+"/", nil)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := c.Do(req.WithContext(ctx))
+				require.True(t, errors.Is(err, context.Canceled), err)
+			}()
+		}
+		<-started
+		time.Sleep(100 * time.Millisecond) // let the requests join
+		cancel()
+		wg.Wait()
+
+		select {
+		case <-stopped:
+		case <-time.After(clientTimeout):
+			t.Fatal("shared round trip was not canceled")
+		}
+	})
+
+	t.Run("bodies are fanned out", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		srvPK, _ := cipher.GenerateKeyPair()
+		lis, err := lb.Listen(srvPK, testPort)
+		require.NoError(t, err)
+		payload := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+		gate := make(chan struct{})
+		var mx sync.Mutex
+		requests := 0
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			mx.Lock()
+			requests++
+			mx.Unlock()
+			<-gate
+			_, _ = w.Write(payload) //nolint:errcheck
+		})}
+		go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+		defer func() { require.NoError(t, srv.Close()) }()
+
+		c := &http.Client{Transport: dmsghttp.NewCoalescer(lb.Transport(clientPK), dmsghttp.CoalesceConfig{}),
+			Timeout: clientTimeout}
+		url := "dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort}.String() + "/"
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := c.Get(url)
+				require.NoError(t, err)
+				defer func() { require.NoError(t, resp.Body.Close()) }()
+				if i == 0 {
+					// a caller which stops reading early does not affect the others
+					_, err := resp.Body.Read(make([]byte, 10))
+					require.NoError(t, err)
+					return
+				}
+				b, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(payload, b))
+			}(i)
+		}
+		time.Sleep(100 * time.Millisecond) // let the requests join
+		close(gate)
+		wg.Wait()
+
+		mx.Lock()
+		defer mx.Unlock()
+		require.Equal(t, 1, requests)
+	})
+
+	t.Run("large bodies are not shared", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		srvPK, _ := cipher.GenerateKeyPair()
+		lis, err := lb.Listen(srvPK, testPort)
+		require.NoError(t, err)
+		payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<10)
+		gate := make(chan struct{})
+		var mx sync.Mutex
+		requests := 0
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			requests++
+			mx.Unlock()
+			<-gate
+			if r.URL.Path == "/sized" {
+				w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+			}
+			_, _ = w.Write(payload) //nolint:errcheck
+		})}
+		go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+		defer func() { require.NoError(t, srv.Close()) }()
+
+		tr := dmsghttp.NewCoalescer(lb.Transport(clientPK), dmsghttp.CoalesceConfig{MaxBodySize: 1000})
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+		addr := "dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort}.String()
+
+		for _, path := range []string{"/sized", "/chunked"} {
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					require.Equal(t, string(payload), getBody(t, c, addr+path))
+				}()
+			}
+			time.Sleep(100 * time.Millisecond) // let the requests join
+			mx.Lock()
+			require.Equal(t, 1, requests)
+			mx.Unlock()
+
+			gate <- struct{}{}
+			gate <- struct{}{}
+			gate <- struct{}{}
+			wg.Wait()
+
+			// the body went to one of the callers while the others sent requests of their own
+			mx.Lock()
+			require.Equal(t, 3, requests)
+			requests = 0
+			mx.Unlock()
+		}
+	})
+}
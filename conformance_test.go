@@ -0,0 +1,374 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+// conformanceHandler serves the endpoints used by the scenarios of TestConformance.
+func conformanceHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "12")
+		_, _ = w.Write([]byte("Hello World!")) //nolint:errcheck
+	})
+	mux.HandleFunc("/no-content", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/not-modified", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("v1")) //nolint:errcheck
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, _ *http.Request) {
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "chunk%d;", i) //nolint:errcheck
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/trailer", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte("body")) //nolint:errcheck
+		w.Header().Set("X-Checksum", "abc")
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Header().Set("X-Transfer-Encoding", strings.Join(r.TransferEncoding, ","))
+		_, _ = w.Write(b) //nolint:errcheck
+	})
+	mux.HandleFunc("/reject", func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	})
+	mux.HandleFunc("/header-size", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strconv.Itoa(len(r.Header.Get("X-Large"))))) //nolint:errcheck
+	})
+	mux.HandleFunc("/large-header", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Large", strings.Repeat("h", 64<<10))
+	})
+	mux.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host)) //nolint:errcheck
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/hello", http.StatusFound)
+	})
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("partial")) //nolint:errcheck
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	return mux
+}
+
+// conformanceTarget is a server reachable over a client.
+type conformanceTarget struct {
+	name    string
+	baseURL string
+	host    string
+	client  *http.Client
+}
+
+type conformanceResult struct {
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+func TestConformance(t *testing.T) {
+	h := conformanceHandler()
+
+	tcpSrv := httptest.NewServer(h)
+	defer tcpSrv.Close()
+
+	n, err := devnet.Start(devnet.Config{Servers: 1, Clients: 2})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
+
+	clients := n.Clients()
+	lis, err := clients[0].Listen(testPort)
+	require.NoError(t, err)
+	dmsgSrv := &http.Server{Handler: h}
+	go func() { _ = dmsgSrv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, dmsgSrv.Close()) }()
+
+	dmsgHost := dmsg.Addr{PK: clients[0].LocalPK(), Port: testPort}.String()
+	targets := []conformanceTarget{
+		{
+			name:    "tcp",
+			baseURL: tcpSrv.URL,
+			host:    strings.TrimPrefix(tcpSrv.URL, "http://"),
+			client:  &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Second}, Timeout: clientTimeout},
+		},
+		{
+			name:    "dmsg",
+			baseURL: "dmsg://" + dmsgHost,
+			host:    dmsgHost,
+			client: &http.Client{
+				Transport: dmsghttp.Transport{DmsgClient: clients[1], ExpectContinueTimeout: time.Second},
+				Timeout:   clientTimeout,
+			},
+		},
+	}
+
+	var rejectedBody *readSignal
+	scenarios := []struct {
+		name  string
+		req   func(t *testing.T, baseURL string) *http.Request
+		check func(t *testing.T, tgt conformanceTarget, r conformanceResult)
+	}{
+		{
+			name: "GET",
+			req:  newReq(http.MethodGet, "/hello", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, http.StatusOK, r.resp.StatusCode)
+				require.Equal(t, int64(12), r.resp.ContentLength)
+				require.Equal(t, "Hello World!", string(r.body))
+			},
+		},
+		{
+			name: "HEAD",
+			req:  newReq(http.MethodHead, "/hello", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, http.StatusOK, r.resp.StatusCode)
+				require.Equal(t, int64(12), r.resp.ContentLength)
+				require.Empty(t, r.body)
+			},
+		},
+		{
+			name: "204 without body",
+			req:  newReq(http.MethodGet, "/no-content", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, http.StatusNoContent, r.resp.StatusCode)
+				require.Empty(t, r.body)
+			},
+		},
+		{
+			name: "304 without body",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				req := newReq(http.MethodGet, "/not-modified", nil)(t, baseURL)
+				req.Header.Set("If-None-Match", `"v1"`)
+				return req
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, http.StatusNotModified, r.resp.StatusCode)
+				require.Equal(t, `"v1"`, r.resp.Header.Get("ETag"))
+				require.Empty(t, r.body)
+			},
+		},
+		{
+			name: "chunked response",
+			req:  newReq(http.MethodGet, "/chunked", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, []string{"chunked"}, r.resp.TransferEncoding)
+				require.Equal(t, int64(-1), r.resp.ContentLength)
+				require.Equal(t, "chunk0;chunk1;chunk2;", string(r.body))
+			},
+		},
+		{
+			name: "trailer",
+			req:  newReq(http.MethodGet, "/trailer", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, "body", string(r.body))
+				require.Equal(t, "abc", r.resp.Trailer.Get("X-Checksum"))
+			},
+		},
+		{
+			name: "chunked request",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				// hiding the type of the reader makes the length unknown
+				return newReq(http.MethodPost, "/echo", struct{ io.Reader }{strings.NewReader("streamed")})(t, baseURL)
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, "chunked", r.resp.Header.Get("X-Transfer-Encoding"))
+				require.Equal(t, "-1", r.resp.Header.Get("X-Content-Length"))
+				require.Equal(t, "streamed", string(r.body))
+			},
+		},
+		{
+			name: "Expect: 100-continue",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				req := newReq(http.MethodPost, "/echo", strings.NewReader("upload"))(t, baseURL)
+				req.Header.Set("Expect", "100-continue")
+				return req
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, http.StatusOK, r.resp.StatusCode)
+				require.Equal(t, "6", r.resp.Header.Get("X-Content-Length"))
+				require.Equal(t, "upload", string(r.body))
+			},
+		},
+		{
+			name: "Expect: 100-continue rejected",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				rejectedBody = &readSignal{read: make(chan struct{})}
+				req := newReq(http.MethodPost, "/reject", rejectedBody)(t, baseURL)
+				req.ContentLength = 1 << 20
+				req.Header.Set("Expect", "100-continue")
+				return req
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, http.StatusRequestEntityTooLarge, r.resp.StatusCode)
+				select {
+				case <-rejectedBody.read:
+					t.Fatal("body was sent")
+				default:
+				}
+			},
+		},
+		{
+			name: "request body read error",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				body := io.MultiReader(strings.NewReader("start"), failingReader{err: errBrokenBody})
+				req := newReq(http.MethodPost, "/echo", body)(t, baseURL)
+				req.ContentLength = 100
+				return req
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.True(t, errors.Is(r.err, errBrokenBody), r.err)
+			},
+		},
+		{
+			name: "Connection: close",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				req := newReq(http.MethodGet, "/hello", nil)(t, baseURL)
+				req.Close = true
+				return req
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.True(t, r.resp.Close)
+				require.Equal(t, "Hello World!", string(r.body))
+			},
+		},
+		{
+			name: "large request header",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				req := newReq(http.MethodGet, "/header-size", nil)(t, baseURL)
+				req.Header.Set("X-Large", strings.Repeat("h", 64<<10))
+				return req
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, strconv.Itoa(64<<10), string(r.body))
+			},
+		},
+		{
+			name: "large response header",
+			req:  newReq(http.MethodGet, "/large-header", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Len(t, r.resp.Header.Get("X-Large"), 64<<10)
+			},
+		},
+		{
+			name: "Host header",
+			req:  newReq(http.MethodGet, "/host", nil),
+			check: func(t *testing.T, tgt conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, tgt.host, string(r.body))
+			},
+		},
+		{
+			name: "relative redirect",
+			req:  newReq(http.MethodGet, "/redirect", nil),
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.NoError(t, r.err)
+				require.Equal(t, "/hello", r.resp.Request.URL.Path)
+				require.Equal(t, "Hello World!", string(r.body))
+			},
+		},
+		{
+			name: "context canceled during body",
+			req: func(t *testing.T, baseURL string) *http.Request {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Second, cancel)
+				return newReq(http.MethodGet, "/stall", nil)(t, baseURL).WithContext(ctx)
+			},
+			check: func(t *testing.T, _ conformanceTarget, r conformanceResult) {
+				require.Equal(t, context.Canceled, r.err)
+				require.Equal(t, "partial", string(r.body))
+			},
+		},
+	}
+
+	for _, sc := range scenarios {
+		sc := sc
+		t.Run(sc.name, func(t *testing.T) {
+			for _, tgt := range targets {
+				tgt := tgt
+				t.Run(tgt.name, func(t *testing.T) {
+					var r conformanceResult
+					r.resp, r.err = tgt.client.Do(sc.req(t, tgt.baseURL))
+					if r.err == nil {
+						r.body, r.err = ioutil.ReadAll(r.resp.Body)
+						require.NoError(t, r.resp.Body.Close())
+					}
+					sc.check(t, tgt, r)
+				})
+			}
+		})
+	}
+}
+
+// newReq returns a function creating a request for the given path of a target.
+func newReq(method, path string, body io.Reader) func(t *testing.T, baseURL string) *http.Request {
+	return func(t *testing.T, baseURL string) *http.Request {
+		req, err := http.NewRequest(method, baseURL+path, body)
+		require.NoError(t, err)
+		return req
+	}
+}
+
+var errBrokenBody = errors.New("broken body")
+
+// failingReader fails every read with err.
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+// readSignal is an endless request body which signals when it is read.
+type readSignal struct {
+	read chan struct{}
+	once sync.Once
+}
+
+func (s *readSignal) Read(p []byte) (int, error) {
+	s.once.Do(func() { close(s.read) })
+	return len(p), nil
+}
@@ -0,0 +1,228 @@
+// Package devnet runs a complete dmsg network in a single process: a discovery, dmsg servers and dmsg clients, all on
+// loopback addresses. It is meant for integration tests and local development without internet access.
+package devnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"golang.org/x/net/nettest"
+)
+
+// DefaultMaxSessions is the default number of sessions a dmsg server of the network accepts.
+const DefaultMaxSessions = 100
+
+// readyPollInterval is the interval in which Ready checks the state of the network.
+const readyPollInterval = 10 * time.Millisecond
+
+// ErrNoServers is returned when starting a network without dmsg servers.
+var ErrNoServers = errors.New("devnet needs at least one dmsg server")
+
+// Config describes the topology of a network.
+type Config struct {
+	// Servers is the number of dmsg servers.
+	Servers int
+
+	// Clients is the number of dmsg clients started along with the network.
+	// More clients can be added with AddClient.
+	Clients int
+
+	// MaxSessions is the number of sessions every dmsg server accepts.
+	// DefaultMaxSessions is used if zero.
+	MaxSessions int
+}
+
+// Network is a running dmsg network.
+type Network struct {
+	// DiscAddr is the URL of the discovery, to be used with disc.NewHTTP.
+	DiscAddr  string
+	Discovery *Discovery
+	Servers   []*dmsg.Server
+
+	conf    Config
+	discSrv *http.Server
+
+	mx      sync.Mutex
+	clients []*dmsg.Client
+
+	wg    sync.WaitGroup
+	errMx sync.Mutex
+	err   error
+}
+
+// Start starts a network. The network may not be ready when Start returns, see Ready.
+func Start(conf Config) (*Network, error) {
+	if conf.Servers < 1 {
+		return nil, ErrNoServers
+	}
+	if conf.MaxSessions == 0 {
+		conf.MaxSessions = DefaultMaxSessions
+	}
+
+	lis, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{
+		DiscAddr:  "http://" + lis.Addr().String(),
+		Discovery: NewDiscovery(),
+		conf:      conf,
+	}
+	n.discSrv = &http.Server{Handler: n.Discovery}
+	n.serve("discovery", func() error {
+		if err := n.discSrv.Serve(lis); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+
+	for i := 0; i < conf.Servers; i++ {
+		if err := n.addServer(); err != nil {
+			_ = n.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	for i := 0; i < conf.Clients; i++ {
+		n.AddClient()
+	}
+	return n, nil
+}
+
+// DiscClient returns a client of the network's discovery.
+func (n *Network) DiscClient() disc.APIClient {
+	return disc.NewHTTP(n.DiscAddr)
+}
+
+// Clients returns the dmsg clients of the network.
+func (n *Network) Clients() []*dmsg.Client {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return append([]*dmsg.Client(nil), n.clients...)
+}
+
+// AddClient starts a dmsg client with a random key pair.
+func (n *Network) AddClient() *dmsg.Client {
+	pk, sk := cipher.GenerateKeyPair()
+	return n.AddClientWithKeys(pk, sk)
+}
+
+// AddClientWithKeys starts a dmsg client with the given key pair.
+func (n *Network) AddClientWithKeys(pk cipher.PubKey, sk cipher.SecKey) *dmsg.Client {
+	c := dmsg.NewClient(pk, sk, n.DiscClient(), dmsg.DefaultConfig())
+	go c.Serve()
+
+	n.mx.Lock()
+	n.clients = append(n.clients, c)
+	n.mx.Unlock()
+	return c
+}
+
+func (n *Network) addServer() error {
+	lis, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		return err
+	}
+	pk, sk := cipher.GenerateKeyPair()
+	srv := dmsg.NewServer(pk, sk, n.DiscClient(), n.conf.MaxSessions)
+	n.Servers = append(n.Servers, srv)
+	n.serve(fmt.Sprintf("dmsg server %s", pk), func() error { return srv.Serve(lis, "") })
+	return nil
+}
+
+// Ready blocks until all servers are registered in the discovery and all clients have established their sessions,
+// or until ctx is done.
+func (n *Network) Ready(ctx context.Context) error {
+	t := time.NewTicker(readyPollInterval)
+	defer t.Stop()
+
+	for {
+		if err := n.Err(); err != nil {
+			return err
+		}
+		if n.ready() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// ready reports whether every server serves and every client is registered with sessions which the servers have
+// accepted, so that clients can reach each other.
+func (n *Network) ready() bool {
+	srvSessions := 0
+	for _, srv := range n.Servers {
+		select {
+		case <-srv.Ready():
+		default:
+			return false
+		}
+		srvSessions += srv.SessionCount()
+	}
+
+	clientSessions := 0
+	for _, c := range n.Clients() {
+		select {
+		case <-c.Ready():
+		default:
+			return false
+		}
+		clientSessions += c.SessionCount()
+	}
+	return srvSessions == clientSessions
+}
+
+// Err returns the first error with which a discovery or dmsg server of the network stopped.
+func (n *Network) Err() error {
+	n.errMx.Lock()
+	defer n.errMx.Unlock()
+	return n.err
+}
+
+// Close stops all clients, servers and the discovery.
+func (n *Network) Close() error {
+	for _, c := range n.Clients() {
+		_ = c.Close() //nolint:errcheck
+	}
+	for _, srv := range n.Servers {
+		_ = srv.Close() //nolint:errcheck
+	}
+	err := n.discSrv.Close()
+	n.wg.Wait()
+
+	if sErr := n.Err(); sErr != nil {
+		return sErr
+	}
+	return err
+}
+
+func (n *Network) serve(name string, fn func() error) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if err := fn(); err != nil && !isClosedErr(err) {
+			n.errMx.Lock()
+			if n.err == nil {
+				n.err = fmt.Errorf("%s: %v", name, err)
+			}
+			n.errMx.Unlock()
+		}
+	}()
+}
+
+// isClosedErr reports whether err results from closing a listener.
+func isClosedErr(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "accept"
+}
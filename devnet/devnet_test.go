@@ -0,0 +1,89 @@
+package devnet_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+func TestNetwork(t *testing.T) {
+	n, err := devnet.Start(devnet.Config{Servers: 2, Clients: 3})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
+
+	servers, err := n.DiscClient().AvailableServers(ctx)
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	require.Len(t, n.Discovery.Entries(), 5)
+
+	clients := n.Clients()
+	require.Len(t, clients, 3)
+	for _, c := range clients {
+		entry, err := n.DiscClient().Entry(ctx, c.LocalPK())
+		require.NoError(t, err)
+		require.NotEmpty(t, entry.Client.DelegatedServers)
+	}
+
+	lis, err := clients[0].Listen(1)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lis.Close()) }()
+
+	accepted := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		b, _ := ioutil.ReadAll(conn) //nolint:errcheck
+		accepted <- b
+	}()
+
+	stream, err := clients[2].DialStream(ctx, dmsg.Addr{PK: clients[0].LocalPK(), Port: 1})
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	require.Equal(t, []byte("hello"), <-accepted)
+}
+
+func TestDiscovery(t *testing.T) {
+	n, err := devnet.Start(devnet.Config{Servers: 1})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx := context.Background()
+	dc := n.DiscClient()
+	pk, sk := cipher.GenerateKeyPair()
+
+	_, err = dc.Entry(ctx, pk)
+	require.Equal(t, disc.ErrKeyNotFound, err)
+
+	entry := disc.NewClientEntry(pk, 1, nil)
+	require.NoError(t, entry.Sign(sk))
+	require.Equal(t, disc.ErrValidationNonZeroSequence, dc.PostEntry(ctx, entry))
+
+	entry = disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, dc.PostEntry(ctx, entry))
+
+	_, otherSK := cipher.GenerateKeyPair()
+	require.Equal(t, disc.ErrUnauthorized, dc.PutEntry(ctx, otherSK, entry))
+
+	require.NoError(t, dc.PutEntry(ctx, sk, entry))
+	stored, err := dc.Entry(ctx, pk)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stored.Sequence)
+}
@@ -0,0 +1,126 @@
+package devnet
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// Discovery paths, as used by disc.NewHTTP.
+const (
+	entryPath   = "/dmsg-discovery/entry/"
+	serversPath = "/dmsg-discovery/available_servers"
+)
+
+// Discovery is an in-memory dmsg discovery service which speaks the HTTP API of disc.NewHTTP.
+// Like the production discovery, it validates entries and their signatures and enforces increasing sequences.
+type Discovery struct {
+	mx      sync.RWMutex
+	entries map[cipher.PubKey]disc.Entry
+}
+
+// NewDiscovery creates an empty discovery.
+func NewDiscovery() *Discovery {
+	return &Discovery{entries: make(map[cipher.PubKey]disc.Entry)}
+}
+
+// Entries returns all entries known to the discovery.
+func (d *Discovery) Entries() []*disc.Entry {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+
+	out := make([]*disc.Entry, 0, len(d.entries))
+	for _, e := range d.entries {
+		entry := new(disc.Entry)
+		disc.Copy(entry, &e)
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Static.Hex() < out[j].Static.Hex() })
+	return out
+}
+
+func (d *Discovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == serversPath && r.Method == http.MethodGet:
+		d.availableServers(w)
+	case strings.TrimSuffix(r.URL.Path, "/")+"/" == entryPath && r.Method == http.MethodPost:
+		d.postEntry(w, r)
+	case strings.HasPrefix(r.URL.Path, entryPath) && r.Method == http.MethodGet:
+		d.entry(w, strings.TrimPrefix(r.URL.Path, entryPath))
+	default:
+		writeMessage(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+}
+
+func (d *Discovery) entry(w http.ResponseWriter, pkStr string) {
+	var pk cipher.PubKey
+	if err := pk.Set(pkStr); err != nil {
+		writeMessage(w, http.StatusBadRequest, disc.ErrBadInput.Error())
+		return
+	}
+
+	d.mx.RLock()
+	e, ok := d.entries[pk]
+	d.mx.RUnlock()
+	if !ok {
+		writeMessage(w, http.StatusNotFound, disc.ErrKeyNotFound.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func (d *Discovery) postEntry(w http.ResponseWriter, r *http.Request) {
+	var e disc.Entry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeMessage(w, http.StatusBadRequest, disc.ErrBadInput.Error())
+		return
+	}
+	if err := e.Validate(); err != nil {
+		writeMessage(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err := e.VerifySignature(); err != nil {
+		writeMessage(w, http.StatusUnauthorized, disc.ErrUnauthorized.Error())
+		return
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if prev, ok := d.entries[e.Static]; ok {
+		if err := prev.ValidateIteration(&e); err != nil {
+			writeMessage(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	} else if e.Sequence != 0 {
+		writeMessage(w, http.StatusUnprocessableEntity, disc.ErrValidationNonZeroSequence.Error())
+		return
+	}
+	d.entries[e.Static] = e
+	writeJSON(w, http.StatusOK, disc.MsgEntrySet)
+}
+
+func (d *Discovery) availableServers(w http.ResponseWriter) {
+	servers := make([]*disc.Entry, 0)
+	for _, e := range d.Entries() {
+		if e.Server != nil && e.Server.AvailableSessions > 0 {
+			servers = append(servers, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, servers)
+}
+
+func writeMessage(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, disc.HTTPMessage{Message: msg, Code: code})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
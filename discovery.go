@@ -0,0 +1,233 @@
+package dmsghttp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// Default discovery cache settings.
+const (
+	DefaultDiscoveryTTL         = time.Minute
+	DefaultDiscoveryNegativeTTL = 5 * time.Second
+
+	// DefaultDiscoveryLookupTimeout bounds a coalesced lookup, which does not end with the context of a caller.
+	DefaultDiscoveryLookupTimeout = 30 * time.Second
+)
+
+// CachingDiscovery is a disc.APIClient which caches the entries and server lists of another disc.APIClient.
+// Concurrent lookups of the same key are coalesced into a single request, which is not cancelled with the context of
+// any caller but ends after DefaultDiscoveryLookupTimeout. Every caller stops waiting for it once its context is done.
+type CachingDiscovery struct {
+	dc     disc.APIClient
+	ttl    time.Duration
+	negTTL time.Duration
+
+	mx      sync.Mutex
+	entries map[cipher.PubKey]cachedEntry
+	gen     uint64 // incremented by Invalidate, so lookups started before do not cache stale entries
+
+	servers        []*disc.Entry
+	serversExpires time.Time
+
+	flights flightGroup
+}
+
+type cachedEntry struct {
+	entry   *disc.Entry
+	err     error
+	expires time.Time
+}
+
+// NewCachingDiscovery caches the entries returned by dc for ttl and unknown keys for negTTL.
+// Unknown keys are not cached if negTTL is zero. Other errors are never cached.
+func NewCachingDiscovery(dc disc.APIClient, ttl, negTTL time.Duration) *CachingDiscovery {
+	return &CachingDiscovery{
+		dc:      dc,
+		ttl:     ttl,
+		negTTL:  negTTL,
+		entries: make(map[cipher.PubKey]cachedEntry),
+	}
+}
+
+// Entry implements disc.APIClient.
+func (d *CachingDiscovery) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	d.mx.Lock()
+	e, ok := d.entries[pk]
+	d.mx.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return copyEntry(e.entry), nil
+	}
+
+	v, err := d.flights.do(ctx, "entry:"+pk.Hex(), func(ctx context.Context) (interface{}, error) {
+		d.mx.Lock()
+		gen := d.gen
+		d.mx.Unlock()
+
+		entry, err := d.dc.Entry(ctx, pk)
+		now := time.Now()
+		switch {
+		case err == nil && d.ttl > 0:
+			d.setEntry(pk, gen, cachedEntry{entry: entry, expires: now.Add(d.ttl)})
+		case isKeyNotFound(err) && d.negTTL > 0:
+			d.setEntry(pk, gen, cachedEntry{err: err, expires: now.Add(d.negTTL)})
+		}
+		return entry, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyEntry(v.(*disc.Entry)), nil
+}
+
+// PostEntry implements disc.APIClient. The cached entry of the key is dropped.
+func (d *CachingDiscovery) PostEntry(ctx context.Context, entry *disc.Entry) error {
+	defer d.Invalidate(entry.Static)
+	return d.dc.PostEntry(ctx, entry)
+}
+
+// PutEntry implements disc.APIClient. The cached entry of the key is dropped.
+func (d *CachingDiscovery) PutEntry(ctx context.Context, sk cipher.SecKey, entry *disc.Entry) error {
+	defer d.Invalidate(entry.Static)
+	return d.dc.PutEntry(ctx, sk, entry)
+}
+
+// AvailableServers implements disc.APIClient.
+func (d *CachingDiscovery) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	d.mx.Lock()
+	servers, expires := d.servers, d.serversExpires
+	d.mx.Unlock()
+	if time.Now().Before(expires) {
+		return copyEntries(servers), nil
+	}
+
+	v, err := d.flights.do(ctx, "servers", func(ctx context.Context) (interface{}, error) {
+		entries, err := d.dc.AvailableServers(ctx)
+		// empty lists are not cached, so that servers which come up are found at once
+		if err == nil && len(entries) > 0 && d.ttl > 0 {
+			d.mx.Lock()
+			d.servers, d.serversExpires = entries, time.Now().Add(d.ttl)
+			d.mx.Unlock()
+		}
+		return entries, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyEntries(v.([]*disc.Entry)), nil
+}
+
+// Invalidate drops the cached entry of a key, e.g. because dialing it through its delegated servers failed.
+func (d *CachingDiscovery) Invalidate(pk cipher.PubKey) {
+	d.mx.Lock()
+	delete(d.entries, pk)
+	d.gen++
+	d.mx.Unlock()
+}
+
+func (d *CachingDiscovery) setEntry(pk cipher.PubKey, gen uint64, e cachedEntry) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if gen != d.gen {
+		return
+	}
+
+	if len(d.entries) >= maxCachedNames {
+		now := time.Now()
+		for k, old := range d.entries {
+			if !now.Before(old.expires) {
+				delete(d.entries, k)
+			}
+		}
+	}
+	d.entries[pk] = e
+}
+
+// copyEntry returns a deep copy of a cached entry, as callers are free to modify returned entries.
+func copyEntry(e *disc.Entry) *disc.Entry {
+	out := new(disc.Entry)
+	disc.Copy(out, e)
+	return out
+}
+
+func copyEntries(entries []*disc.Entry) []*disc.Entry {
+	out := make([]*disc.Entry, len(entries))
+	for i, e := range entries {
+		out[i] = copyEntry(e)
+	}
+	return out
+}
+
+// isKeyNotFound reports whether err is the discovery's response to an unknown key.
+// The HTTP client returns disc.ErrKeyNotFound while the mock client only includes its message.
+func isKeyNotFound(err error) bool {
+	return err != nil && (err == disc.ErrKeyNotFound || strings.Contains(err.Error(), disc.ErrKeyNotFound.Error()))
+}
+
+// flightGroup coalesces concurrent calls with the same key into a single call.
+type flightGroup struct {
+	mx    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// do calls fn unless a call for key is in flight, in which case its result is awaited instead.
+// fn runs in its own goroutine with a context which keeps the values of ctx, but is only cancelled after
+// DefaultDiscoveryLookupTimeout, so that a caller giving up does not fail the others. Waiting is aborted if ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string,
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mx.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f, ok := g.calls[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		g.calls[key] = f
+		go g.run(ctx, key, f, fn)
+	}
+	g.mx.Unlock()
+
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, f *flight, fn func(ctx context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(detachedContext{parent: ctx}, DefaultDiscoveryLookupTimeout)
+	defer cancel()
+
+	f.val, f.err = fn(ctx)
+
+	g.mx.Lock()
+	delete(g.calls, key)
+	g.mx.Unlock()
+	close(f.done)
+}
+
+// NewTransport creates a Transport with a dmsg client of the given key pair, which looks up the discovery dc through
+// a CachingDiscovery with the default TTLs. The dmsg client is served in the background and has to be closed by the
+// caller.
+func NewTransport(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, conf *dmsg.Config) Transport {
+	cd := NewCachingDiscovery(dc, DefaultDiscoveryTTL, DefaultDiscoveryNegativeTTL)
+	dmsgC := dmsg.NewClient(pk, sk, cd, conf)
+	go dmsgC.Serve()
+	return Transport{DmsgClient: dmsgC, Discovery: cd}
+}
@@ -0,0 +1,260 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// countingDisc counts the entry lookups of a disc.APIClient.
+// Lookups block while gate is non-nil and open, or until their context is done.
+type countingDisc struct {
+	disc.APIClient
+	gate chan struct{}
+
+	mx          sync.Mutex
+	calls       map[cipher.PubKey]int
+	serverCalls int
+}
+
+func newCountingDisc(dc disc.APIClient) *countingDisc {
+	return &countingDisc{APIClient: dc, calls: make(map[cipher.PubKey]int)}
+}
+
+func (d *countingDisc) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	d.mx.Lock()
+	d.calls[pk]++
+	d.mx.Unlock()
+	if d.gate != nil {
+		select {
+		case <-d.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return d.APIClient.Entry(ctx, pk)
+}
+
+func (d *countingDisc) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	d.mx.Lock()
+	d.serverCalls++
+	d.mx.Unlock()
+	return d.APIClient.AvailableServers(ctx)
+}
+
+func (d *countingDisc) serverCount() int {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.serverCalls
+}
+
+func (d *countingDisc) count(pk cipher.PubKey) int {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.calls[pk]
+}
+
+func TestCachingDiscovery(t *testing.T) {
+	ctx := context.Background()
+	pk, sk := cipher.GenerateKeyPair()
+	srvPK, _ := cipher.GenerateKeyPair()
+
+	newEntry := func(t *testing.T, dc disc.APIClient) {
+		entry := disc.NewClientEntry(pk, 0, []cipher.PubKey{srvPK})
+		require.NoError(t, entry.Sign(sk))
+		require.NoError(t, dc.PostEntry(ctx, entry))
+	}
+
+	t.Run("caches entries", func(t *testing.T) {
+		counting := newCountingDisc(disc.NewMock())
+		newEntry(t, counting)
+		cd := dmsghttp.NewCachingDiscovery(counting, time.Minute, time.Minute)
+
+		for i := 0; i < 3; i++ {
+			entry, err := cd.Entry(ctx, pk)
+			require.NoError(t, err)
+			require.Equal(t, []cipher.PubKey{srvPK}, entry.Client.DelegatedServers)
+
+			// returned entries are copies
+			entry.Client.DelegatedServers = nil
+		}
+		require.Equal(t, 1, counting.count(pk))
+
+		cd.Invalidate(pk)
+		_, err := cd.Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, 2, counting.count(pk))
+	})
+
+	t.Run("caches unknown keys", func(t *testing.T) {
+		counting := newCountingDisc(disc.NewMock())
+		cd := dmsghttp.NewCachingDiscovery(counting, time.Minute, time.Minute)
+
+		for i := 0; i < 3; i++ {
+			_, err := cd.Entry(ctx, pk)
+			require.Error(t, err)
+		}
+		require.Equal(t, 1, counting.count(pk))
+
+		// posting an entry through the cache drops the negative entry
+		newEntry(t, cd)
+		_, err := cd.Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, 2, counting.count(pk))
+	})
+
+	t.Run("expires entries", func(t *testing.T) {
+		counting := newCountingDisc(disc.NewMock())
+		newEntry(t, counting)
+		cd := dmsghttp.NewCachingDiscovery(counting, 10*time.Millisecond, 0)
+
+		_, err := cd.Entry(ctx, pk)
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		_, err = cd.Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, 2, counting.count(pk))
+	})
+
+	t.Run("coalesces concurrent lookups", func(t *testing.T) {
+		counting := newCountingDisc(disc.NewMock())
+		newEntry(t, counting)
+		counting.gate = make(chan struct{})
+		cd := dmsghttp.NewCachingDiscovery(counting, time.Minute, time.Minute)
+
+		const n = 10
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				_, err := cd.Entry(ctx, pk)
+				errs <- err
+			}()
+		}
+		require.Eventually(t, func() bool { return counting.count(pk) == 1 }, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond) // let the other lookups join the one in flight
+		close(counting.gate)
+
+		for i := 0; i < n; i++ {
+			require.NoError(t, <-errs)
+		}
+		require.Equal(t, 1, counting.count(pk))
+	})
+
+	t.Run("lookups outlive the caller starting them", func(t *testing.T) {
+		counting := newCountingDisc(disc.NewMock())
+		newEntry(t, counting)
+		counting.gate = make(chan struct{})
+		cd := dmsghttp.NewCachingDiscovery(counting, time.Minute, time.Minute)
+
+		firstCtx, cancel := context.WithCancel(ctx)
+		firstErr := make(chan error, 1)
+		go func() {
+			_, err := cd.Entry(firstCtx, pk)
+			firstErr <- err
+		}()
+		require.Eventually(t, func() bool { return counting.count(pk) == 1 }, time.Second, time.Millisecond)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := cd.Entry(ctx, pk)
+			errs <- err
+		}()
+		time.Sleep(20 * time.Millisecond) // let the second lookup join the one in flight
+
+		cancel()
+		require.Equal(t, context.Canceled, <-firstErr)
+		close(counting.gate)
+		require.NoError(t, <-errs)
+		require.Equal(t, 1, counting.count(pk))
+	})
+
+	t.Run("does not cache empty server lists", func(t *testing.T) {
+		counting := newCountingDisc(disc.NewMock())
+		cd := dmsghttp.NewCachingDiscovery(counting, time.Minute, time.Minute)
+
+		servers, err := cd.AvailableServers(ctx)
+		require.NoError(t, err)
+		require.Empty(t, servers)
+
+		srvEntry := disc.NewServerEntry(srvPK, 0, "localhost:8080", 10)
+		require.NoError(t, counting.PostEntry(ctx, srvEntry))
+		for i := 0; i < 3; i++ {
+			servers, err = cd.AvailableServers(ctx)
+			require.NoError(t, err)
+			require.Len(t, servers, 1)
+		}
+		require.Equal(t, 2, counting.serverCount())
+	})
+}
+
+func TestTransportInvalidatesDiscovery(t *testing.T) {
+	dmsgD := disc.NewMock()
+	dmsgS, dmsgSErr := createDmsgSrv(t, dmsgD)
+	defer func() {
+		require.NoError(t, dmsgS.Close())
+		for err := range dmsgSErr {
+			require.NoError(t, err)
+		}
+	}()
+
+	dmsgServerClient := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgServerClient.Close()) }()
+
+	list, err := dmsgServerClient.Listen(testPort)
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("Hello World!")) //nolint:errcheck
+		}),
+	}
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- srv.Serve(list)
+		close(sErr)
+	}()
+	defer func() {
+		require.NoError(t, srv.Close())
+		require.Equal(t, http.ErrServerClosed, <-sErr)
+	}()
+
+	counting := newCountingDisc(dmsgD)
+	pk, sk := cipher.GenerateKeyPair()
+	tr := dmsghttp.NewTransport(pk, sk, counting, dmsg.DefaultConfig())
+	defer func() { require.NoError(t, tr.DmsgClient.Close()) }()
+
+	select {
+	case <-tr.DmsgClient.Ready():
+	case <-time.After(clientTimeout):
+		t.Fatal("dmsg client is not ready")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c := &http.Client{Transport: tr, Timeout: clientTimeout}
+	serverPK := dmsgServerClient.LocalPK()
+	url := "dmsg://" + dmsg.Addr{PK: serverPK, Port: testPort}.String() + "/"
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, "Hello World!", getBody(t, c, url))
+	}
+	require.Equal(t, 1, counting.count(serverPK))
+
+	// dialing a port nobody listens on fails and drops the cached entry
+	req, err := http.NewRequest(http.MethodGet, "dmsg://"+dmsg.Addr{PK: serverPK, Port: testPort + 1}.String()+"/", nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = c.Do(req.WithContext(ctx))
+	require.Error(t, err)
+	require.Equal(t, "Hello World!", getBody(t, c, url))
+	require.Equal(t, 2, counting.count(serverPK))
+}
@@ -1,6 +1,7 @@
 package dmsghttp_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,12 +16,12 @@ import (
 	"golang.org/x/net/nettest"
 
 	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
 )
 
 const (
 	testPort         uint16 = 8081
 	clientTimeout           = 30 * time.Second
-	discoveryAddr           = "http://dmsg.discovery.skywire.cc"
 	parallelRequests        = 20
 )
 
@@ -39,7 +40,7 @@ func TestDmsgHTTP(t *testing.T) {
 	dmsgServerClient := dmsg.NewClient(sPK, sSK, dmsgD, dmsg.DefaultConfig())
 	go dmsgServerClient.Serve()
 
-	time.Sleep(time.Second) // wait for dmsg client to be ready
+	waitReady(t, dmsgServerClient)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
@@ -72,18 +73,9 @@ func TestDmsgHTTP(t *testing.T) {
 
 	// generate keys and initiate client
 	cPK, cSK := cipher.GenerateKeyPair()
-	dmsgClient := dmsg.NewClient(cPK, cSK, dmsgD, dmsg.DefaultConfig())
-	go dmsgServerClient.Serve()
-
-	time.Sleep(time.Second) // wait for dmsg client to be ready
-
-	dmsgTransport := dmsghttp.Transport{
-		DmsgClient: dmsgClient,
-	}
-	c := &http.Client{
-		Transport: dmsgTransport,
-		Timeout:   clientTimeout,
-	}
+	c, dmsgClient, err := dmsghttp.NewHTTPClient(cPK, cSK, dmsgD, dmsghttp.WithTimeout(clientTimeout))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, dmsgClient.Close()) }()
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("dmsg://%v:%d/", sPK.Hex(), testPort), nil)
 	require.NoError(t, err)
@@ -111,7 +103,7 @@ func TestDmsgHTTPTargetingSpecificRoute(t *testing.T) {
 	dmsgServerClient := dmsg.NewClient(sPK, sSK, dmsgD, dmsg.DefaultConfig())
 	go dmsgServerClient.Serve()
 
-	time.Sleep(time.Second) // wait for dmsg client to be ready
+	waitReady(t, dmsgServerClient)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/route", func(w http.ResponseWriter, _ *http.Request) {
@@ -147,7 +139,7 @@ func TestDmsgHTTPTargetingSpecificRoute(t *testing.T) {
 	dmsgClient := dmsg.NewClient(cPK, cSK, dmsgD, dmsg.DefaultConfig())
 	go dmsgClient.Serve()
 
-	time.Sleep(time.Second) // wait for dmsg client to be ready
+	waitReady(t, dmsgClient)
 
 	dmsgTransport := dmsghttp.Transport{
 		DmsgClient: dmsgClient,
@@ -183,7 +175,7 @@ func TestDmsgHTTPWithMultipleRoutes(t *testing.T) {
 	dmsgServerClient := dmsg.NewClient(sPK, sSK, dmsgD, dmsg.DefaultConfig())
 	go dmsgServerClient.Serve()
 
-	time.Sleep(time.Second) // wait for dmsg client to be ready
+	waitReady(t, dmsgServerClient)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
@@ -231,7 +223,7 @@ func TestDmsgHTTPWithMultipleRoutes(t *testing.T) {
 	dmsgClient := dmsg.NewClient(cPK, cSK, dmsgD, dmsg.DefaultConfig())
 	go dmsgClient.Serve()
 
-	time.Sleep(time.Second) // wait for dmsg client to be ready
+	waitReady(t, dmsgClient)
 
 	dmsgTransport := dmsghttp.Transport{
 		DmsgClient: dmsgClient,
@@ -275,14 +267,16 @@ func TestDmsgHTTPWithMultipleRoutes(t *testing.T) {
 }
 
 func TestDmsgHTTPParallelRequests(t *testing.T) {
-	dmsgD := disc.NewHTTP(discoveryAddr)
+	n, err := devnet.Start(devnet.Config{Servers: 2, Clients: 2})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
 
-	// generate keys and create server
-	sPK, sSK := cipher.GenerateKeyPair()
-	dmsgServerClient := dmsg.NewClient(sPK, sSK, dmsgD, dmsg.DefaultConfig())
-	go dmsgServerClient.Serve()
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
 
-	time.Sleep(time.Second) // wait for dmsg client to be ready
+	clients := n.Clients()
+	dmsgServerClient, dmsgClient := clients[0], clients[1]
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
@@ -297,9 +291,7 @@ func TestDmsgHTTPParallelRequests(t *testing.T) {
 	}
 
 	list, err := dmsgServerClient.Listen(testPort)
-	if err != nil {
-		panic(err)
-	}
+	require.NoError(t, err)
 
 	sErr := make(chan error, 1)
 	go func() {
@@ -313,13 +305,6 @@ func TestDmsgHTTPParallelRequests(t *testing.T) {
 		require.Equal(t, "http: Server closed", err.Error())
 	}()
 
-	// generate keys and initiate client
-	cPK, cSK := cipher.GenerateKeyPair()
-	dmsgClient := dmsg.NewClient(cPK, cSK, dmsgD, dmsg.DefaultConfig())
-	go dmsgServerClient.Serve()
-
-	time.Sleep(time.Second) // wait for dmsg client to be ready
-
 	dmsgTransport := dmsghttp.Transport{
 		DmsgClient: dmsgClient,
 	}
@@ -328,11 +313,13 @@ func TestDmsgHTTPParallelRequests(t *testing.T) {
 		Timeout:   clientTimeout,
 	}
 
+	sPK := dmsgServerClient.LocalPK()
 	wg := &sync.WaitGroup{}
 	wg.Add(parallelRequests)
 	starter := make(chan struct{})
 	for i := 0; i < parallelRequests; i++ {
 		go func() {
+			defer wg.Done()
 			<-starter
 			req, err := http.NewRequest("GET", fmt.Sprintf("dmsg://%v:%d/", sPK.Hex(), testPort), nil)
 			require.NoError(t, err)
@@ -342,13 +329,12 @@ func TestDmsgHTTPParallelRequests(t *testing.T) {
 
 			respB, err := ioutil.ReadAll(resp.Body)
 			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
 			require.Equal(t, "Hello World!", string(respB))
-			wg.Done()
 		}()
 	}
 	close(starter)
 	wg.Wait()
-
 }
 
 func createDmsgSrv(t *testing.T, dc disc.APIClient) (srv *dmsg.Server, srvErr <-chan error) {
@@ -364,3 +350,18 @@ func createDmsgSrv(t *testing.T, dc disc.APIClient) (srv *dmsg.Server, srvErr <-
 	}()
 	return srv, errCh
 }
+
+// waitReady waits until the dmsg client has a session with a dmsg server.
+func waitReady(t *testing.T, c *dmsg.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, dmsghttp.Transport{DmsgClient: c}.Ready(ctx))
+}
+
+func createDmsgClient(t *testing.T, dc disc.APIClient) *dmsg.Client {
+	pk, sk := cipher.GenerateKeyPair()
+	c := dmsg.NewClient(pk, sk, dc, dmsg.DefaultConfig())
+	go c.Serve()
+	waitReady(t, c)
+	return c
+}
@@ -0,0 +1,332 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Download errors.
+var (
+	ErrNoDigest       = errors.New("server did not advertise a SHA-256 digest")
+	ErrDigestMismatch = errors.New("downloaded file does not match the advertised SHA-256 digest")
+	ErrDigestChanged  = errors.New("advertised SHA-256 digest changed during download")
+)
+
+// Default download settings.
+const (
+	DefaultDownloadRetries    = 5
+	DefaultDownloadRetryDelay = time.Second
+)
+
+// ProgressFunc reports the progress of a download.
+// Total is -1 if the size of the file is not known.
+type ProgressFunc func(written, total int64)
+
+// Downloader downloads files with HTTP range requests, resuming whenever the transfer is interrupted.
+// The result is verified against the digest which the server advertises in the SHA256Header header.
+type Downloader struct {
+	Client *http.Client
+
+	// Progress is called whenever data is written to the destination file.
+	Progress ProgressFunc
+
+	// MaxRetries is the number of consecutive failed attempts after which the download is abandoned.
+	// DefaultDownloadRetries is used if zero.
+	MaxRetries int
+
+	// RetryDelay is the time to wait before resuming an interrupted download.
+	// DefaultDownloadRetryDelay is used if zero.
+	RetryDelay time.Duration
+}
+
+// Download downloads url into the file dst using the given client.
+// See Downloader for details.
+func Download(ctx context.Context, client *http.Client, url, dst string) error {
+	d := Downloader{Client: client}
+	return d.Download(ctx, url, dst)
+}
+
+// download holds the state of a single download.
+type download struct {
+	d          *Downloader
+	url        string
+	f          *os.File
+	offset     int64
+	total      int64
+	digest     string
+	digestFile string // keeps digest next to the part file, so a resumed download sends If-Range
+}
+
+// Download downloads url into the file dst.
+// Data is written to dst + ".part" first, so an unfinished download is resumed by calling Download again. The
+// advertised digest is kept in dst + ".part.sha256", so a resumed download starts over if the remote file changed.
+// The part file is renamed to dst once it is verified.
+func (d *Downloader) Download(ctx context.Context, url, dst string) error {
+	part := dst + ".part"
+	digestFile := part + ".sha256"
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	dl := &download{d: d, url: url, f: f, offset: fi.Size(), total: -1, digestFile: digestFile}
+	if dl.offset > 0 {
+		if b, err := ioutil.ReadFile(digestFile); err == nil { //nolint:gosec
+			dl.digest = strings.TrimSpace(string(b))
+		}
+	}
+	if err := dl.run(ctx); err != nil {
+		return err
+	}
+
+	if err := verifyFile(part, dl.digest); err != nil {
+		if errors.Is(err, ErrDigestMismatch) {
+			_ = f.Close()             //nolint:errcheck
+			_ = os.Remove(part)       //nolint:errcheck
+			_ = os.Remove(digestFile) //nolint:errcheck
+		}
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+	_ = os.Remove(digestFile) //nolint:errcheck
+	return nil
+}
+
+func (dl *download) run(ctx context.Context) error {
+	maxRetries := dl.d.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultDownloadRetries
+	}
+	delay := dl.d.RetryDelay
+	if delay == 0 {
+		delay = DefaultDownloadRetryDelay
+	}
+
+	failures := 0
+	for {
+		prevOffset := dl.offset
+		done, err := dl.attempt(ctx)
+		if done {
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var pErr permanentError
+		if errors.As(err, &pErr) {
+			return pErr.error
+		}
+
+		// Only consecutive attempts which made no progress count as failures.
+		if dl.offset > prevOffset {
+			failures = 0
+		}
+		if failures++; failures > maxRetries {
+			return fmt.Errorf("download failed after %d attempts: %v", failures, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// attempt performs a single request, continuing from the current offset.
+func (dl *download) attempt(ctx context.Context) (done bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, dl.url, nil)
+	if err != nil {
+		return false, permanent(err)
+	}
+	req = req.WithContext(ctx)
+	if dl.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", dl.offset))
+		if dl.digest != "" {
+			req.Header.Set("If-Range", `"`+dl.digest+`"`)
+		}
+	}
+
+	resp, err := dl.d.client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The whole file is sent, either because no range was requested or the file changed.
+		if err := dl.reset(); err != nil {
+			return false, permanent(err)
+		}
+		dl.total = resp.ContentLength
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return false, permanent(err)
+		}
+		if start != dl.offset {
+			return false, permanent(fmt.Errorf("unexpected range start %d, expected %d", start, dl.offset))
+		}
+		dl.total = total
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The part file is larger than the remote file, start over.
+		return false, dl.reset()
+	default:
+		err := fmt.Errorf("unexpected response status: %s", resp.Status)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return false, err
+		}
+		return false, permanent(err)
+	}
+
+	digest := resp.Header.Get(SHA256Header)
+	if digest == "" {
+		return false, permanent(ErrNoDigest)
+	}
+	if resp.StatusCode == http.StatusPartialContent && dl.digest != "" && dl.digest != digest {
+		// The server ignored If-Range although the file changed.
+		if err := dl.reset(); err != nil {
+			return false, permanent(err)
+		}
+		if err := dl.setDigest(digest); err != nil {
+			return false, permanent(err)
+		}
+		return false, ErrDigestChanged
+	}
+	if err := dl.setDigest(digest); err != nil {
+		return false, permanent(err)
+	}
+
+	if err := dl.copy(resp.Body); err != nil {
+		return false, err
+	}
+	return dl.total < 0 || dl.offset >= dl.total, nil
+}
+
+func (dl *download) copy(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, rErr := r.Read(buf)
+		if n > 0 {
+			if _, err := dl.f.WriteAt(buf[:n], dl.offset); err != nil {
+				return permanent(err)
+			}
+			dl.offset += int64(n)
+			if dl.d.Progress != nil {
+				dl.d.Progress(dl.offset, dl.total)
+			}
+		}
+		if rErr == io.EOF {
+			if dl.total >= 0 && dl.offset < dl.total {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if rErr != nil {
+			return rErr
+		}
+	}
+}
+
+// setDigest records the advertised digest, persisting it if it changed.
+func (dl *download) setDigest(digest string) error {
+	if digest == dl.digest {
+		return nil
+	}
+	dl.digest = digest
+	return writeFileAtomic(dl.digestFile, []byte(digest))
+}
+
+func (dl *download) reset() error {
+	if err := dl.f.Truncate(0); err != nil {
+		return err
+	}
+	dl.offset = 0
+	return nil
+}
+
+// verifyFile checks the file of the given name against a hex encoded SHA-256 digest.
+func verifyFile(name, digest string) error {
+	want, err := parseSHA256(digest)
+	if err != nil {
+		return fmt.Errorf("invalid advertised digest: %v", err)
+	}
+
+	f, err := os.Open(name) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	got, err := sumSHA256(f)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+func (d *Downloader) client() *http.Client {
+	if d.Client == nil {
+		return http.DefaultClient
+	}
+	return d.Client
+}
+
+// parseContentRange parses the start offset and complete length of a "bytes start-end/total" Content-Range value.
+func parseContentRange(s string) (start, total int64, err error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+	slash := strings.IndexByte(s, '/')
+	dash := strings.IndexByte(s, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if start, err = strconv.ParseInt(s[:dash], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q: %v", s, err)
+	}
+	total = -1
+	if s[slash+1:] != "*" {
+		if total, err = strconv.ParseInt(s[slash+1:], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q: %v", s, err)
+		}
+	}
+	return start, total, nil
+}
+
+// permanentError marks errors that are not resolved by retrying.
+type permanentError struct{ error }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
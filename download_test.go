@@ -0,0 +1,220 @@
+package dmsghttp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+// abortingWriter aborts the response after limit bytes of the body are written.
+type abortingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *abortingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		n, _ := w.ResponseWriter.Write(b[:w.limit]) //nolint:errcheck
+		w.limit -= n
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_download")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	srcDir := filepath.Join(dir, "src")
+	require.NoError(t, os.Mkdir(srcDir, 0700))
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(srcDir, "file.bin"), content, 0600))
+
+	files := dmsghttp.NewFileServer(http.Dir(srcDir), dmsghttp.FileServerConfig{})
+
+	t.Run("resumes interrupted transfers", func(t *testing.T) {
+		var (
+			mx     sync.Mutex
+			ranges []string
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			n := len(ranges)
+			mx.Unlock()
+
+			// drop the first two transfers half way
+			if n <= 2 {
+				w = &abortingWriter{ResponseWriter: w, limit: len(content) / 4}
+			}
+			files.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+
+		var written, total int64
+		d := dmsghttp.Downloader{
+			Client:     srv.Client(),
+			RetryDelay: time.Millisecond,
+			Progress: func(w, t int64) {
+				written, total = w, t
+			},
+		}
+
+		dst := filepath.Join(dir, "resumed.bin")
+		require.NoError(t, d.Download(context.Background(), srv.URL+"/file.bin", dst))
+
+		got, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Equal(t, int64(len(content)), written)
+		require.Equal(t, int64(len(content)), total)
+
+		_, err = os.Stat(dst + ".part")
+		require.True(t, os.IsNotExist(err))
+
+		require.Len(t, ranges, 3)
+		require.Equal(t, "", ranges[0])
+		require.NotEqual(t, "", ranges[1])
+		require.NotEqual(t, "", ranges[2])
+	})
+
+	t.Run("continues existing part file", func(t *testing.T) {
+		srv := httptest.NewServer(files)
+		defer srv.Close()
+
+		dst := filepath.Join(dir, "continued.bin")
+		require.NoError(t, ioutil.WriteFile(dst+".part", content[:1234], 0600))
+
+		require.NoError(t, dmsghttp.Download(context.Background(), srv.Client(), srv.URL+"/file.bin", dst))
+
+		got, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+	})
+
+	t.Run("rejects digest mismatch", func(t *testing.T) {
+		srv := httptest.NewServer(files)
+		defer srv.Close()
+
+		dst := filepath.Join(dir, "corrupt.bin")
+		// a corrupt part file which is consistent in size with the remote file
+		corrupt := append([]byte{}, content[:5000]...)
+		corrupt[0] ^= 0xff
+		require.NoError(t, ioutil.WriteFile(dst+".part", corrupt, 0600))
+
+		err := dmsghttp.Download(context.Background(), srv.Client(), srv.URL+"/file.bin", dst)
+		require.Equal(t, dmsghttp.ErrDigestMismatch, err)
+
+		_, err = os.Stat(dst + ".part")
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(dst)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("requires digest", func(t *testing.T) {
+		srv := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+		defer srv.Close()
+
+		err := dmsghttp.Download(context.Background(), srv.Client(), srv.URL+"/file.bin", filepath.Join(dir, "x.bin"))
+		require.Equal(t, dmsghttp.ErrNoDigest, err)
+	})
+
+	t.Run("restarts changed files over dmsg", func(t *testing.T) {
+		n, err := devnet.Start(devnet.Config{Servers: 1, Clients: 2})
+		require.NoError(t, err)
+		defer func() { require.NoError(t, n.Close()) }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		defer cancel()
+		require.NoError(t, n.Ready(ctx))
+		srvC, cliC := n.Clients()[0], n.Clients()[1]
+
+		name := filepath.Join(srcDir, "changing.bin")
+		require.NoError(t, ioutil.WriteFile(name, content, 0600))
+
+		// the first transfer stalls half way, until the client gives up
+		var (
+			mx       sync.Mutex
+			requests int
+		)
+		lis, err := srvC.Listen(testPort)
+		require.NoError(t, err)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			requests++
+			n := requests
+			mx.Unlock()
+
+			if n == 1 {
+				w = &stallingWriter{ResponseWriter: w, limit: len(content) / 2, ctx: r.Context()}
+			}
+			files.ServeHTTP(w, r)
+		})}
+		go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+		defer func() { require.NoError(t, srv.Close()) }()
+
+		c := &http.Client{Transport: dmsghttp.Transport{DmsgClient: cliC}, Timeout: clientTimeout}
+		url := "dmsg://" + dmsg.Addr{PK: srvC.LocalPK(), Port: testPort}.String() + "/changing.bin"
+		dst := filepath.Join(dir, "changing.bin")
+
+		dlCtx, dlCancel := context.WithCancel(ctx)
+		d := dmsghttp.Downloader{Client: c, Progress: func(written, _ int64) {
+			if written >= int64(len(content)/2) {
+				dlCancel()
+			}
+		}}
+		require.Equal(t, context.Canceled, d.Download(dlCtx, url, dst))
+		digest, err := ioutil.ReadFile(dst + ".part.sha256")
+		require.NoError(t, err)
+		sum := sha256.Sum256(content)
+		require.Equal(t, hex.EncodeToString(sum[:]), string(digest))
+
+		// the remote file changes before the download is resumed
+		changed := bytes.Repeat([]byte("abcdefghij"), 12000)
+		require.NoError(t, ioutil.WriteFile(name, changed, 0600))
+
+		require.NoError(t, dmsghttp.Download(ctx, c, url, dst))
+		got, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, changed, got)
+		_, err = os.Stat(dst + ".part.sha256")
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+// stallingWriter stops writing the response after limit bytes of the body, until ctx is done.
+type stallingWriter struct {
+	http.ResponseWriter
+	limit int
+	ctx   context.Context
+}
+
+func (w *stallingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		n, _ := w.ResponseWriter.Write(b[:w.limit]) //nolint:errcheck
+		w.limit -= n
+		w.ResponseWriter.(http.Flusher).Flush()
+		<-w.ctx.Done()
+		return n, w.ctx.Err()
+	}
+	w.limit -= len(b)
+	return w.ResponseWriter.Write(b)
+}
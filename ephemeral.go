@@ -0,0 +1,300 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// DefaultEphemeralPoolSize is the default number of warmed ephemeral identities.
+const DefaultEphemeralPoolSize = 2
+
+// ephemeralRetryDelay is the time to wait after an ephemeral identity failed to get ready.
+const ephemeralRetryDelay = time.Second
+
+// ErrTransportClosed is returned by an EphemeralTransport once it is closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// EphemeralConfig configures an EphemeralTransport.
+type EphemeralConfig struct {
+	// DmsgConfig is the configuration of the dmsg clients. dmsg.DefaultConfig is used if nil.
+	DmsgConfig *dmsg.Config
+
+	// Window is the time an identity is used for before it is retired. Zero uses a fresh identity for every request.
+	Window time.Duration
+
+	// PoolSize is the number of identities which are kept warm, with their sessions established, so that requests
+	// do not wait for a dmsg client to get ready. They are started concurrently. DefaultEphemeralPoolSize if zero.
+	PoolSize int
+
+	// ReadyTimeout is the time a new identity may take to get ready. DefaultReadyTimeout if zero.
+	ReadyTimeout time.Duration
+
+	// Transport is copied for every identity, with DmsgClient and Discovery replaced, e.g. to set a Resolver, a
+	// Limiter or MinSessions. A Pool is shared by all identities, which keeps their streams apart.
+	Transport Transport
+}
+
+// EphemeralTransport is a http.RoundTripper which sends requests from fresh identities, each a dmsg client of a newly
+// generated key pair with its own sessions, so that requests can not be linked to each other or to a long-lived key.
+// Identities are retired once the window they are used for passes and their responses are closed, and are then
+// torn down.
+type EphemeralTransport struct {
+	disc *CachingDiscovery
+	conf EphemeralConfig
+
+	warm chan *ephemeralClient // unbuffered, every filler holds a warm identity until it is taken
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	rotateMx sync.Mutex // serializes taking a new identity for the current window
+
+	mx      sync.Mutex
+	current *ephemeralClient
+	live    map[*ephemeralClient]struct{}
+	closed  bool
+}
+
+type ephemeralClient struct {
+	t      Transport
+	refs   int  // requests using the identity
+	retire bool // set once no further requests may use the identity
+	timer  *time.Timer
+}
+
+// NewEphemeralTransport creates an EphemeralTransport of which the identities use the discovery dc through a shared
+// CachingDiscovery. It starts warming identities in the background and has to be closed.
+func NewEphemeralTransport(dc disc.APIClient, conf EphemeralConfig) *EphemeralTransport {
+	if conf.DmsgConfig == nil {
+		conf.DmsgConfig = dmsg.DefaultConfig()
+	}
+	if conf.PoolSize <= 0 {
+		conf.PoolSize = DefaultEphemeralPoolSize
+	}
+	if conf.ReadyTimeout == 0 {
+		conf.ReadyTimeout = DefaultReadyTimeout
+	}
+	e := &EphemeralTransport{
+		disc: NewCachingDiscovery(dc, DefaultDiscoveryTTL, DefaultDiscoveryNegativeTTL),
+		conf: conf,
+		warm: make(chan *ephemeralClient),
+		done: make(chan struct{}),
+		live: make(map[*ephemeralClient]struct{}),
+	}
+	e.wg.Add(conf.PoolSize)
+	for i := 0; i < conf.PoolSize; i++ {
+		go e.fill()
+	}
+	return e
+}
+
+// RoundTrip implements http.RoundTripper.
+func (e *EphemeralTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, err := e.acquire(req.Context())
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	resp, err := c.t.RoundTrip(req)
+	if err != nil {
+		e.release(c)
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { e.release(c) }}
+	return resp, nil
+}
+
+// Live returns the number of identities which have not been torn down yet, warm ones included.
+func (e *EphemeralTransport) Live() int {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	return len(e.live)
+}
+
+// Close tears down all identities, failing requests in flight, and waits until their dmsg clients stopped serving.
+// Requests made afterwards fail with ErrTransportClosed.
+func (e *EphemeralTransport) Close() error {
+	e.mx.Lock()
+	if e.closed {
+		e.mx.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.current = nil
+	close(e.done)
+	clients := make([]*ephemeralClient, 0, len(e.live))
+	for c := range e.live {
+		clients = append(clients, c)
+	}
+	e.mx.Unlock()
+
+	for _, c := range clients {
+		e.teardown(c)
+	}
+	e.wg.Wait()
+	return nil
+}
+
+// fill keeps a warm identity of the pool, replacing it once it is taken.
+func (e *EphemeralTransport) fill() {
+	defer e.wg.Done()
+
+	for {
+		c, err := e.spawn()
+		if err != nil {
+			select {
+			case <-e.done:
+				return
+			case <-time.After(ephemeralRetryDelay):
+				continue
+			}
+		}
+		select {
+		case e.warm <- c:
+		case <-e.done:
+			e.teardown(c)
+			return
+		}
+	}
+}
+
+// spawn starts a dmsg client of a new key pair and waits until it is ready.
+func (e *EphemeralTransport) spawn() (*ephemeralClient, error) {
+	pk, sk := cipher.GenerateKeyPair()
+	t := e.conf.Transport
+	t.DmsgClient = dmsg.NewClient(pk, sk, e.disc, e.conf.DmsgConfig)
+	t.Discovery = e.disc
+	c := &ephemeralClient{t: t}
+
+	e.mx.Lock()
+	if e.closed {
+		e.mx.Unlock()
+		return nil, ErrTransportClosed
+	}
+	e.live[c] = struct{}{}
+	e.wg.Add(1)
+	e.mx.Unlock()
+	go func() {
+		defer e.wg.Done()
+		t.DmsgClient.Serve()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.conf.ReadyTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-e.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := t.Ready(ctx); err != nil {
+		e.teardown(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// acquire returns the identity to send a request from, taking a warm one if the request needs a new identity.
+// Identities taken while the transport closes are torn down by Close, as they are live.
+func (e *EphemeralTransport) acquire(ctx context.Context) (*ephemeralClient, error) {
+	if e.conf.Window <= 0 {
+		c, err := e.take(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e.mx.Lock()
+		defer e.mx.Unlock()
+		if e.closed {
+			return nil, ErrTransportClosed
+		}
+		c.refs, c.retire = 1, true
+		return c, nil
+	}
+
+	e.rotateMx.Lock()
+	defer e.rotateMx.Unlock()
+
+	e.mx.Lock()
+	if e.closed {
+		e.mx.Unlock()
+		return nil, ErrTransportClosed
+	}
+	if c := e.current; c != nil {
+		c.refs++
+		e.mx.Unlock()
+		return c, nil
+	}
+	e.mx.Unlock()
+
+	c, err := e.take(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	if e.closed {
+		return nil, ErrTransportClosed
+	}
+	c.refs = 1
+	e.current = c
+	c.timer = time.AfterFunc(e.conf.Window, func() { e.expire(c) })
+	return c, nil
+}
+
+// take takes a warm identity.
+func (e *EphemeralTransport) take(ctx context.Context) (*ephemeralClient, error) {
+	select {
+	case c := <-e.warm:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-e.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+// expire retires the identity of a window which passed.
+func (e *EphemeralTransport) expire(c *ephemeralClient) {
+	e.mx.Lock()
+	if e.current == c {
+		e.current = nil
+	}
+	c.retire = true
+	idle := c.refs == 0
+	e.mx.Unlock()
+
+	if idle {
+		e.teardown(c)
+	}
+}
+
+// release ends a request of the identity, tearing it down if it is retired and was the last one.
+func (e *EphemeralTransport) release(c *ephemeralClient) {
+	e.mx.Lock()
+	c.refs--
+	idle := c.retire && c.refs == 0
+	e.mx.Unlock()
+
+	if idle {
+		e.teardown(c)
+	}
+}
+
+// teardown closes the dmsg client of an identity. It may be called more than once.
+func (e *EphemeralTransport) teardown(c *ephemeralClient) {
+	e.mx.Lock()
+	delete(e.live, c)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	e.mx.Unlock()
+
+	_ = c.t.DmsgClient.Close() //nolint:errcheck
+}
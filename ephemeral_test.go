@@ -0,0 +1,103 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+func TestEphemeralTransport(t *testing.T) {
+	n, err := devnet.Start(devnet.Config{Servers: 2, Clients: 1})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
+
+	srvC := n.Clients()[0]
+	lis, err := srvC.Listen(testPort)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := dmsghttp.RemoteAddr(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(addr.PK.Hex())) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+	url := "dmsg://" + dmsg.Addr{PK: srvC.LocalPK(), Port: testPort}.String() + "/"
+
+	// waitLive waits until the transport holds the given number of identities.
+	waitLive := func(e *dmsghttp.EphemeralTransport, live int) {
+		deadline := time.Now().Add(clientTimeout)
+		for e.Live() != live {
+			require.True(t, time.Now().Before(deadline), "live identities: %d, want %d", e.Live(), live)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("identity per request", func(t *testing.T) {
+		e := dmsghttp.NewEphemeralTransport(n.DiscClient(), dmsghttp.EphemeralConfig{PoolSize: 2})
+		c := &http.Client{Transport: e, Timeout: clientTimeout}
+
+		// the pool is filled
+		waitLive(e, 2)
+
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		first, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NotEqual(t, srvC.LocalPK().Hex(), string(first))
+		waitLive(e, 3) // the identity is held by the open response
+
+		require.NoError(t, resp.Body.Close())
+		waitLive(e, 2)
+
+		seen := map[string]bool{string(first): true}
+		for i := 0; i < 3; i++ {
+			pk := getBody(t, c, url)
+			require.False(t, seen[pk], pk)
+			seen[pk] = true
+		}
+
+		require.NoError(t, e.Close())
+		require.Equal(t, 0, e.Live())
+		_, err = c.Get(url)
+		require.True(t, errors.Is(err, dmsghttp.ErrTransportClosed), err)
+	})
+
+	t.Run("identity per window", func(t *testing.T) {
+		e := dmsghttp.NewEphemeralTransport(n.DiscClient(), dmsghttp.EphemeralConfig{
+			PoolSize: 1,
+			Window:   2 * time.Second,
+		})
+		defer func() { require.NoError(t, e.Close()) }()
+		c := &http.Client{Transport: e, Timeout: clientTimeout}
+		waitLive(e, 1)
+
+		first := getBody(t, c, url)
+		require.Equal(t, first, getBody(t, c, url))
+
+		// the identity of the window is torn down once the window passed
+		waitLive(e, 2)
+		waitLive(e, 1)
+		require.NotEqual(t, first, getBody(t, c, url))
+
+		// the identity of the window is not used once the transport is closed
+		require.NoError(t, e.Close())
+		_, err := c.Get(url)
+		require.True(t, errors.Is(err, dmsghttp.ErrTransportClosed), err)
+	})
+}
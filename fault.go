@@ -0,0 +1,333 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// ErrInvalidFault is returned for requests of which the injected fault is invalid.
+var ErrInvalidFault = errors.New("invalid fault")
+
+// Fault describes failures injected into a single request, connection or discovery call.
+// The zero Fault injects nothing.
+type Fault struct {
+	// Latency is added before the request is sent, before the first read of a connection or before a discovery call.
+	Latency time.Duration
+
+	// Err fails the request, the connection or the discovery call, for example with dmsg.ErrReqNoListener,
+	// dmsg.ErrSessionClosed or disc.ErrKeyNotFound. Accepted connections are dropped.
+	Err error
+
+	// Bandwidth caps the rate of response bodies and connection reads and writes in bytes per second.
+	// Zero means no cap.
+	Bandwidth int64
+
+	// Reset resets the stream after ResetAfter bytes of the response body, or of a connection's writes.
+	// Readers of a reset response body get io.ErrUnexpectedEOF, as for a dropped connection.
+	Reset      bool
+	ResetAfter int64
+}
+
+func (f Fault) validate() error {
+	if f.ResetAfter < 0 {
+		return fmt.Errorf("%w: negative ResetAfter %d", ErrInvalidFault, f.ResetAfter)
+	}
+	return nil
+}
+
+// FaultPlan decides which faults to inject. Implementations have to be safe for concurrent use.
+type FaultPlan interface {
+	Next() Fault
+}
+
+type faultScript struct {
+	mx     sync.Mutex
+	faults []Fault
+}
+
+// FaultScript returns a plan which injects the given faults in order, one per call, and nothing afterwards.
+func FaultScript(faults ...Fault) FaultPlan {
+	return &faultScript{faults: faults}
+}
+
+func (s *faultScript) Next() Fault {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(s.faults) == 0 {
+		return Fault{}
+	}
+	f := s.faults[0]
+	s.faults = s.faults[1:]
+	return f
+}
+
+// ProbableFault is a fault which is injected with probability P.
+type ProbableFault struct {
+	P     float64
+	Fault Fault
+}
+
+type randomFaults struct {
+	mx     sync.Mutex
+	rand   *rand.Rand
+	faults []ProbableFault
+}
+
+// RandomFaults returns a plan which injects the first of the given faults whose probability hits.
+// The plan is deterministic for a given seed.
+func RandomFaults(seed int64, faults ...ProbableFault) FaultPlan {
+	return &randomFaults{rand: rand.New(rand.NewSource(seed)), faults: faults}
+}
+
+func (r *randomFaults) Next() Fault {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for _, f := range r.faults {
+		if r.rand.Float64() < f.P {
+			return f.Fault
+		}
+	}
+	return Fault{}
+}
+
+// FaultTransport is a http.RoundTripper which injects the faults of a plan into the requests of a transport.
+type FaultTransport struct {
+	rt   http.RoundTripper
+	plan FaultPlan
+}
+
+// NewFaultTransport wraps rt, injecting one fault of plan into every request.
+func NewFaultTransport(rt http.RoundTripper, plan FaultPlan) *FaultTransport {
+	return &FaultTransport{rt: rt, plan: plan}
+}
+
+// RoundTrip implements http.RoundTripper. Requests of which the fault is invalid fail with ErrInvalidFault.
+func (t *FaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := t.plan.Next()
+	if err := f.validate(); err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	if err := sleepCtx(req.Context(), f.Latency); err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	if f.Err != nil {
+		closeBody(req)
+		return nil, f.Err
+	}
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if f.Bandwidth > 0 || f.Reset {
+		resp.Body = &faultBody{ReadCloser: resp.Body, f: f, limit: f.ResetAfter}
+	}
+	return resp, nil
+}
+
+// faultBody applies the bandwidth cap and reset of a fault to a response body.
+type faultBody struct {
+	io.ReadCloser
+	f     Fault
+	limit int64
+}
+
+func (b *faultBody) Read(p []byte) (int, error) {
+	if b.f.Reset {
+		if b.limit <= 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if int64(len(p)) > b.limit {
+			p = p[:b.limit]
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.limit -= int64(n)
+	throttle(n, b.f.Bandwidth)
+	return n, err
+}
+
+// FaultListener is a net.Listener which injects the faults of a plan into accepted connections.
+type FaultListener struct {
+	net.Listener
+	plan FaultPlan
+}
+
+// NewFaultListener wraps lis, injecting one fault of plan into every accepted connection.
+func NewFaultListener(lis net.Listener, plan FaultPlan) *FaultListener {
+	return &FaultListener{Listener: lis, plan: plan}
+}
+
+// Accept implements net.Listener. Connections with a fault carrying an error are closed without being returned, and
+// so are connections of which the fault is invalid, as http.Server stops serving on errors of Accept.
+func (l *FaultListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		f := l.plan.Next()
+		if f.validate() != nil || f.Err != nil {
+			_ = conn.Close() //nolint:errcheck
+			continue
+		}
+		return &faultConn{Conn: conn, f: f, limit: f.ResetAfter, closed: make(chan struct{})}, nil
+	}
+}
+
+// faultConn delays the first read of a connection, caps its bandwidth and resets it after a number of written bytes.
+type faultConn struct {
+	net.Conn
+	f Fault
+
+	readOnce sync.Once
+
+	mx    sync.Mutex
+	limit int64
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed once the connection is, ending the delay of the first read
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	c.readOnce.Do(c.delay)
+	n, err := c.Conn.Read(p)
+	throttle(n, c.f.Bandwidth)
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if !c.f.Reset {
+		n, err := c.Conn.Write(p)
+		throttle(n, c.f.Bandwidth)
+		return n, err
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if int64(len(p)) <= c.limit {
+		n, err := c.Conn.Write(p)
+		c.limit -= int64(n)
+		throttle(n, c.f.Bandwidth)
+		return n, err
+	}
+	n, err := c.Conn.Write(p[:c.limit])
+	c.limit -= int64(n)
+	throttle(n, c.f.Bandwidth)
+	if cErr := c.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	return n, err
+}
+
+// Close implements net.Conn.
+func (c *faultConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// delay waits for the latency of the fault, or until the connection is closed.
+func (c *faultConn) delay() {
+	if c.f.Latency <= 0 {
+		return
+	}
+	timer := time.NewTimer(c.f.Latency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.closed:
+	}
+}
+
+// FaultDiscovery is a disc.APIClient which injects the faults of a plan into discovery calls.
+type FaultDiscovery struct {
+	dc   disc.APIClient
+	plan FaultPlan
+}
+
+// NewFaultDiscovery wraps dc, injecting one fault of plan into every call. Only latency and errors apply.
+func NewFaultDiscovery(dc disc.APIClient, plan FaultPlan) *FaultDiscovery {
+	return &FaultDiscovery{dc: dc, plan: plan}
+}
+
+// Entry implements disc.APIClient.
+func (d *FaultDiscovery) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	if err := d.inject(ctx); err != nil {
+		return nil, err
+	}
+	return d.dc.Entry(ctx, pk)
+}
+
+// PostEntry implements disc.APIClient.
+func (d *FaultDiscovery) PostEntry(ctx context.Context, entry *disc.Entry) error {
+	if err := d.inject(ctx); err != nil {
+		return err
+	}
+	return d.dc.PostEntry(ctx, entry)
+}
+
+// PutEntry implements disc.APIClient.
+func (d *FaultDiscovery) PutEntry(ctx context.Context, sk cipher.SecKey, entry *disc.Entry) error {
+	if err := d.inject(ctx); err != nil {
+		return err
+	}
+	return d.dc.PutEntry(ctx, sk, entry)
+}
+
+// AvailableServers implements disc.APIClient.
+func (d *FaultDiscovery) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	if err := d.inject(ctx); err != nil {
+		return nil, err
+	}
+	return d.dc.AvailableServers(ctx)
+}
+
+func (d *FaultDiscovery) inject(ctx context.Context) error {
+	f := d.plan.Next()
+	if err := sleepCtx(ctx, f.Latency); err != nil {
+		return err
+	}
+	return f.Err
+}
+
+// sleepCtx sleeps for d, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttle sleeps as long as transferring n bytes takes at the given bandwidth.
+func throttle(n int, bandwidth int64) {
+	if n > 0 && bandwidth > 0 {
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / bandwidth))
+	}
+}
@@ -0,0 +1,224 @@
+package dmsghttp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// newLoopbackServer serves body on a loopback network and returns its URL.
+func newLoopbackServer(t *testing.T, lb *dmsghttp.Loopback, body []byte) (url string, closeFn func()) {
+	pk, _ := cipher.GenerateKeyPair()
+	lis, err := lb.Listen(pk, testPort)
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(body) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	return "dmsg://" + dmsg.Addr{PK: pk, Port: testPort}.String() + "/", func() { require.NoError(t, srv.Close()) }
+}
+
+// closeTracker is a request body which records whether it was closed.
+type closeTracker struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func newCloseTracker() *closeTracker {
+	return &closeTracker{Reader: bytes.NewReader([]byte("body")), closed: make(chan struct{})}
+}
+
+func (b *closeTracker) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestFaultTransport(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	body := bytes.Repeat([]byte("x"), 1000)
+	url, closeSrv := newLoopbackServer(t, lb, body)
+	defer closeSrv()
+
+	clientPK, _ := cipher.GenerateKeyPair()
+	newClient := func(plan dmsghttp.FaultPlan) *http.Client {
+		return &http.Client{Transport: dmsghttp.NewFaultTransport(lb.Transport(clientPK), plan), Timeout: clientTimeout}
+	}
+
+	t.Run("scripted errors", func(t *testing.T) {
+		c := newClient(dmsghttp.FaultScript(
+			dmsghttp.Fault{Err: dmsg.ErrReqNoListener},
+			dmsghttp.Fault{Err: dmsg.ErrSessionClosed},
+		))
+		_, err := c.Get(url)
+		require.True(t, errors.Is(err, dmsg.ErrReqNoListener), err)
+		_, err = c.Get(url)
+		require.True(t, errors.Is(err, dmsg.ErrSessionClosed), err)
+		require.Equal(t, string(body), getBody(t, c, url))
+	})
+
+	t.Run("mid-body reset", func(t *testing.T) {
+		c := newClient(dmsghttp.FaultScript(dmsghttp.Fault{Reset: true, ResetAfter: 100}))
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+		require.Len(t, b, 100)
+		require.NoError(t, resp.Body.Close())
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		c := newClient(dmsghttp.FaultScript(dmsghttp.Fault{Latency: time.Second}))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		_, err = c.Do(req.WithContext(ctx))
+		require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	})
+
+	t.Run("request bodies are closed", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		rt := dmsghttp.NewFaultTransport(lb.Transport(clientPK), dmsghttp.FaultScript(
+			dmsghttp.Fault{Err: dmsg.ErrSessionClosed},
+			dmsghttp.Fault{Latency: time.Second},
+		))
+		for _, ctx := range []context.Context{context.Background(), ctx} {
+			body := newCloseTracker()
+			req, err := http.NewRequest(http.MethodPost, url, body)
+			require.NoError(t, err)
+			_, err = rt.RoundTrip(req.WithContext(ctx))
+			require.Error(t, err)
+			select {
+			case <-body.closed:
+			default:
+				t.Fatal("request body not closed")
+			}
+		}
+	})
+
+	t.Run("invalid faults", func(t *testing.T) {
+		c := newClient(dmsghttp.FaultScript(dmsghttp.Fault{Reset: true, ResetAfter: -1}))
+		_, err := c.Get(url)
+		require.True(t, errors.Is(err, dmsghttp.ErrInvalidFault), err)
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		c := newClient(dmsghttp.FaultScript(dmsghttp.Fault{Bandwidth: 10000}))
+		start := time.Now()
+		require.Equal(t, string(body), getBody(t, c, url))
+		require.True(t, time.Since(start) >= 100*time.Millisecond)
+	})
+}
+
+func TestFaultListener(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	body := bytes.Repeat([]byte("x"), 1000)
+	plan := dmsghttp.FaultScript(
+		dmsghttp.Fault{Err: dmsg.ErrSessionClosed},
+		dmsghttp.Fault{Reset: true, ResetAfter: 10},
+		dmsghttp.Fault{Reset: true, ResetAfter: -1},
+	)
+
+	pk, _ := cipher.GenerateKeyPair()
+	lis, err := lb.Listen(pk, testPort)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(body) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(dmsghttp.NewFaultListener(lis, plan)) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	clientPK, _ := cipher.GenerateKeyPair()
+	c := &http.Client{Transport: lb.Transport(clientPK), Timeout: clientTimeout}
+	url := "dmsg://" + dmsg.Addr{PK: pk, Port: testPort}.String() + "/"
+
+	// the first connection is dropped
+	_, err = c.Get(url)
+	require.Error(t, err)
+
+	// the second one is reset within the response headers
+	_, err = c.Get(url)
+	require.Error(t, err)
+
+	// the third one has an invalid fault and is dropped, without stopping the server
+	_, err = c.Get(url)
+	require.Error(t, err)
+
+	require.Equal(t, string(body), getBody(t, c, url))
+
+	t.Run("closing ends the latency", func(t *testing.T) {
+		tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		lis := dmsghttp.NewFaultListener(tcpLis, dmsghttp.FaultScript(dmsghttp.Fault{Latency: time.Minute}))
+		defer func() { require.NoError(t, lis.Close()) }()
+
+		dialed, err := net.Dial("tcp", tcpLis.Addr().String())
+		require.NoError(t, err)
+		defer func() { require.NoError(t, dialed.Close()) }()
+		conn, err := lis.Accept()
+		require.NoError(t, err)
+
+		time.AfterFunc(100*time.Millisecond, func() { _ = conn.Close() }) //nolint:errcheck
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		require.True(t, time.Since(start) < 10*time.Second)
+	})
+}
+
+func TestFaultDiscovery(t *testing.T) {
+	ctx := context.Background()
+	pk, sk := cipher.GenerateKeyPair()
+	entry := disc.NewClientEntry(pk, 0, nil)
+	require.NoError(t, entry.Sign(sk))
+
+	dc := dmsghttp.NewFaultDiscovery(disc.NewMock(), dmsghttp.FaultScript(
+		dmsghttp.Fault{Err: errors.New("connection refused")},
+	))
+	require.EqualError(t, dc.PostEntry(ctx, entry), "connection refused")
+	require.NoError(t, dc.PostEntry(ctx, entry))
+	_, err := dc.Entry(ctx, pk)
+	require.NoError(t, err)
+}
+
+func TestRandomFaults(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	faults := []dmsghttp.ProbableFault{
+		{P: 0.3, Fault: dmsghttp.Fault{Err: errA}},
+		{P: 0.3, Fault: dmsghttp.Fault{Err: errB}},
+	}
+	p1 := dmsghttp.RandomFaults(42, faults...)
+	p2 := dmsghttp.RandomFaults(42, faults...)
+
+	counts := make(map[error]int)
+	for i := 0; i < 1000; i++ {
+		f := p1.Next()
+		require.Equal(t, f, p2.Next())
+		counts[f.Err]++
+	}
+	require.InDelta(t, 300, counts[errA], 60)
+	require.InDelta(t, 210, counts[errB], 60)
+	require.InDelta(t, 490, counts[nil], 60)
+
+	always := dmsghttp.RandomFaults(1, dmsghttp.ProbableFault{P: 1, Fault: dmsghttp.Fault{Err: errA}})
+	never := dmsghttp.RandomFaults(1, dmsghttp.ProbableFault{P: 0, Fault: dmsghttp.Fault{Err: errA}})
+	for i := 0; i < 100; i++ {
+		require.Equal(t, errA, always.Next().Err)
+		require.NoError(t, never.Next().Err)
+	}
+}
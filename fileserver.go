@@ -0,0 +1,309 @@
+package dmsghttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+const (
+	// SHA256Header is the response header in which a file server advertises the hex encoded SHA-256 digest of a file.
+	SHA256Header = "X-Content-Sha256"
+
+	// ChunkManifestQuery is the query parameter which requests the ChunkManifest of a file instead of its content.
+	ChunkManifestQuery = "chunks"
+
+	// DefaultChunkSize is the default size of the chunks listed in a ChunkManifest.
+	DefaultChunkSize = 1 << 20
+)
+
+// FileServerConfig configures a file server.
+type FileServerConfig struct {
+	// ManifestPath is the URL path under which the SHA-256 manifest of all served files is published.
+	// The manifest endpoint is disabled if empty.
+	ManifestPath string
+
+	// ChunkSize is the size of the chunks listed in chunk manifests.
+	// DefaultChunkSize is used if zero.
+	ChunkSize int64
+
+	// AllowedPKs restricts access to clients of the given public keys.
+	// All clients are allowed if empty.
+	AllowedPKs []cipher.PubKey
+}
+
+// Manifest lists the files served by a file server.
+type Manifest struct {
+	Files []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes a single file of a Manifest.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Digest returns the decoded SHA-256 digest of the entry.
+func (e ManifestEntry) Digest() (cipher.SHA256, error) {
+	return parseSHA256(e.SHA256)
+}
+
+// ChunkManifest lists the SHA-256 digests of the consecutive fixed size chunks of a file.
+// The last chunk may be shorter than ChunkSize.
+type ChunkManifest struct {
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	SHA256    string   `json:"sha256"`
+	Chunks    []string `json:"chunks"`
+}
+
+type fileServer struct {
+	fs      http.FileSystem
+	files   http.Handler
+	conf    FileServerConfig
+	allowed map[cipher.PubKey]struct{}
+
+	sumsMx sync.Mutex
+	sums   map[string]fileSum
+}
+
+type fileSum struct {
+	size    int64
+	modTime time.Time
+	sum     cipher.SHA256
+	chunks  []cipher.SHA256
+}
+
+// NewFileServer returns a handler that serves the contents of fs.
+// On top of what http.FileServer provides (range requests and directory listings), regular files are served with
+// their SHA-256 digest as ETag and in the SHA256Header header, so If-None-Match and If-Range requests work.
+func NewFileServer(fs http.FileSystem, conf FileServerConfig) http.Handler {
+	s := &fileServer{
+		fs:    fs,
+		files: http.FileServer(fs),
+		conf:  conf,
+		sums:  make(map[string]fileSum),
+	}
+	if len(conf.AllowedPKs) > 0 {
+		s.allowed = make(map[cipher.PubKey]struct{}, len(conf.AllowedPKs))
+		for _, pk := range conf.AllowedPKs {
+			s.allowed[pk] = struct{}{}
+		}
+	}
+	return s
+}
+
+// ServeFileSystem serves the contents of fs on the given port of the dmsg client.
+// It blocks until the context is canceled or serving fails.
+func ServeFileSystem(ctx context.Context, dmsgC *dmsg.Client, port uint16, fs http.FileSystem,
+	conf FileServerConfig) error {
+	return serveHandler(ctx, dmsgC, port, NewFileServer(fs, conf))
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.allowed != nil {
+		addr, err := RemoteAddr(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if _, ok := s.allowed[addr.PK]; !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if s.conf.ManifestPath != "" && name == path.Clean("/"+s.conf.ManifestPath) {
+		s.serveManifest(w, r)
+		return
+	}
+
+	if _, ok := r.URL.Query()[ChunkManifestQuery]; ok {
+		s.serveChunkManifest(w, r, name)
+		return
+	}
+
+	if fs, ok := s.fileSum(name, false); ok {
+		digest := hex.EncodeToString(fs.sum[:])
+		w.Header().Set("Etag", `"`+digest+`"`)
+		w.Header().Set(SHA256Header, digest)
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+func (s *fileServer) serveManifest(w http.ResponseWriter, r *http.Request) {
+	var m Manifest
+	if err := s.walk("/", &m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(m) //nolint:errcheck
+}
+
+func (s *fileServer) serveChunkManifest(w http.ResponseWriter, r *http.Request, name string) {
+	fs, ok := s.fileSum(name, true)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	m := ChunkManifest{
+		Size:      fs.size,
+		ChunkSize: s.chunkSize(),
+		SHA256:    hex.EncodeToString(fs.sum[:]),
+		Chunks:    make([]string, len(fs.chunks)),
+	}
+	for i, sum := range fs.chunks {
+		m.Chunks[i] = hex.EncodeToString(sum[:])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(m) //nolint:errcheck
+}
+
+func (s *fileServer) walk(name string, m *Manifest) error {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		fName := path.Join(name, fi.Name())
+		if fi.IsDir() {
+			if err := s.walk(fName, m); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		fs, ok := s.fileSum(fName, false)
+		if !ok {
+			continue
+		}
+		m.Files = append(m.Files, ManifestEntry{
+			Path:   fName,
+			Size:   fs.size,
+			SHA256: hex.EncodeToString(fs.sum[:]),
+		})
+	}
+	return nil
+}
+
+// fileSum returns the digests of the regular file of the given name.
+// Digests are cached until the size or modification time of the file changes.
+// Chunk digests are only computed if requested.
+func (s *fileServer) fileSum(name string, withChunks bool) (fileSum, bool) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return fileSum{}, false
+	}
+	defer f.Close() //nolint:errcheck
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return fileSum{}, false
+	}
+
+	s.sumsMx.Lock()
+	cached, ok := s.sums[name]
+	s.sumsMx.Unlock()
+	if ok && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) && (!withChunks || cached.chunks != nil) {
+		return cached, true
+	}
+
+	fs := fileSum{size: fi.Size(), modTime: fi.ModTime()}
+	if withChunks {
+		fs.sum, fs.chunks, err = sumChunks(f, s.chunkSize())
+	} else {
+		fs.sum, err = sumSHA256(f)
+	}
+	if err != nil {
+		return fileSum{}, false
+	}
+
+	s.sumsMx.Lock()
+	s.sums[name] = fs
+	s.sumsMx.Unlock()
+	return fs, true
+}
+
+func (s *fileServer) chunkSize() int64 {
+	if s.conf.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return s.conf.ChunkSize
+}
+
+func sumSHA256(r io.Reader) (cipher.SHA256, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return cipher.SHA256{}, err
+	}
+	return cipher.SHA256FromBytes(h.Sum(nil))
+}
+
+func sumChunks(r io.Reader, chunkSize int64) (cipher.SHA256, []cipher.SHA256, error) {
+	h := sha256.New()
+	chunks := make([]cipher.SHA256, 0)
+	for {
+		ch := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(h, ch), r, chunkSize)
+		if n > 0 {
+			sum, sErr := cipher.SHA256FromBytes(ch.Sum(nil))
+			if sErr != nil {
+				return cipher.SHA256{}, nil, sErr
+			}
+			chunks = append(chunks, sum)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cipher.SHA256{}, nil, err
+		}
+	}
+	sum, err := cipher.SHA256FromBytes(h.Sum(nil))
+	return sum, chunks, err
+}
+
+func parseSHA256(s string) (cipher.SHA256, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return cipher.SHA256{}, err
+	}
+	return cipher.SHA256FromBytes(b)
+}
@@ -0,0 +1,147 @@
+package dmsghttp_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_fileserver")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	content := []byte("0123456789abcdef")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "file.txt"), content, 0600))
+	sum := cipher.SumSHA256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	allowedPK, _ := cipher.GenerateKeyPair()
+	otherPK, _ := cipher.GenerateKeyPair()
+
+	h := dmsghttp.NewFileServer(http.Dir(dir), dmsghttp.FileServerConfig{
+		ManifestPath: "/manifest.json",
+		AllowedPKs:   []cipher.PubKey{allowedPK},
+	})
+
+	do := func(pk cipher.PubKey, target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = fmt.Sprintf("%s:%d", pk, 49153)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("forbidden", func(t *testing.T) {
+		w := do(otherPK, "/sub/file.txt", nil)
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("digest", func(t *testing.T) {
+		w := do(allowedPK, "/sub/file.txt", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, content, w.Body.Bytes())
+		require.Equal(t, digest, w.Header().Get(dmsghttp.SHA256Header))
+		require.Equal(t, `"`+digest+`"`, w.Header().Get("Etag"))
+	})
+
+	t.Run("if-none-match", func(t *testing.T) {
+		w := do(allowedPK, "/sub/file.txt", http.Header{"If-None-Match": {`"` + digest + `"`}})
+		require.Equal(t, http.StatusNotModified, w.Code)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		w := do(allowedPK, "/sub/file.txt", http.Header{"Range": {"bytes=4-7"}})
+		require.Equal(t, http.StatusPartialContent, w.Code)
+		require.Equal(t, content[4:8], w.Body.Bytes())
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		w := do(allowedPK, "/sub/", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), "file.txt")
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		w := do(allowedPK, "/manifest.json", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var m dmsghttp.Manifest
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+		require.Equal(t, []dmsghttp.ManifestEntry{
+			{Path: "/sub/file.txt", Size: int64(len(content)), SHA256: digest},
+		}, m.Files)
+	})
+}
+
+func TestFileServerOverDmsg(t *testing.T) {
+	dmsgD := disc.NewMock()
+	dmsgS, dmsgSErr := createDmsgSrv(t, dmsgD)
+	defer func() {
+		require.NoError(t, dmsgS.Close())
+		for err := range dmsgSErr {
+			require.NoError(t, err)
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "dmsghttp_serve")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	// large enough to not fit into the read buffers of a single response
+	content := bytes.Repeat([]byte("dmsg"), 1<<18)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "big.bin"), content, 0600))
+
+	dmsgServerClient := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgServerClient.Close()) }()
+
+	list, err := dmsgServerClient.Listen(testPort)
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: dmsghttp.NewFileServer(http.Dir(dir), dmsghttp.FileServerConfig{}),
+	}
+
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- srv.Serve(list)
+		close(sErr)
+	}()
+	defer func() {
+		require.NoError(t, srv.Close())
+		require.Equal(t, http.ErrServerClosed, <-sErr)
+	}()
+
+	dmsgClient := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgClient.Close()) }()
+
+	c := &http.Client{
+		Transport: dmsghttp.Transport{DmsgClient: dmsgClient},
+		Timeout:   clientTimeout,
+	}
+
+	resp, err := c.Get(fmt.Sprintf("dmsg://%v:%d/big.bin", dmsgServerClient.LocalPK().Hex(), testPort))
+	require.NoError(t, err)
+
+	respB, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, content, respB)
+}
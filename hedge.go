@@ -0,0 +1,216 @@
+package dmsghttp
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default hedging settings.
+const (
+	DefaultHedgeMinDelay = 50 * time.Millisecond
+	DefaultHedgeBudget   = 0.05
+
+	hedgeWindow     = 128 // number of recent latencies the hedge delay is computed from
+	hedgeMinSamples = 10  // latencies needed before the percentile is used
+	hedgeMaxTokens  = 10  // bound of hedges which may be saved up by the budget
+)
+
+// HedgeConfig configures hedged requests of a service: if a replica has not returned response headers within the
+// hedge delay, the request is sent to a second replica as well. The first response is used and the other request
+// is canceled. Only idempotent requests whose body can be sent again are hedged.
+type HedgeConfig struct {
+	// Percentile of recent response header latencies of the service which is used as hedge delay, e.g. 0.95.
+	// Requests are not hedged if zero.
+	Percentile float64
+
+	// MinDelay is the lower bound of the hedge delay. It is also used until enough latencies were recorded.
+	// DefaultHedgeMinDelay is used if zero.
+	MinDelay time.Duration
+
+	// Budget is the fraction of requests which may be hedged, so that hedging adds at most Budget to the load.
+	// DefaultHedgeBudget is used if zero.
+	Budget float64
+}
+
+// hedger keeps the latencies and the hedge budget of a service.
+type hedger struct {
+	conf HedgeConfig
+
+	mx        sync.Mutex
+	latencies []time.Duration
+	next      int
+	tokens    float64
+}
+
+func newHedger(conf HedgeConfig) *hedger {
+	if conf.MinDelay == 0 {
+		conf.MinDelay = DefaultHedgeMinDelay
+	}
+	if conf.Budget == 0 {
+		conf.Budget = DefaultHedgeBudget
+	}
+	return &hedger{conf: conf}
+}
+
+// observe records the time a replica took to return response headers.
+func (h *hedger) observe(d time.Duration) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if len(h.latencies) < hedgeWindow {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+	h.latencies[h.next] = d
+	h.next = (h.next + 1) % hedgeWindow
+}
+
+// delay returns the time to wait for a response before hedging.
+func (h *hedger) delay() time.Duration {
+	h.mx.Lock()
+	sorted := append([]time.Duration(nil), h.latencies...)
+	h.mx.Unlock()
+
+	if len(sorted) < hedgeMinSamples {
+		return h.conf.MinDelay
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	d := sorted[int(math.Ceil(h.conf.Percentile*float64(len(sorted)-1)))]
+	if d < h.conf.MinDelay {
+		return h.conf.MinDelay
+	}
+	return d
+}
+
+// request adds the share of a request to the budget.
+func (h *hedger) request() {
+	h.mx.Lock()
+	h.tokens = math.Min(hedgeMaxTokens, h.tokens+h.conf.Budget)
+	h.mx.Unlock()
+}
+
+// take reports whether the budget allows a hedge, spending it if so.
+func (h *hedger) take() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedgeResult is the outcome of one of the requests of a hedged round trip.
+type hedgeResult struct {
+	i    int // index of the request
+	resp *http.Response
+	err  error
+}
+
+// hedge sends a request to a replica, and to another replica as well if the first is slower than the hedge delay.
+// Requests which fail with a dmsg error are retried on the other replicas, as with unhedged requests.
+func (b *Balancer) hedge(s *service, req *http.Request) (*http.Response, error) {
+	s.hedger.request()
+
+	results := make(chan hedgeResult, len(s.replicas))
+	tried := make(map[*replica]bool, len(s.replicas))
+	var cancels []context.CancelFunc
+
+	launch := func() error {
+		r := s.pick(req, tried)
+		tried[r] = true
+
+		ctx, cancel := context.WithCancel(req.Context())
+		hReq := req.WithContext(ctx)
+		if len(cancels) > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return err
+			}
+			hReq.Body = body
+		}
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+
+		go func() {
+			start := time.Now()
+			resp, err := b.send(s, r, hReq, false)
+			if err != nil {
+				cancel()
+				results <- hedgeResult{i: i, err: err}
+				return
+			}
+			s.hedger.observe(time.Since(start))
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: cancel}
+			results <- hedgeResult{i: i, resp: resp}
+		}()
+		return nil
+	}
+
+	if err := launch(); err != nil {
+		return nil, err
+	}
+	pending := 1
+
+	timer := time.NewTimer(s.hedger.delay())
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if len(tried) < len(s.replicas) && s.hedger.take() {
+				if err := launch(); err != nil {
+					lastErr = err
+					continue
+				}
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				for i, cancel := range cancels {
+					if i != res.i {
+						cancel()
+					}
+				}
+				go drainHedges(results, pending)
+				return res.resp, nil
+			}
+			lastErr = res.err
+			if pending == 0 && isDmsgError(res.err) && len(tried) < len(s.replicas) {
+				if err := launch(); err != nil {
+					return nil, err
+				}
+				pending++
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// drainHedges closes the responses of the n requests which lost a hedged round trip.
+func drainHedges(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			_ = res.resp.Body.Close() //nolint:errcheck
+		}
+	}
+}
+
+// idempotent reports whether a request may be sent more than once, following net/http.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
@@ -0,0 +1,116 @@
+package dmsghttp_test
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// delayedReplicas returns replicas which answer with their address after the given delays, counting the requests
+// they receive and the ones canceled while waiting.
+func delayedReplicas(delays ...time.Duration) ([]dmsg.Addr, hostRouter, func() (received, canceled int)) {
+	addrs, _ := newReplicas(len(delays))
+	router := make(hostRouter, len(addrs))
+
+	var mx sync.Mutex
+	var received, canceled int
+	for i, a := range addrs {
+		name, delay := a.String(), delays[i]
+		router[name] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			received++
+			mx.Unlock()
+
+			select {
+			case <-time.After(delay):
+				_, _ = w.Write([]byte(name)) //nolint:errcheck
+			case <-r.Context().Done():
+				mx.Lock()
+				canceled++
+				mx.Unlock()
+			}
+		})
+	}
+	return addrs, router, func() (int, int) {
+		mx.Lock()
+		defer mx.Unlock()
+		return received, canceled
+	}
+}
+
+// waitStats waits until the numbers of received and canceled requests satisfy cond.
+func waitStats(t *testing.T, stats func() (received, canceled int), cond func(received, canceled int) bool) {
+	deadline := time.Now().Add(clientTimeout)
+	for {
+		received, canceled := stats()
+		if cond(received, canceled) {
+			return
+		}
+		require.True(t, time.Now().Before(deadline), "received: %d, canceled: %d", received, canceled)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancerHedge(t *testing.T) {
+	t.Run("slow replica is hedged", func(t *testing.T) {
+		addrs, router, stats := delayedReplicas(2*time.Second, 0)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{
+			Replicas: addrs,
+			Hedge:    dmsghttp.HedgeConfig{Percentile: 0.9, MinDelay: 20 * time.Millisecond, Budget: 1},
+		}))
+		c := &http.Client{Transport: b, Timeout: clientTimeout}
+
+		start := time.Now()
+		require.Equal(t, addrs[1].String(), getBody(t, c, "dmsg://svc/"))
+		require.True(t, time.Since(start) < time.Second)
+
+		// the request to the slow replica is canceled
+		waitStats(t, stats, func(received, canceled int) bool { return received == 2 && canceled == 1 })
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		addrs, router, stats := delayedReplicas(100*time.Millisecond, 100*time.Millisecond)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{
+			Replicas: addrs,
+			Hedge:    dmsghttp.HedgeConfig{Percentile: 0.9, MinDelay: 20 * time.Millisecond, Budget: 0.5},
+		}))
+		c := &http.Client{Transport: b, Timeout: clientTimeout}
+
+		for i := 0; i < 4; i++ {
+			getBody(t, c, "dmsg://svc/")
+		}
+		// every other request may be hedged
+		waitStats(t, stats, func(received, _ int) bool { return received == 6 })
+		time.Sleep(100 * time.Millisecond)
+		received, _ := stats()
+		require.Equal(t, 6, received)
+	})
+
+	t.Run("non-idempotent requests are not hedged", func(t *testing.T) {
+		addrs, router, stats := delayedReplicas(200*time.Millisecond, 200*time.Millisecond)
+		b := dmsghttp.NewBalancer(router)
+		defer func() { require.NoError(t, b.Close()) }()
+		require.NoError(t, b.SetService("svc", dmsghttp.ServiceConfig{
+			Replicas: addrs,
+			Hedge:    dmsghttp.HedgeConfig{Percentile: 0.9, MinDelay: 20 * time.Millisecond, Budget: 1},
+		}))
+		c := &http.Client{Transport: b, Timeout: clientTimeout}
+
+		resp, err := c.Post("dmsg://svc/", "text/plain", strings.NewReader("data"))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		received, _ := stats()
+		require.Equal(t, 1, received)
+	})
+}
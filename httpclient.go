@@ -0,0 +1,184 @@
+package dmsghttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// DefaultReadyTimeout is the default time NewHTTPClient waits for the dmsg client to be ready.
+const DefaultReadyTimeout = 30 * time.Second
+
+// HealthState is the state of a ManagedClient.
+type HealthState int
+
+// Health states.
+const (
+	// HealthReady means the dmsg client has at least the minimum number of sessions.
+	HealthReady HealthState = iota
+	// HealthDegraded means the dmsg client lost sessions and has less than the minimum number of them.
+	// It keeps reconnecting in the background.
+	HealthDegraded
+	// HealthClosed means the client was closed.
+	HealthClosed
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthReady:
+		return "ready"
+	case HealthDegraded:
+		return "degraded"
+	case HealthClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("HealthState(%d)", int(s))
+	}
+}
+
+// Health describes the state of a ManagedClient.
+type Health struct {
+	State    HealthState
+	Sessions int // sessions with dmsg servers
+}
+
+// HTTPClientOption configures NewHTTPClient.
+type HTTPClientOption func(*httpClientConfig)
+
+type httpClientConfig struct {
+	dmsgConf     *dmsg.Config
+	timeout      time.Duration
+	readyTimeout time.Duration
+	minSessions  int
+	transport    []func(*Transport)
+	wrap         []func(http.RoundTripper) http.RoundTripper
+}
+
+// WithDmsgConfig sets the configuration of the dmsg client. dmsg.DefaultConfig is used by default.
+func WithDmsgConfig(conf *dmsg.Config) HTTPClientOption {
+	return func(c *httpClientConfig) { c.dmsgConf = conf }
+}
+
+// WithTimeout sets the Timeout of the returned http.Client.
+func WithTimeout(timeout time.Duration) HTTPClientOption {
+	return func(c *httpClientConfig) { c.timeout = timeout }
+}
+
+// WithReadyTimeout sets the time NewHTTPClient waits for the dmsg client to be ready. DefaultReadyTimeout by default.
+func WithReadyTimeout(timeout time.Duration) HTTPClientOption {
+	return func(c *httpClientConfig) { c.readyTimeout = timeout }
+}
+
+// WithMinSessions sets the number of sessions with dmsg servers the client needs to be ready and healthy. 1 by default.
+// The MinSessions of the dmsg configuration is raised to n if lower.
+func WithMinSessions(n int) HTTPClientOption {
+	return func(c *httpClientConfig) { c.minSessions = n }
+}
+
+// WithTransport modifies the Transport before it is used, e.g. to set a Limiter or a Resolver.
+func WithTransport(fn func(t *Transport)) HTTPClientOption {
+	return func(c *httpClientConfig) { c.transport = append(c.transport, fn) }
+}
+
+// WithRoundTripper wraps the round tripper of the http.Client, e.g. with NewBreaker or NewCache.
+// Wrappers are applied in order, so the last one sees requests first.
+func WithRoundTripper(wrap func(http.RoundTripper) http.RoundTripper) HTTPClientOption {
+	return func(c *httpClientConfig) { c.wrap = append(c.wrap, wrap) }
+}
+
+// ManagedClient owns the dmsg client of an http.Client returned by NewHTTPClient.
+type ManagedClient struct {
+	transport Transport
+	min       int
+
+	served    chan struct{} // closed once Serve returned
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHTTPClient creates a dmsg client of the given key pair with a CachingDiscovery of dc, serves it and waits until
+// it is ready. It returns an http.Client sending requests over dmsg and the ManagedClient, which has to be closed
+// once the http.Client is no longer used.
+func NewHTTPClient(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, opts ...HTTPClientOption) (*http.Client,
+	*ManagedClient, error) {
+	conf := httpClientConfig{
+		dmsgConf:     dmsg.DefaultConfig(),
+		readyTimeout: DefaultReadyTimeout,
+		minSessions:  1,
+	}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	if conf.minSessions <= 0 {
+		conf.minSessions = 1
+	}
+	dmsgConf := *conf.dmsgConf
+	if dmsgConf.MinSessions < conf.minSessions {
+		dmsgConf.MinSessions = conf.minSessions // the dmsg client stops connecting to servers at its MinSessions
+	}
+
+	cd := NewCachingDiscovery(dc, DefaultDiscoveryTTL, DefaultDiscoveryNegativeTTL)
+	t := Transport{DmsgClient: dmsg.NewClient(pk, sk, cd, &dmsgConf), Discovery: cd, MinSessions: conf.minSessions}
+	for _, fn := range conf.transport {
+		fn(&t)
+	}
+	m := &ManagedClient{transport: t, min: conf.minSessions, served: make(chan struct{}), closed: make(chan struct{})}
+	go func() {
+		defer close(m.served)
+		t.DmsgClient.Serve()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.readyTimeout)
+	defer cancel()
+	if err := t.Ready(ctx); err != nil {
+		_ = m.Close() //nolint:errcheck
+		return nil, nil, fmt.Errorf("dmsg client is not ready: %w", err)
+	}
+
+	var rt http.RoundTripper = t
+	for _, wrap := range conf.wrap {
+		rt = wrap(rt)
+	}
+	return &http.Client{Transport: rt, Timeout: conf.timeout}, m, nil
+}
+
+// Transport returns the Transport of the client, e.g. for Prewarm.
+func (m *ManagedClient) Transport() Transport {
+	return m.transport
+}
+
+// Health returns the current state of the client.
+func (m *ManagedClient) Health() Health {
+	select {
+	case <-m.closed:
+		return Health{State: HealthClosed}
+	default:
+	}
+
+	h := Health{State: HealthReady, Sessions: m.transport.DmsgClient.SessionCount()}
+	if h.Sessions < m.min {
+		h.State = HealthDegraded
+	}
+	return h
+}
+
+// Close closes the dmsg client, and the stream pool of the Transport if any, and waits until the client stopped
+// serving. Requests in flight fail.
+func (m *ManagedClient) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		if m.transport.Pool != nil {
+			_ = m.transport.Pool.Close() //nolint:errcheck
+		}
+		err = m.transport.DmsgClient.Close()
+		<-m.served
+	})
+	return err
+}
@@ -0,0 +1,85 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	n, err := devnet.Start(devnet.Config{Servers: 2, Clients: 1})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
+
+	srvC := n.Clients()[0]
+	lis, err := srvC.Listen(testPort)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok")) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+	url := "dmsg://" + dmsg.Addr{PK: srvC.LocalPK(), Port: testPort}.String() + "/"
+
+	t.Run("lifecycle", func(t *testing.T) {
+		wrapped := 0
+		pk, sk := cipher.GenerateKeyPair()
+		c, m, err := dmsghttp.NewHTTPClient(pk, sk, n.DiscClient(),
+			dmsghttp.WithTimeout(clientTimeout),
+			dmsghttp.WithMinSessions(2),
+			dmsghttp.WithRoundTripper(func(rt http.RoundTripper) http.RoundTripper {
+				return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					wrapped++
+					return rt.RoundTrip(req)
+				})
+			}))
+		require.NoError(t, err)
+		require.Equal(t, clientTimeout, c.Timeout)
+
+		h := m.Health()
+		require.Equal(t, dmsghttp.HealthReady, h.State)
+		require.Equal(t, 2, h.Sessions)
+		require.Equal(t, "ok", getBody(t, c, url))
+		require.Equal(t, 1, wrapped)
+
+		require.NoError(t, m.Close())
+		require.NoError(t, m.Close())
+		require.Equal(t, dmsghttp.Health{State: dmsghttp.HealthClosed}, m.Health())
+		_, err = c.Get(url)
+		require.Error(t, err)
+	})
+
+	t.Run("transport options", func(t *testing.T) {
+		pool := dmsghttp.NewStreamPool(dmsghttp.StreamPoolConfig{Ports: []uint16{testPort}})
+		pk, sk := cipher.GenerateKeyPair()
+		c, m, err := dmsghttp.NewHTTPClient(pk, sk, n.DiscClient(), dmsghttp.WithTransport(func(t *dmsghttp.Transport) {
+			t.Pool = pool
+		}))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, m.Close()) }()
+
+		require.NoError(t, m.Transport().Prewarm(ctx, srvC.LocalPK()))
+		require.Equal(t, 1, pool.Idle(dmsg.Addr{PK: srvC.LocalPK(), Port: testPort}))
+		require.Equal(t, "ok", getBody(t, c, url))
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		pk, sk := cipher.GenerateKeyPair()
+		_, _, err := dmsghttp.NewHTTPClient(pk, sk, n.DiscClient(),
+			dmsghttp.WithMinSessions(3), dmsghttp.WithReadyTimeout(200*time.Millisecond))
+		require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	})
+}
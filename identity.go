@@ -0,0 +1,104 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// IdentityHeader is the request header which selects the identity dialing a request, as the hex encoded public key of
+// one of the Transport's dmsg clients. It is removed before the request is sent.
+const IdentityHeader = "X-Dmsg-Identity"
+
+// ErrUnknownIdentity is returned for requests selecting an identity which the Transport does not hold.
+var ErrUnknownIdentity = errors.New("unknown dmsg identity")
+
+type identityKey struct{}
+
+// WithIdentity returns a context which selects the identity of the given public key to dial requests made with it.
+// It takes precedence over IdentityHeader.
+func WithIdentity(ctx context.Context, pk cipher.PubKey) context.Context {
+	return context.WithValue(ctx, identityKey{}, pk)
+}
+
+// selectedIdentity returns the identity selected by ctx or by the header, if any.
+func selectedIdentity(ctx context.Context, h http.Header) (cipher.PubKey, bool, error) {
+	if pk, ok := ctx.Value(identityKey{}).(cipher.PubKey); ok {
+		return pk, true, nil
+	}
+	v := h.Get(IdentityHeader)
+	if v == "" {
+		return cipher.PubKey{}, false, nil
+	}
+	var pk cipher.PubKey
+	if err := pk.Set(v); err != nil {
+		return cipher.PubKey{}, false, fmt.Errorf("invalid %s header: %w", IdentityHeader, err)
+	}
+	return pk, true, nil
+}
+
+// identityResolver is implemented by round trippers which know the identity a request is sent from.
+type identityResolver interface {
+	requestIdentity(req *http.Request) (cipher.PubKey, bool)
+}
+
+// requestIdentity returns the identity req is sent from through rt, if rt tells.
+func requestIdentity(rt http.RoundTripper, req *http.Request) (cipher.PubKey, bool) {
+	if r, ok := rt.(identityResolver); ok {
+		return r.requestIdentity(req)
+	}
+	return cipher.PubKey{}, false
+}
+
+// identityPrefix prefixes keys of shared state, such as cache entries, with the identity req is sent from through rt,
+// so that responses to different identities are kept apart. Requests which select the default identity and ones
+// which select none share the prefix. If rt does not tell the identity, the one selected for req is used.
+func identityPrefix(rt http.RoundTripper, req *http.Request) string {
+	if pk, ok := requestIdentity(rt, req); ok {
+		return pk.Hex() + "|"
+	}
+	if pk, ok, err := selectedIdentity(req.Context(), req.Header); err == nil && ok {
+		return pk.Hex() + "|"
+	}
+	return ""
+}
+
+func (t Transport) requestIdentity(req *http.Request) (cipher.PubKey, bool) {
+	c, err := t.identityClient(req.Context(), req.Header)
+	if err != nil || c == nil {
+		return cipher.PubKey{}, false
+	}
+	return c.LocalPK(), true
+}
+
+// identity returns the dmsg client selected for req, and req without IdentityHeader.
+func (t Transport) identity(req *http.Request) (*dmsg.Client, *http.Request, error) {
+	c, err := t.identityClient(req.Context(), req.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, set := req.Header[IdentityHeader]; set {
+		req = req.Clone(req.Context())
+		req.Header.Del(IdentityHeader)
+	}
+	return c, req, nil
+}
+
+// identityClient returns the dmsg client selected by ctx or by the header, the default one if none.
+func (t Transport) identityClient(ctx context.Context, h http.Header) (*dmsg.Client, error) {
+	pk, ok, err := selectedIdentity(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || pk == t.DmsgClient.LocalPK() {
+		return t.DmsgClient, nil
+	}
+	if c, ok := t.Identities[pk]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownIdentity, pk)
+}
@@ -0,0 +1,148 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+func TestIdentities(t *testing.T) {
+	n, err := devnet.Start(devnet.Config{Servers: 2, Clients: 3})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
+
+	clients := n.Clients()
+	srvC, idA, idB := clients[0], clients[1], clients[2]
+	lis, err := srvC.Listen(testPort)
+	require.NoError(t, err)
+	var requests int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		addr, err := dmsghttp.RemoteAddr(r)
+		require.NoError(t, err)
+		require.Empty(t, r.Header.Get(dmsghttp.IdentityHeader))
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(addr.PK.Hex())) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+	addr := dmsg.Addr{PK: srvC.LocalPK(), Port: testPort}
+	url := "dmsg://" + addr.String() + "/"
+
+	tr := dmsghttp.Transport{
+		DmsgClient: idA,
+		Identities: map[cipher.PubKey]*dmsg.Client{idB.LocalPK(): idB},
+		Discovery:  dmsghttp.NewCachingDiscovery(n.DiscClient(), dmsghttp.DefaultDiscoveryTTL, 0),
+		Pool:       dmsghttp.NewStreamPool(dmsghttp.StreamPoolConfig{Ports: []uint16{testPort}}),
+	}
+	defer func() { require.NoError(t, tr.Pool.Close()) }()
+	c := &http.Client{Transport: tr, Timeout: clientTimeout}
+
+	// get returns the key the server saw for a request from ctx, with the identity header set to id if not empty.
+	get := func(ctx context.Context, id string) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		if id != "" {
+			req.Header.Set(dmsghttp.IdentityHeader, id)
+		}
+		resp, err := c.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b), nil
+	}
+
+	t.Run("identity selection", func(t *testing.T) {
+		pk, err := get(ctx, "")
+		require.NoError(t, err)
+		require.Equal(t, idA.LocalPK().Hex(), pk)
+
+		pk, err = get(dmsghttp.WithIdentity(ctx, idB.LocalPK()), "")
+		require.NoError(t, err)
+		require.Equal(t, idB.LocalPK().Hex(), pk)
+
+		pk, err = get(ctx, idB.LocalPK().Hex())
+		require.NoError(t, err)
+		require.Equal(t, idB.LocalPK().Hex(), pk)
+
+		// the context takes precedence over the header
+		pk, err = get(dmsghttp.WithIdentity(ctx, idA.LocalPK()), idB.LocalPK().Hex())
+		require.NoError(t, err)
+		require.Equal(t, idA.LocalPK().Hex(), pk)
+	})
+
+	t.Run("unknown identities", func(t *testing.T) {
+		unknownPK, _ := cipher.GenerateKeyPair()
+		_, err := get(dmsghttp.WithIdentity(ctx, unknownPK), "")
+		require.True(t, errors.Is(err, dmsghttp.ErrUnknownIdentity), err)
+
+		_, err = get(ctx, "not a key")
+		require.Error(t, err)
+
+		// request bodies are closed
+		body := newCloseTracker()
+		req, err := http.NewRequest(http.MethodPost, url, body)
+		require.NoError(t, err)
+		_, err = tr.RoundTrip(req.WithContext(dmsghttp.WithIdentity(ctx, unknownPK)))
+		require.True(t, errors.Is(err, dmsghttp.ErrUnknownIdentity), err)
+		select {
+		case <-body.closed:
+		default:
+			t.Fatal("request body not closed")
+		}
+	})
+
+	t.Run("keys cache entries by the identity sending the request", func(t *testing.T) {
+		cc := &http.Client{Transport: dmsghttp.NewCache(tr, dmsghttp.CacheConfig{}), Timeout: clientTimeout}
+		cachedGet := func(ctx context.Context) string {
+			req, err := http.NewRequest(http.MethodGet, url+"cached", nil)
+			require.NoError(t, err)
+			resp, err := cc.Do(req.WithContext(ctx))
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			b, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return string(b)
+		}
+
+		before := atomic.LoadInt32(&requests)
+		require.Equal(t, idA.LocalPK().Hex(), cachedGet(ctx))
+		require.Equal(t, idA.LocalPK().Hex(), cachedGet(dmsghttp.WithIdentity(ctx, idA.LocalPK())))
+		require.Equal(t, before+1, atomic.LoadInt32(&requests))
+
+		require.Equal(t, idB.LocalPK().Hex(), cachedGet(dmsghttp.WithIdentity(ctx, idB.LocalPK())))
+		require.Equal(t, before+2, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("streams are pooled per identity", func(t *testing.T) {
+		require.NoError(t, tr.Prewarm(dmsghttp.WithIdentity(ctx, idB.LocalPK()), addr.PK))
+		require.Equal(t, 1, tr.Pool.Idle(addr))
+
+		pk, err := get(ctx, "")
+		require.NoError(t, err)
+		require.Equal(t, idA.LocalPK().Hex(), pk)
+		require.Equal(t, 1, tr.Pool.Idle(addr))
+
+		pk, err = get(ctx, idB.LocalPK().Hex())
+		require.NoError(t, err)
+		require.Equal(t, idB.LocalPK().Hex(), pk)
+		require.Equal(t, 0, tr.Pool.Idle(addr))
+	})
+}
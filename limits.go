@@ -0,0 +1,297 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// DefaultRetryAfter is the Retry-After of responses to streams rejected by a PeerLimitListener.
+const DefaultRetryAfter = time.Second
+
+// ErrPeerBusy is matched by errors of dialing peers which accept no more streams for now, as their dmsg accept buffer
+// is full. Retrying later may succeed.
+var ErrPeerBusy = errors.New("dmsg peer is busy")
+
+// peerBusyError is returned when dialing a busy peer.
+type peerBusyError struct {
+	addr dmsg.Addr
+	err  error
+}
+
+func (e *peerBusyError) Error() string {
+	return fmt.Sprintf("%v: %s accepts no more streams: %v", ErrPeerBusy, e.addr, e.err)
+}
+
+func (e *peerBusyError) Unwrap() error { return e.err }
+
+// Is reports whether target is ErrPeerBusy.
+func (e *peerBusyError) Is(target error) bool { return target == ErrPeerBusy }
+
+// dialError makes errors of dialing addr more descriptive.
+func dialError(addr dmsg.Addr, err error) error {
+	if errors.Is(err, dmsg.ErrAcceptChanMaxed) {
+		return &peerBusyError{addr: addr, err: err}
+	}
+	return err
+}
+
+// PeerLimits configures a PeerLimiter. Zero values mean no limit.
+type PeerLimits struct {
+	// MaxConnsPerPeer limits the dmsg streams open to a peer. A stream is open until its response body is closed.
+	MaxConnsPerPeer int
+
+	// MaxConcurrentRequestsPerPeer limits the requests to a peer which are waiting for response headers.
+	MaxConcurrentRequestsPerPeer int
+}
+
+// PeerLimiter enforces PeerLimits for a Transport. Requests over a limit wait in a first-come, first-served queue of
+// their peer until the request's context is done.
+type PeerLimiter struct {
+	limits PeerLimits
+
+	mx    sync.Mutex
+	peers map[cipher.PubKey]*peerSems
+}
+
+// peerSems holds the semaphores of a peer.
+type peerSems struct {
+	conns, reqs *fifoSem
+	users       int
+}
+
+// NewPeerLimiter creates a PeerLimiter.
+func NewPeerLimiter(limits PeerLimits) *PeerLimiter {
+	return &PeerLimiter{limits: limits, peers: make(map[cipher.PubKey]*peerSems)}
+}
+
+// acquire waits for a request slot and a connection slot to pk. The returned functions release them.
+func (l *PeerLimiter) acquire(ctx context.Context, pk cipher.PubKey) (releaseReq, releaseConn func(), err error) {
+	s := l.peer(pk)
+
+	if err := s.reqs.acquire(ctx); err != nil {
+		l.done(pk)
+		return nil, nil, err
+	}
+	if err := s.conns.acquire(ctx); err != nil {
+		s.reqs.release()
+		l.done(pk)
+		return nil, nil, err
+	}
+
+	// both slots count as a user of the semaphores
+	l.mx.Lock()
+	s.users++
+	l.mx.Unlock()
+
+	var reqOnce, connOnce sync.Once
+	releaseReq = func() {
+		reqOnce.Do(func() {
+			s.reqs.release()
+			l.done(pk)
+		})
+	}
+	releaseConn = func() {
+		connOnce.Do(func() {
+			s.conns.release()
+			l.done(pk)
+		})
+	}
+	return releaseReq, releaseConn, nil
+}
+
+// peer returns the semaphores of pk, counting a user of them until done is called.
+func (l *PeerLimiter) peer(pk cipher.PubKey) *peerSems {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	s, ok := l.peers[pk]
+	if !ok {
+		s = &peerSems{conns: newFIFOSem(l.limits.MaxConnsPerPeer), reqs: newFIFOSem(l.limits.MaxConcurrentRequestsPerPeer)}
+		l.peers[pk] = s
+	}
+	s.users++
+	return s
+}
+
+// done drops the semaphores of pk once they have no users left.
+func (l *PeerLimiter) done(pk cipher.PubKey) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if s := l.peers[pk]; s != nil {
+		if s.users--; s.users == 0 {
+			delete(l.peers, pk)
+		}
+	}
+}
+
+// fifoSem is a counting semaphore which grants slots in the order they were requested.
+type fifoSem struct {
+	max int
+
+	mx      sync.Mutex
+	n       int
+	waiters []chan struct{}
+}
+
+// newFIFOSem creates a semaphore with max slots, or without limit if max is not positive.
+func newFIFOSem(max int) *fifoSem {
+	if max <= 0 {
+		max = math.MaxInt32
+	}
+	return &fifoSem{max: max}
+}
+
+func (s *fifoSem) acquire(ctx context.Context) error {
+	s.mx.Lock()
+	if s.n < s.max && len(s.waiters) == 0 {
+		s.n++
+		s.mx.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, ch)
+	s.mx.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.mx.Lock()
+		for i, w := range s.waiters {
+			if w == ch {
+				s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+				s.mx.Unlock()
+				return ctx.Err()
+			}
+		}
+		s.mx.Unlock()
+
+		// The slot was granted concurrently, pass it on.
+		s.release()
+		return ctx.Err()
+	}
+}
+
+func (s *fifoSem) release() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if len(s.waiters) > 0 {
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+		return
+	}
+	s.n--
+}
+
+// PeerLimitListener is a net.Listener which caps the concurrent streams of every remote public key.
+// Streams over the cap are answered with 503 Service Unavailable and a Retry-After header and closed, instead of
+// piling up in the dmsg accept buffer.
+type PeerLimitListener struct {
+	net.Listener
+	max        int
+	retryAfter time.Duration
+
+	mx      sync.Mutex
+	streams map[cipher.PubKey]int
+}
+
+// NewPeerLimitListener wraps lis, allowing max concurrent streams per remote public key, or any number of them if max
+// is not positive. Rejected streams are told to retry after retryAfter, DefaultRetryAfter if zero.
+func NewPeerLimitListener(lis net.Listener, max int, retryAfter time.Duration) *PeerLimitListener {
+	if max <= 0 {
+		max = math.MaxInt32
+	}
+	if retryAfter == 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	return &PeerLimitListener{
+		Listener:   lis,
+		max:        max,
+		retryAfter: retryAfter,
+		streams:    make(map[cipher.PubKey]int),
+	}
+}
+
+// Accept implements net.Listener.
+func (l *PeerLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := conn.RemoteAddr().(dmsg.Addr)
+		if !ok {
+			return conn, nil
+		}
+		if l.add(addr.PK) {
+			return &peerLimitConn{Conn: conn, release: func() { l.remove(addr.PK) }}, nil
+		}
+		go l.reject(conn)
+	}
+}
+
+func (l *PeerLimitListener) add(pk cipher.PubKey) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.streams[pk] >= l.max {
+		return false
+	}
+	l.streams[pk]++
+	return true
+}
+
+func (l *PeerLimitListener) remove(pk cipher.PubKey) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.streams[pk]--; l.streams[pk] <= 0 {
+		delete(l.streams, pk)
+	}
+}
+
+// reject answers a stream with 503 Service Unavailable and closes it.
+func (l *PeerLimitListener) reject(conn net.Conn) {
+	resp := "HTTP/1.1 503 Service Unavailable\r\n" +
+		"Retry-After: " + strconv.Itoa(ceilSeconds(l.retryAfter)) + "\r\n" +
+		"Content-Length: 0\r\n" +
+		"Connection: close\r\n\r\n"
+	_, _ = conn.Write([]byte(resp)) //nolint:errcheck
+	_ = conn.Close()                //nolint:errcheck
+}
+
+// peerLimitConn releases its slot of a PeerLimitListener once closed.
+type peerLimitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *peerLimitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// limitedConn releases its slot of a PeerLimiter once closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
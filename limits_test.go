@@ -0,0 +1,245 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// gatedHandler holds requests until its gate is closed, recording their concurrency and order.
+type gatedHandler struct {
+	gate chan struct{}
+
+	mx        sync.Mutex
+	active    int
+	maxActive int
+	order     []string
+}
+
+func (h *gatedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mx.Lock()
+	h.active++
+	if h.active > h.maxActive {
+		h.maxActive = h.active
+	}
+	h.order = append(h.order, r.Header.Get("X-Seq"))
+	h.mx.Unlock()
+
+	<-h.gate
+
+	h.mx.Lock()
+	h.active--
+	h.mx.Unlock()
+	_, _ = w.Write([]byte("ok")) //nolint:errcheck
+}
+
+func (h *gatedHandler) stats() (active, maxActive int, order []string) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return h.active, h.maxActive, append([]string(nil), h.order...)
+}
+
+// newGatedServer serves a gatedHandler on a loopback network, over the listener returned by wrap if not nil.
+func newGatedServer(t *testing.T, lb *dmsghttp.Loopback, wrap func(net.Listener) net.Listener) (*gatedHandler,
+	string, func()) {
+	pk, _ := cipher.GenerateKeyPair()
+	lis, err := lb.Listen(pk, testPort)
+	require.NoError(t, err)
+
+	var l net.Listener = lis
+	if wrap != nil {
+		l = wrap(lis)
+	}
+	h := &gatedHandler{gate: make(chan struct{})}
+	srv := &http.Server{Handler: h}
+	go func() { _ = srv.Serve(l) }() //nolint:errcheck
+	return h, "dmsg://" + dmsg.Addr{PK: pk, Port: testPort}.String() + "/", func() { require.NoError(t, srv.Close()) }
+}
+
+func TestPeerLimiter(t *testing.T) {
+	clientPK, _ := cipher.GenerateKeyPair()
+
+	t.Run("concurrent requests", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		h, url, closeSrv := newGatedServer(t, lb, nil)
+		defer closeSrv()
+
+		tr := lb.Transport(clientPK)
+		tr.Limiter = dmsghttp.NewPeerLimiter(dmsghttp.PeerLimits{MaxConcurrentRequestsPerPeer: 2})
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.Equal(t, "ok", getBody(t, c, url))
+			}()
+		}
+		require.Eventually(t, func() bool {
+			active, _, _ := h.stats()
+			return active == 2
+		}, clientTimeout, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		close(h.gate)
+		wg.Wait()
+
+		_, maxActive, order := h.stats()
+		require.Equal(t, 2, maxActive)
+		require.Len(t, order, 6)
+	})
+
+	t.Run("first come first served", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		h, url, closeSrv := newGatedServer(t, lb, nil)
+		defer closeSrv()
+
+		tr := lb.Transport(clientPK)
+		tr.Limiter = dmsghttp.NewPeerLimiter(dmsghttp.PeerLimits{MaxConcurrentRequestsPerPeer: 1})
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Seq", strconv.Itoa(i))
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := c.Do(req)
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+			}()
+			time.Sleep(20 * time.Millisecond) // let the request queue up
+		}
+		close(h.gate)
+		wg.Wait()
+
+		_, maxActive, order := h.stats()
+		require.Equal(t, 1, maxActive)
+		require.Equal(t, []string{"0", "1", "2", "3", "4"}, order)
+	})
+
+	t.Run("waiting is context aware", func(t *testing.T) {
+		lb := dmsghttp.NewLoopback()
+		h, url, closeSrv := newGatedServer(t, lb, nil)
+		defer closeSrv()
+		close(h.gate)
+
+		tr := lb.Transport(clientPK)
+		tr.Limiter = dmsghttp.NewPeerLimiter(dmsghttp.PeerLimits{MaxConnsPerPeer: 1})
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+
+		// the stream stays open until the body is closed
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		_, err = c.Do(req.WithContext(ctx))
+		require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, "ok", getBody(t, c, url))
+	})
+}
+
+func TestPeerLimitListener(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	h, url, closeSrv := newGatedServer(t, lb, func(lis net.Listener) net.Listener {
+		return dmsghttp.NewPeerLimitListener(lis, 1, 1500*time.Millisecond)
+	})
+	defer closeSrv()
+
+	clientPK, _ := cipher.GenerateKeyPair()
+	otherPK, _ := cipher.GenerateKeyPair()
+	c := &http.Client{Transport: lb.Transport(clientPK), Timeout: clientTimeout}
+
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		require.Equal(t, "ok", getBody(t, c, url))
+	}()
+	require.Eventually(t, func() bool {
+		active, _, _ := h.stats()
+		return active == 1
+	}, clientTimeout, 10*time.Millisecond)
+
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// other peers are not affected
+	go func() {
+		other := &http.Client{Transport: lb.Transport(otherPK), Timeout: clientTimeout}
+		_, _ = other.Get(url) //nolint:errcheck
+	}()
+	require.Eventually(t, func() bool {
+		active, _, _ := h.stats()
+		return active == 2
+	}, clientTimeout, 10*time.Millisecond)
+
+	close(h.gate)
+	<-held
+	require.Eventually(t, func() bool {
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode == http.StatusOK
+	}, clientTimeout, 10*time.Millisecond)
+}
+
+func TestPeerLimitListenerUnlimited(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	h, url, closeSrv := newGatedServer(t, lb, func(lis net.Listener) net.Listener {
+		return dmsghttp.NewPeerLimitListener(lis, 0, 0)
+	})
+	defer closeSrv()
+
+	clientPK, _ := cipher.GenerateKeyPair()
+	c := &http.Client{Transport: lb.Transport(clientPK), Timeout: clientTimeout}
+
+	const n = 3
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, "ok", getBody(t, c, url))
+		}()
+	}
+	require.Eventually(t, func() bool {
+		active, _, _ := h.stats()
+		return active == n
+	}, clientTimeout, 10*time.Millisecond)
+	close(h.gate)
+	wg.Wait()
+}
+
+func TestPeerBusy(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	clientPK, _ := cipher.GenerateKeyPair()
+	lb.FailDial(dmsg.Addr{PK: srvPK}, dmsg.ErrAcceptChanMaxed)
+
+	c := &http.Client{Transport: lb.Transport(clientPK), Timeout: clientTimeout}
+	_, err := c.Get("dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort}.String() + "/")
+	require.True(t, errors.Is(err, dmsghttp.ErrPeerBusy), err)
+	require.True(t, errors.Is(err, dmsg.ErrAcceptChanMaxed), err)
+}
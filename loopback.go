@@ -0,0 +1,213 @@
+package dmsghttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/netutil"
+)
+
+// Loopback is an in-memory stand-in for a dmsg network, meant for unit tests of handlers and clients.
+// Connections are backed by net.Pipe and carry dmsg addresses, so RemoteAddr works in handlers served over a
+// LoopbackListener. Like dmsg, dialing an address without a listener fails with dmsg.ErrReqNoListener.
+type Loopback struct {
+	mx        sync.Mutex
+	listeners map[dmsg.Addr]*LoopbackListener
+	dialErrs  map[dmsg.Addr]error
+	nextPort  uint16
+}
+
+// NewLoopback creates an empty loopback network.
+func NewLoopback() *Loopback {
+	return &Loopback{
+		listeners: make(map[dmsg.Addr]*LoopbackListener),
+		dialErrs:  make(map[dmsg.Addr]error),
+		nextPort:  netutil.PorterMinEphemeral,
+	}
+}
+
+// Listen listens on the given port of pk. It fails with dmsg.ErrPortOccupied if the port is in use.
+func (l *Loopback) Listen(pk cipher.PubKey, port uint16) (*LoopbackListener, error) {
+	addr := dmsg.Addr{PK: pk, Port: port}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if _, ok := l.listeners[addr]; ok {
+		return nil, dmsg.ErrPortOccupied
+	}
+	lis := &LoopbackListener{
+		lb:     l,
+		addr:   addr,
+		accept: make(chan net.Conn, dmsg.AcceptBufferSize),
+		done:   make(chan struct{}),
+	}
+	l.listeners[addr] = lis
+	return lis, nil
+}
+
+// FailDial makes dials to addr fail with err, which usually is one of the dmsg errors such as
+// dmsg.ErrDiscEntryNotFound or dmsg.ErrCannotConnectToDelegated. A zero port matches all ports of addr.PK.
+// A nil err removes the failure again.
+func (l *Loopback) FailDial(addr dmsg.Addr, err error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if err == nil {
+		delete(l.dialErrs, addr)
+		return
+	}
+	l.dialErrs[addr] = err
+}
+
+// Dial connects pk to the listener on remote.
+func (l *Loopback) Dial(ctx context.Context, pk cipher.PubKey, remote dmsg.Addr) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	l.mx.Lock()
+	if err, ok := l.dialErrs[remote]; ok {
+		l.mx.Unlock()
+		return nil, err
+	}
+	if err, ok := l.dialErrs[dmsg.Addr{PK: remote.PK}]; ok {
+		l.mx.Unlock()
+		return nil, err
+	}
+	lis, ok := l.listeners[remote]
+	local := dmsg.Addr{PK: pk, Port: l.nextPort}
+	if l.nextPort++; l.nextPort == 0 {
+		l.nextPort = netutil.PorterMinEphemeral
+	}
+	l.mx.Unlock()
+
+	if !ok {
+		return nil, dmsg.ErrReqNoListener
+	}
+
+	c1, c2 := net.Pipe()
+	if err := lis.introduce(&loopbackConn{Conn: c2, local: remote, remote: local}); err != nil {
+		_ = c1.Close() //nolint:errcheck
+		return nil, err
+	}
+	return &loopbackConn{Conn: c1, local: local, remote: remote}, nil
+}
+
+// Transport returns an http.RoundTripper which issues requests as pk. Hosts are handled like by Transport.
+func (l *Loopback) Transport(pk cipher.PubKey) *LoopbackTransport {
+	return &LoopbackTransport{Loopback: l, PK: pk}
+}
+
+// LoopbackTransport is the counterpart of Transport for a Loopback network.
+type LoopbackTransport struct {
+	Loopback *Loopback
+	PK       cipher.PubKey
+
+	// Resolver resolves host names which are not public keys. Only public keys are accepted if nil.
+	Resolver Resolver
+
+	// ExpectContinueTimeout, Limiter and Proxy are used as in Transport.
+	ExpectContinueTimeout time.Duration
+	Limiter               *PeerLimiter
+	Proxy                 dmsg.Addr
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *LoopbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr, err := Transport{Resolver: t.Resolver}.resolveAddr(req)
+	if err != nil {
+		return nil, err
+	}
+	req, addr, viaProxy := proxyRequest(req, addr, t.Proxy)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return t.Loopback.Dial(ctx, t.PK, addr)
+	}
+	return roundTripPeer(req, addr, t.Limiter, t.ExpectContinueTimeout, viaProxy, dial)
+}
+
+// LoopbackListener is a net.Listener of a Loopback network.
+type LoopbackListener struct {
+	lb     *Loopback
+	addr   dmsg.Addr
+	accept chan net.Conn
+
+	mx   sync.Mutex // protects closing done
+	done chan struct{}
+}
+
+// Accept implements net.Listener.
+func (l *LoopbackListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, dmsg.ErrEntityClosed
+	case conn := <-l.accept:
+		return conn, nil
+	}
+}
+
+// Close implements net.Listener. Connections which were not accepted yet are closed.
+func (l *LoopbackListener) Close() error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	select {
+	case <-l.done:
+		return dmsg.ErrEntityClosed
+	default:
+	}
+	close(l.done)
+
+	l.lb.mx.Lock()
+	delete(l.lb.listeners, l.addr)
+	l.lb.mx.Unlock()
+
+	for {
+		select {
+		case conn := <-l.accept:
+			_ = conn.Close() //nolint:errcheck
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr implements net.Listener, it returns the dmsg.Addr of the listener.
+func (l *LoopbackListener) Addr() net.Addr {
+	return l.addr
+}
+
+// introduce hands a dialed connection to Accept, failing the same way as a dmsg.Listener does.
+func (l *LoopbackListener) introduce(conn net.Conn) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	select {
+	case <-l.done:
+		_ = conn.Close() //nolint:errcheck
+		return dmsg.ErrReqNoListener
+	default:
+	}
+
+	select {
+	case l.accept <- conn:
+		return nil
+	default:
+		_ = conn.Close() //nolint:errcheck
+		return dmsg.ErrAcceptChanMaxed
+	}
+}
+
+// loopbackConn is a net.Pipe connection with dmsg addresses.
+type loopbackConn struct {
+	net.Conn
+	local, remote dmsg.Addr
+}
+
+func (c *loopbackConn) LocalAddr() net.Addr  { return c.local }
+func (c *loopbackConn) RemoteAddr() net.Addr { return c.remote }
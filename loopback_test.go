@@ -0,0 +1,99 @@
+package dmsghttp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestLoopback(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	clientPK, _ := cipher.GenerateKeyPair()
+
+	lis, err := lb.Listen(srvPK, testPort)
+	require.NoError(t, err)
+	_, err = lb.Listen(srvPK, testPort)
+	require.Equal(t, dmsg.ErrPortOccupied, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, err := dmsghttp.RemoteAddr(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(addr.PK.Hex())) //nolint:errcheck
+		}),
+	}
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- srv.Serve(lis)
+		close(sErr)
+	}()
+	defer func() {
+		require.NoError(t, srv.Close())
+		require.Equal(t, http.ErrServerClosed, <-sErr)
+	}()
+
+	c := &http.Client{Transport: lb.Transport(clientPK), Timeout: clientTimeout}
+	url := "dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort}.String() + "/"
+
+	t.Run("remote address", func(t *testing.T) {
+		require.Equal(t, clientPK.Hex(), getBody(t, c, url))
+	})
+
+	t.Run("no listener", func(t *testing.T) {
+		_, err := c.Get("dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort + 1}.String() + "/")
+		require.True(t, errors.Is(err, dmsg.ErrReqNoListener), err)
+	})
+
+	t.Run("injected dial error", func(t *testing.T) {
+		lb.FailDial(dmsg.Addr{PK: srvPK}, dmsg.ErrDiscEntryNotFound)
+		_, err := c.Get(url)
+		require.True(t, errors.Is(err, dmsg.ErrDiscEntryNotFound), err)
+
+		lb.FailDial(dmsg.Addr{PK: srvPK}, nil)
+		require.Equal(t, clientPK.Hex(), getBody(t, c, url))
+	})
+}
+
+func TestLoopbackFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_loopback")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("file a"), 0644))
+
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	allowedPK, _ := cipher.GenerateKeyPair()
+	deniedPK, _ := cipher.GenerateKeyPair()
+
+	lis, err := lb.Listen(srvPK, testPort)
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler: dmsghttp.NewFileServer(http.Dir(dir), dmsghttp.FileServerConfig{AllowedPKs: []cipher.PubKey{allowedPK}}),
+	}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	url := "dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort}.String() + "/a.txt"
+
+	c := &http.Client{Transport: lb.Transport(allowedPK), Timeout: clientTimeout}
+	require.Equal(t, "file a", getBody(t, c, url))
+
+	c = &http.Client{Transport: lb.Transport(deniedPK), Timeout: clientTimeout}
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
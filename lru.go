@@ -0,0 +1,54 @@
+package dmsghttp
+
+import (
+	"container/list"
+)
+
+// lruCache is a map bounded to a maximum number of entries, dropping the least recently used entry when full.
+// It is not safe for concurrent use.
+type lruCache struct {
+	max     int
+	ll      *list.List
+	entries map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key, value interface{}
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{max: max, ll: list.New(), entries: make(map[interface{}]*list.Element)}
+}
+
+// get returns the value of key, marking it as recently used.
+func (c *lruCache) get(key interface{}) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add sets the value of key, dropping the least recently used entry if the cache is full.
+func (c *lruCache) add(key, value interface{}) {
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	if c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// remove drops the entry of key, if any.
+func (c *lruCache) remove(key interface{}) {
+	if e, ok := c.entries[key]; ok {
+		c.ll.Remove(e)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,244 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// DefaultDiscoveryHedgeDelay is the time after which a read is also sent to the next discovery.
+const DefaultDiscoveryHedgeDelay = 500 * time.Millisecond
+
+// ErrNoDiscovery is returned by a MultiDiscovery without backends.
+var ErrNoDiscovery = errors.New("no discovery backends")
+
+// MultiError merges the errors of several discovery backends.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	return "all discoveries failed: " + e.join()
+}
+
+func (e MultiError) join() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the merged errors matches target.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// PartialWriteError is returned by writes of a MultiDiscovery which some backends accepted and others failed.
+// The backends which accepted the write keep the entry; Errs holds the errors of the others.
+type PartialWriteError struct {
+	Errs MultiError
+}
+
+func (e *PartialWriteError) Error() string {
+	return "some discoveries failed: " + e.Errs.join()
+}
+
+// Is reports whether any of the backend errors matches target.
+func (e *PartialWriteError) Is(target error) bool {
+	return e.Errs.Is(target)
+}
+
+// MultiDiscovery is a disc.APIClient which spreads over several discovery backends.
+// Reads are sent to the backends in order, failing over to the next backend on error and hedging to it if a
+// backend does not answer within the hedge delay. Writes are sent to all backends and succeed if any backend
+// accepts them, so that a dmsg client gets ready while a backend is down. The failures of the other backends are
+// reported to the OnPartialWrite function.
+type MultiDiscovery struct {
+	backends   []disc.APIClient
+	hedgeDelay time.Duration
+	onPartial  func(err *PartialWriteError)
+}
+
+// NewMultiDiscovery creates a MultiDiscovery over backends, ordered by preference.
+// Reads are only hedged if hedgeDelay is non-zero.
+func NewMultiDiscovery(hedgeDelay time.Duration, backends ...disc.APIClient) *MultiDiscovery {
+	return &MultiDiscovery{
+		backends:   backends,
+		hedgeDelay: hedgeDelay,
+	}
+}
+
+// NewDiscovery creates a disc.APIClient for the discovery services at addrs.
+// Several addresses are combined into a MultiDiscovery using DefaultDiscoveryHedgeDelay.
+func NewDiscovery(addrs ...string) disc.APIClient {
+	if len(addrs) == 1 {
+		return disc.NewHTTP(addrs[0])
+	}
+	backends := make([]disc.APIClient, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = disc.NewHTTP(addr)
+	}
+	return NewMultiDiscovery(DefaultDiscoveryHedgeDelay, backends...)
+}
+
+// OnPartialWrite sets the function which is called for every write which some backends failed while others
+// accepted it. It has to be set before the MultiDiscovery is used.
+func (d *MultiDiscovery) OnPartialWrite(fn func(err *PartialWriteError)) {
+	d.onPartial = fn
+}
+
+// Entry implements disc.APIClient.
+func (d *MultiDiscovery) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	v, err := d.read(ctx, func(ctx context.Context, dc disc.APIClient) (interface{}, error) {
+		return dc.Entry(ctx, pk)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*disc.Entry), nil
+}
+
+// AvailableServers implements disc.APIClient.
+func (d *MultiDiscovery) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	v, err := d.read(ctx, func(ctx context.Context, dc disc.APIClient) (interface{}, error) {
+		return dc.AvailableServers(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*disc.Entry), nil
+}
+
+// PostEntry implements disc.APIClient.
+func (d *MultiDiscovery) PostEntry(ctx context.Context, entry *disc.Entry) error {
+	_, err := d.write(entry, func(dc disc.APIClient, e *disc.Entry) error {
+		return dc.PostEntry(ctx, e)
+	})
+	return err
+}
+
+// PutEntry implements disc.APIClient.
+// Every backend updates its own copy of entry, which is then copied back from the most preferred backend that
+// accepted it.
+func (d *MultiDiscovery) PutEntry(ctx context.Context, sk cipher.SecKey, entry *disc.Entry) error {
+	updated, err := d.write(entry, func(dc disc.APIClient, e *disc.Entry) error {
+		return dc.PutEntry(ctx, sk, e)
+	})
+	if err != nil {
+		return err
+	}
+	disc.Copy(entry, updated)
+	return nil
+}
+
+type readResult struct {
+	i   int
+	val interface{}
+	err error
+}
+
+// read calls fn on the backends in order until one succeeds.
+func (d *MultiDiscovery) read(ctx context.Context,
+	fn func(context.Context, disc.APIClient) (interface{}, error)) (interface{}, error) {
+
+	if len(d.backends) == 0 {
+		return nil, ErrNoDiscovery
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan readResult, len(d.backends))
+	next := 0
+	start := func() {
+		i := next
+		next++
+		go func() {
+			v, err := fn(ctx, d.backends[i])
+			results <- readResult{i: i, val: v, err: err}
+		}()
+	}
+	start()
+
+	var hedge <-chan time.Time
+	if d.hedgeDelay > 0 {
+		t := time.NewTicker(d.hedgeDelay)
+		defer t.Stop()
+		hedge = t.C
+	}
+
+	errs := make(MultiError, len(d.backends))
+	for pending := 1; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.val, nil
+			}
+			errs[r.i] = r.err
+			if next < len(d.backends) {
+				start()
+				pending++
+			}
+		case <-hedge:
+			if next < len(d.backends) {
+				start()
+				pending++
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errs
+}
+
+// write calls fn on all backends concurrently, each with its own copy of entry.
+// It returns the copy of the most preferred backend that succeeded, reporting the failures of the others.
+func (d *MultiDiscovery) write(entry *disc.Entry, fn func(disc.APIClient, *disc.Entry) error) (*disc.Entry, error) {
+	if len(d.backends) == 0 {
+		return nil, ErrNoDiscovery
+	}
+
+	entries := make([]*disc.Entry, len(d.backends))
+	errs := make(MultiError, len(d.backends))
+
+	var wg sync.WaitGroup
+	for i, dc := range d.backends {
+		entries[i] = copyEntry(entry)
+		wg.Add(1)
+		go func(i int, dc disc.APIClient) {
+			defer wg.Done()
+			errs[i] = fn(dc, entries[i])
+		}(i, dc)
+	}
+	wg.Wait()
+
+	var (
+		updated *disc.Entry
+		failed  MultiError
+	)
+	for i, err := range errs {
+		switch {
+		case err != nil:
+			failed = append(failed, err)
+		case updated == nil:
+			updated = entries[i]
+		}
+	}
+	if updated == nil {
+		return nil, errs
+	}
+	if len(failed) > 0 && d.onPartial != nil {
+		d.onPartial(&PartialWriteError{Errs: failed})
+	}
+	return updated, nil
+}
@@ -0,0 +1,118 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// brokenDisc is a discovery whose calls fail with err, or block until the context is done if err is nil.
+type brokenDisc struct{ err error }
+
+func (d brokenDisc) fail(ctx context.Context) error {
+	if d.err != nil {
+		return d.err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (d brokenDisc) Entry(ctx context.Context, _ cipher.PubKey) (*disc.Entry, error) {
+	return nil, d.fail(ctx)
+}
+
+func (d brokenDisc) PostEntry(ctx context.Context, _ *disc.Entry) error { return d.fail(ctx) }
+
+func (d brokenDisc) PutEntry(ctx context.Context, _ cipher.SecKey, _ *disc.Entry) error {
+	return d.fail(ctx)
+}
+
+func (d brokenDisc) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	return nil, d.fail(ctx)
+}
+
+func TestMultiDiscovery(t *testing.T) {
+	ctx := context.Background()
+	pk, sk := cipher.GenerateKeyPair()
+	srvPK, _ := cipher.GenerateKeyPair()
+	errDown := errors.New("discovery is down")
+
+	newEntry := func(t *testing.T) *disc.Entry {
+		entry := disc.NewClientEntry(pk, 0, []cipher.PubKey{srvPK})
+		require.NoError(t, entry.Sign(sk))
+		return entry
+	}
+
+	t.Run("fails over in order", func(t *testing.T) {
+		live := disc.NewMock()
+		require.NoError(t, live.PostEntry(ctx, newEntry(t)))
+
+		d := dmsghttp.NewMultiDiscovery(0, brokenDisc{err: errDown}, live)
+		entry, err := d.Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, pk, entry.Static)
+	})
+
+	t.Run("hedges slow reads", func(t *testing.T) {
+		live := disc.NewMock()
+		require.NoError(t, live.PostEntry(ctx, newEntry(t)))
+
+		d := dmsghttp.NewMultiDiscovery(10*time.Millisecond, brokenDisc{}, live)
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+
+		entry, err := d.Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, pk, entry.Static)
+	})
+
+	t.Run("merges errors", func(t *testing.T) {
+		d := dmsghttp.NewMultiDiscovery(0, brokenDisc{err: errDown}, disc.NewMock())
+		_, err := d.Entry(ctx, pk)
+		require.True(t, errors.Is(err, errDown))
+		require.Contains(t, err.Error(), errDown.Error())
+		require.Contains(t, err.Error(), disc.ErrKeyNotFound.Error())
+
+		_, err = dmsghttp.NewMultiDiscovery(0).AvailableServers(ctx)
+		require.Equal(t, dmsghttp.ErrNoDiscovery, err)
+	})
+
+	t.Run("fans out writes", func(t *testing.T) {
+		a, b := disc.NewMock(), disc.NewMock()
+		d := dmsghttp.NewMultiDiscovery(0, a, brokenDisc{err: errDown}, b)
+
+		// the failures of backends are reported, but do not fail the writes
+		var partial []*dmsghttp.PartialWriteError
+		d.OnPartialWrite(func(err *dmsghttp.PartialWriteError) { partial = append(partial, err) })
+
+		entry := newEntry(t)
+		require.NoError(t, d.PostEntry(ctx, entry))
+
+		entry.Client.DelegatedServers = nil
+		require.NoError(t, d.PutEntry(ctx, sk, entry))
+		require.Equal(t, uint64(1), entry.Sequence)
+
+		require.Len(t, partial, 2)
+		for _, err := range partial {
+			require.True(t, errors.Is(err, errDown))
+			require.Len(t, err.Errs, 1)
+		}
+
+		for _, dc := range []disc.APIClient{a, b} {
+			stored, err := dc.Entry(ctx, pk)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), stored.Sequence)
+			require.Empty(t, stored.Client.DelegatedServers)
+		}
+
+		err := dmsghttp.NewMultiDiscovery(0, brokenDisc{err: errDown}).PostEntry(ctx, entry)
+		require.True(t, errors.Is(err, errDown))
+	})
+}
@@ -0,0 +1,430 @@
+package dmsghttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// Multi-source download errors.
+var (
+	ErrNoSources        = errors.New("no sources to download from")
+	ErrAllSourcesFailed = errors.New("all sources failed")
+	ErrChunkMismatch    = errors.New("chunk does not match the manifest")
+)
+
+// Default multi-source download settings.
+const (
+	DefaultChunkTimeout      = 30 * time.Second
+	DefaultMaxSourceFailures = 3
+)
+
+// MultiSourceDownloader downloads a file which is served under the same path by several dmsg peers.
+// The file is split into the chunks of a ChunkManifest, which are fetched concurrently from all sources.
+// Faster sources fetch more chunks, and chunks which fail or time out are handed to other sources.
+// Every chunk is verified against the manifest before it is written.
+type MultiSourceDownloader struct {
+	// Client has to use a Transport. http.DefaultClient is used if nil.
+	Client *http.Client
+
+	// Sources are the addresses of the peers serving the file.
+	Sources []dmsg.Addr
+
+	// Manifest lists the chunk digests of the file.
+	// If nil, it is fetched from the sources with the ChunkManifestQuery query parameter.
+	Manifest *ChunkManifest
+
+	// Progress is called whenever a chunk is written to the destination file.
+	Progress ProgressFunc
+
+	// ChunkTimeout bounds the time to fetch a single chunk, after which the chunk is handed to another source.
+	// DefaultChunkTimeout is used if zero.
+	ChunkTimeout time.Duration
+
+	// MaxSourceFailures is the number of failed chunks after which a source is no longer used.
+	// DefaultMaxSourceFailures is used if zero.
+	MaxSourceFailures int
+}
+
+// Download downloads the file of the given path into the file dst.
+func (d *MultiSourceDownloader) Download(ctx context.Context, path, dst string) error {
+	if len(d.Sources) == 0 {
+		return ErrNoSources
+	}
+
+	m := d.Manifest
+	if m == nil {
+		var err error
+		if m, err = d.fetchManifest(ctx, path); err != nil {
+			return err
+		}
+	}
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	part := dst + ".part"
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	if err := d.fetchChunks(ctx, path, m, f); err != nil {
+		_ = f.Close()       //nolint:errcheck
+		_ = os.Remove(part) //nolint:errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Chunks are verified individually, the digest of the whole file guards against an inconsistent manifest.
+	if err := verifyFile(part, m.SHA256); err != nil {
+		_ = os.Remove(part) //nolint:errcheck
+		return err
+	}
+	return os.Rename(part, dst)
+}
+
+func (d *MultiSourceDownloader) client() *http.Client {
+	if d.Client == nil {
+		return http.DefaultClient
+	}
+	return d.Client
+}
+
+func (d *MultiSourceDownloader) fetchManifest(ctx context.Context, path string) (*ChunkManifest, error) {
+	var errs []string
+	for _, src := range d.Sources {
+		m, err := d.fetchSourceManifest(ctx, src, path)
+		if err == nil {
+			return m, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", src, err))
+	}
+	return nil, fmt.Errorf("failed to fetch chunk manifest: %s", strings.Join(errs, "; "))
+}
+
+func (d *MultiSourceDownloader) fetchSourceManifest(ctx context.Context, src dmsg.Addr,
+	path string) (*ChunkManifest, error) {
+
+	req, err := http.NewRequest(http.MethodGet, sourceURL(src, path)+"?"+ChunkManifestQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	var m ChunkManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (d *MultiSourceDownloader) fetchChunks(ctx context.Context, path string, m *ChunkManifest, f *os.File) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sched := newChunkScheduler(len(m.Chunks), len(d.Sources))
+	go func() {
+		<-ctx.Done()
+		sched.abort()
+	}()
+
+	var (
+		written int64
+		wg      sync.WaitGroup
+		errMx   sync.Mutex
+		errs    []error
+	)
+	for _, src := range d.Sources {
+		wg.Add(1)
+		go func(src dmsg.Addr) {
+			defer wg.Done()
+			defer sched.leave()
+
+			failures := 0
+			for {
+				i, ok := sched.next()
+				if !ok {
+					return
+				}
+				b, err := d.fetchChunk(ctx, src, path, m, i)
+				if err != nil {
+					sched.fail(i)
+					if ctx.Err() != nil {
+						return
+					}
+					if failures++; failures >= d.maxSourceFailures() {
+						errMx.Lock()
+						errs = append(errs, fmt.Errorf("%s: %v", src, err))
+						errMx.Unlock()
+						return
+					}
+					continue
+				}
+
+				// Another source may have finished the same chunk in the meantime.
+				if !sched.claim(i) {
+					continue
+				}
+				if _, err := f.WriteAt(b, int64(i)*m.ChunkSize); err != nil {
+					errMx.Lock()
+					errs = append(errs, err)
+					errMx.Unlock()
+					cancel()
+					return
+				}
+				if d.Progress != nil {
+					errMx.Lock()
+					written += int64(len(b))
+					d.Progress(written, m.Size)
+					errMx.Unlock()
+				}
+				sched.finish()
+			}
+		}(src)
+	}
+	wg.Wait()
+
+	if sched.complete() {
+		return nil
+	}
+	if err := ctx.Err(); err != nil && len(errs) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrAllSourcesFailed, errs)
+}
+
+func (d *MultiSourceDownloader) fetchChunk(ctx context.Context, src dmsg.Addr, path string, m *ChunkManifest,
+	i int) ([]byte, error) {
+
+	timeout := d.ChunkTimeout
+	if timeout == 0 {
+		timeout = DefaultChunkTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := int64(i) * m.ChunkSize
+	size := m.ChunkSize
+	if start+size > m.Size {
+		size = m.Size - start
+	}
+
+	req, err := http.NewRequest(http.MethodGet, sourceURL(src, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+size-1))
+
+	resp, err := d.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		rStart, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		if rStart != start {
+			return nil, fmt.Errorf("unexpected range start %d, expected %d", rStart, start)
+		}
+	case http.StatusOK:
+		// Servers may respond with the whole content if the range covers all of it.
+		if start != 0 || size != m.Size {
+			return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, err
+	}
+	if cipher.SumSHA256(b) != m.chunkDigest(i) {
+		return nil, ErrChunkMismatch
+	}
+	return b, nil
+}
+
+func (d *MultiSourceDownloader) maxSourceFailures() int {
+	if d.MaxSourceFailures == 0 {
+		return DefaultMaxSourceFailures
+	}
+	return d.MaxSourceFailures
+}
+
+func (m *ChunkManifest) validate() error {
+	if m.ChunkSize <= 0 || m.Size < 0 {
+		return errors.New("invalid chunk manifest: invalid sizes")
+	}
+	if want := (m.Size + m.ChunkSize - 1) / m.ChunkSize; int64(len(m.Chunks)) != want {
+		return fmt.Errorf("invalid chunk manifest: expected %d chunks, got %d", want, len(m.Chunks))
+	}
+	for _, c := range m.Chunks {
+		if _, err := parseSHA256(c); err != nil {
+			return fmt.Errorf("invalid chunk manifest: %v", err)
+		}
+	}
+	if _, err := parseSHA256(m.SHA256); err != nil {
+		return fmt.Errorf("invalid chunk manifest: %v", err)
+	}
+	return nil
+}
+
+// chunkDigest returns the digest of the i-th chunk. The manifest has to be validated first.
+func (m *ChunkManifest) chunkDigest(i int) cipher.SHA256 {
+	sum, _ := parseSHA256(m.Chunks[i]) //nolint:errcheck
+	return sum
+}
+
+func sourceURL(src dmsg.Addr, path string) string {
+	u := url.URL{Scheme: "dmsg", Host: src.String(), Path: path}
+	return u.String()
+}
+
+// chunkScheduler hands out chunks to the workers of a multi-source download.
+// Once no chunk is left unassigned, idle workers duplicate chunks that are still in flight, so a slow source does
+// not hold up the end of the download.
+type chunkScheduler struct {
+	mx        sync.Mutex
+	cond      *sync.Cond
+	pending   []int
+	inflight  map[int]int
+	done      []bool
+	remaining int
+	workers   int
+	aborted   bool
+}
+
+func newChunkScheduler(chunks, workers int) *chunkScheduler {
+	s := &chunkScheduler{
+		pending:   make([]int, chunks),
+		inflight:  make(map[int]int),
+		done:      make([]bool, chunks),
+		remaining: chunks,
+		workers:   workers,
+	}
+	s.cond = sync.NewCond(&s.mx)
+	for i := range s.pending {
+		s.pending[i] = i
+	}
+	return s
+}
+
+// next returns the next chunk to fetch, blocking while there is nothing to do but the download is not finished.
+func (s *chunkScheduler) next() (int, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for {
+		if s.aborted || s.remaining == 0 {
+			return 0, false
+		}
+		if len(s.pending) > 0 {
+			i := s.pending[0]
+			s.pending = s.pending[1:]
+			s.inflight[i]++
+			return i, true
+		}
+		// Endgame: duplicate the in-flight chunk with the fewest fetchers.
+		best, bestN := -1, 0
+		for i, n := range s.inflight {
+			if !s.done[i] && n < 2 && (best < 0 || n < bestN) {
+				best, bestN = i, n
+			}
+		}
+		if best >= 0 {
+			s.inflight[best]++
+			return best, true
+		}
+		s.cond.Wait()
+	}
+}
+
+// fail returns a chunk which could not be fetched.
+func (s *chunkScheduler) fail(i int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.inflight[i]--; s.inflight[i] <= 0 {
+		delete(s.inflight, i)
+		if !s.done[i] {
+			s.pending = append(s.pending, i)
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// claim marks a fetched chunk as done. It returns false if another worker fetched the chunk first.
+func (s *chunkScheduler) claim(i int) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.inflight[i]--; s.inflight[i] <= 0 {
+		delete(s.inflight, i)
+	}
+	if s.done[i] {
+		return false
+	}
+	s.done[i] = true
+	return true
+}
+
+// finish is called once a claimed chunk is written.
+func (s *chunkScheduler) finish() {
+	s.mx.Lock()
+	s.remaining--
+	s.cond.Broadcast()
+	s.mx.Unlock()
+}
+
+// leave is called when a worker exits. Once no worker is left, waiting workers are released.
+func (s *chunkScheduler) leave() {
+	s.mx.Lock()
+	if s.workers--; s.workers == 0 {
+		s.aborted = true
+	}
+	s.cond.Broadcast()
+	s.mx.Unlock()
+}
+
+func (s *chunkScheduler) abort() {
+	s.mx.Lock()
+	s.aborted = true
+	s.cond.Broadcast()
+	s.mx.Unlock()
+}
+
+func (s *chunkScheduler) complete() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.remaining == 0
+}
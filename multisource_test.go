@@ -0,0 +1,161 @@
+package dmsghttp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+// hostRouter is a http.RoundTripper which dispatches requests to in-process handlers by URL host.
+type hostRouter map[string]http.Handler
+
+func (hr hostRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := hr[req.URL.Host]
+	if !ok {
+		return nil, errors.New("no route to host")
+	}
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return rec.Result(), nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+func TestMultiSourceDownloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_multisource")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file.bin"), content, 0600))
+
+	files := dmsghttp.NewFileServer(http.Dir(dir), dmsghttp.FileServerConfig{ChunkSize: 1024})
+
+	newAddr := func() dmsg.Addr {
+		pk, _ := cipher.GenerateKeyPair()
+		return dmsg.Addr{PK: pk, Port: testPort}
+	}
+
+	var (
+		mx       sync.Mutex
+		requests = make(map[string]int)
+	)
+	count := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mx.Lock()
+			requests[r.Host]++
+			mx.Unlock()
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	good, corrupt, slow := newAddr(), newAddr(), newAddr()
+	router := hostRouter{
+		good.String(): count(files),
+		corrupt.String(): count(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := httptest.NewRecorder()
+			files.ServeHTTP(rec, r)
+			b := rec.Body.Bytes()
+			if len(b) > 0 {
+				b[0] ^= 0xff
+			}
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			_, _ = w.Write(b) //nolint:errcheck
+		})),
+		slow.String(): count(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+				files.ServeHTTP(w, r)
+			case <-r.Context().Done():
+			}
+		})),
+	}
+
+	t.Run("rebalances away from bad sources", func(t *testing.T) {
+		var written int64
+		d := dmsghttp.MultiSourceDownloader{
+			Client:            &http.Client{Transport: router},
+			Sources:           []dmsg.Addr{good, corrupt, slow},
+			ChunkTimeout:      100 * time.Millisecond,
+			MaxSourceFailures: 2,
+			Progress:          func(w, _ int64) { written = w },
+		}
+
+		dst := filepath.Join(dir, "out.bin")
+		require.NoError(t, d.Download(context.Background(), "/file.bin", dst))
+
+		got, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		require.Equal(t, int64(len(content)), written)
+
+		mx.Lock()
+		defer mx.Unlock()
+		require.Equal(t, 2, requests[corrupt.String()])
+		require.True(t, requests[slow.String()] <= 2)
+	})
+
+	t.Run("fails without good sources", func(t *testing.T) {
+		c := &http.Client{Transport: router}
+		d := dmsghttp.MultiSourceDownloader{
+			Client:            c,
+			Sources:           []dmsg.Addr{corrupt},
+			Manifest:          fetchChunkManifest(t, c, good, "/file.bin"),
+			MaxSourceFailures: 1,
+		}
+
+		err := d.Download(context.Background(), "/file.bin", filepath.Join(dir, "failed.bin"))
+		require.True(t, errors.Is(err, dmsghttp.ErrAllSourcesFailed))
+
+		_, err = os.Stat(filepath.Join(dir, "failed.bin.part"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("falls back to the default client", func(t *testing.T) {
+		// http.DefaultClient does not speak dmsg, so fetching the manifest fails for every source.
+		a, b := newAddr(), newAddr()
+		d := dmsghttp.MultiSourceDownloader{Sources: []dmsg.Addr{a, b}}
+		err := d.Download(context.Background(), "/file.bin", filepath.Join(dir, "default.bin"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), a.String()+": ")
+		require.Contains(t, err.Error(), "; "+b.String()+": ")
+		require.NotContains(t, err.Error(), "[")
+	})
+}
+
+func fetchChunkManifest(t *testing.T, c *http.Client, src dmsg.Addr, path string) *dmsghttp.ChunkManifest {
+	resp, err := c.Get("dmsg://" + src.String() + path + "?" + dmsghttp.ChunkManifestQuery)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+
+	var m dmsghttp.ChunkManifest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	return &m
+}
@@ -0,0 +1,292 @@
+package dmsghttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// DefaultIdleStreamTTL is the default time idle streams of a StreamPool are used for.
+const DefaultIdleStreamTTL = 30 * time.Second
+
+// readyPollInterval is the interval at which Ready checks the sessions of the dmsg client.
+const readyPollInterval = 10 * time.Millisecond
+
+// probeTimeout is the time an idle stream is read from to check whether the remote closed it.
+const probeTimeout = time.Millisecond
+
+// Ready blocks until the dmsg client is ready and has at least MinSessions sessions with dmsg servers, or until the
+// context is done. It replaces sleeping after starting a dmsg client.
+func (t Transport) Ready(ctx context.Context) error {
+	select {
+	case <-t.DmsgClient.Ready():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	min := t.MinSessions
+	if min <= 0 {
+		min = 1
+	}
+	tick := time.NewTicker(readyPollInterval)
+	defer tick.Stop()
+
+	for t.DmsgClient.SessionCount() < min {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// Prewarm establishes sessions with the delegated servers of the given peers, so that the first requests to them do
+// not pay for the session handshakes. The servers are looked up in Discovery, sessions are only established by
+// dialing streams without one. If Pool is set, it also opens idle streams to the configured ports of the peers, which
+// requests use instead of dialing.
+// The identity selected by the context with WithIdentity is prewarmed, the default one if none.
+// Peers are prewarmed concurrently; the first error is returned once all of them are done.
+func (t Transport) Prewarm(ctx context.Context, pks ...cipher.PubKey) error {
+	dmsgC, err := t.identityClient(ctx, nil)
+	if err != nil {
+		return err
+	}
+	t.DmsgClient = dmsgC
+
+	errCh := make(chan error, len(pks))
+	for _, pk := range pks {
+		go func(pk cipher.PubKey) {
+			errCh <- t.prewarm(ctx, pk)
+		}(pk)
+	}
+
+	for range pks {
+		if pErr := <-errCh; pErr != nil && err == nil {
+			err = pErr
+		}
+	}
+	return err
+}
+
+func (t Transport) prewarm(ctx context.Context, pk cipher.PubKey) error {
+	if t.Discovery != nil {
+		entry, err := t.Discovery.Entry(ctx, pk)
+		if err != nil {
+			return fmt.Errorf("failed to prewarm %s: %w", pk, err)
+		}
+		if entry.Client == nil {
+			return fmt.Errorf("failed to prewarm %s: %w", pk, dmsg.ErrDiscEntryIsNotClient)
+		}
+		if err := t.ensureSession(ctx, entry.Client.DelegatedServers); err != nil {
+			return fmt.Errorf("failed to prewarm %s: %w", pk, err)
+		}
+	}
+
+	if t.Pool == nil {
+		return nil
+	}
+	local := t.DmsgClient.LocalPK()
+	for _, port := range t.Pool.ports {
+		addr := dmsg.Addr{PK: pk, Port: port}
+		for i := t.Pool.idleCount(local, addr); i < t.Pool.streams; i++ {
+			stream, err := t.dialStream(ctx, addr)
+			if err != nil {
+				return fmt.Errorf("failed to prewarm %s: %w", addr, err)
+			}
+			t.Pool.put(local, addr, stream)
+		}
+	}
+	return nil
+}
+
+// ensureSession ensures a session with one of the given servers, preferring existing ones.
+func (t Transport) ensureSession(ctx context.Context, srvPKs []cipher.PubKey) error {
+	if len(srvPKs) == 0 {
+		return dmsg.ErrDiscEntryHasNoDelegated
+	}
+	for _, srvPK := range srvPKs {
+		if _, ok := t.DmsgClient.Session(srvPK); ok {
+			return nil
+		}
+	}
+	for _, srvPK := range srvPKs {
+		if _, err := t.DmsgClient.EnsureAndObtainSession(ctx, srvPK); err == nil {
+			return nil
+		}
+	}
+	return dmsg.ErrCannotConnectToDelegated
+}
+
+// StreamPoolConfig configures a StreamPool.
+type StreamPoolConfig struct {
+	// Ports are the ports of the remote peers which Transport.Prewarm opens idle streams to.
+	Ports []uint16
+
+	// Streams is the number of idle streams Transport.Prewarm keeps to every address. 1 if zero.
+	Streams int
+
+	// TTL is the time an idle stream is used for. Older streams are closed instead, as the server may have dropped
+	// them. DefaultIdleStreamTTL if zero.
+	TTL time.Duration
+}
+
+// StreamPool holds idle streams opened by Transport.Prewarm. Every stream carries a single request.
+// Streams are kept per identity, so requests only take streams dialed by the identity they select.
+// Idle streams are not counted by a PeerLimiter until a request takes them.
+type StreamPool struct {
+	ports   []uint16
+	streams int
+	ttl     time.Duration
+
+	mx     sync.Mutex
+	idle   map[poolKey][]idleStream
+	closed bool
+}
+
+// poolKey identifies the idle streams from a local identity to a remote address.
+type poolKey struct {
+	local cipher.PubKey
+	addr  dmsg.Addr
+}
+
+type idleStream struct {
+	stream *dmsg.Stream
+	opened time.Time
+}
+
+// NewStreamPool creates a StreamPool.
+func NewStreamPool(conf StreamPoolConfig) *StreamPool {
+	p := &StreamPool{
+		ports:   conf.Ports,
+		streams: conf.Streams,
+		ttl:     conf.TTL,
+		idle:    make(map[poolKey][]idleStream),
+	}
+	if p.streams <= 0 {
+		p.streams = 1
+	}
+	if p.ttl == 0 {
+		p.ttl = DefaultIdleStreamTTL
+	}
+	return p
+}
+
+// Idle returns the number of idle streams to addr which have not expired, summed over all identities.
+func (p *StreamPool) Idle(addr dmsg.Addr) int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	n := 0
+	for key := range p.idle {
+		if key.addr == addr {
+			p.expire(key)
+			n += len(p.idle[key])
+		}
+	}
+	return n
+}
+
+// idleCount returns the number of idle streams from the local identity to addr which have not expired.
+func (p *StreamPool) idleCount(local cipher.PubKey, addr dmsg.Addr) int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	key := poolKey{local: local, addr: addr}
+	p.expire(key)
+	return len(p.idle[key])
+}
+
+// Close closes all idle streams. Streams put into the pool afterwards are closed at once.
+func (p *StreamPool) Close() error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.closed = true
+	for key, streams := range p.idle {
+		for _, s := range streams {
+			_ = s.stream.Close() //nolint:errcheck
+		}
+		delete(p.idle, key)
+	}
+	return nil
+}
+
+// get takes the oldest idle stream from the local identity to addr which has not expired and is still open.
+func (p *StreamPool) get(local cipher.PubKey, addr dmsg.Addr) (*dmsg.Stream, bool) {
+	for {
+		stream, ok := p.take(local, addr)
+		if !ok {
+			return nil, false
+		}
+		if alive(stream) {
+			return stream, true
+		}
+		_ = stream.Close() //nolint:errcheck
+	}
+}
+
+// take takes the oldest idle stream from the local identity to addr which has not expired.
+func (p *StreamPool) take(local cipher.PubKey, addr dmsg.Addr) (*dmsg.Stream, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	key := poolKey{local: local, addr: addr}
+	p.expire(key)
+	streams := p.idle[key]
+	if len(streams) == 0 {
+		return nil, false
+	}
+	s := streams[0]
+	if len(streams) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = streams[1:]
+	}
+	return s.stream, true
+}
+
+// alive reports whether the remote did not close an idle stream. Servers send nothing before a request, so any read
+// result other than a timeout means the stream is gone.
+func alive(stream *dmsg.Stream) bool {
+	if err := stream.SetReadDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return false
+	}
+	_, err := stream.Read(make([]byte, 1))
+	if dErr := stream.SetReadDeadline(time.Time{}); dErr != nil {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (p *StreamPool) put(local cipher.PubKey, addr dmsg.Addr, stream *dmsg.Stream) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.closed {
+		_ = stream.Close() //nolint:errcheck
+		return
+	}
+	key := poolKey{local: local, addr: addr}
+	p.idle[key] = append(p.idle[key], idleStream{stream: stream, opened: time.Now()})
+}
+
+// expire closes the expired idle streams of key. It has to be called with the lock held.
+func (p *StreamPool) expire(key poolKey) {
+	streams := p.idle[key]
+	i := 0
+	for ; i < len(streams) && time.Since(streams[i].opened) >= p.ttl; i++ {
+		_ = streams[i].stream.Close() //nolint:errcheck
+	}
+	if i == len(streams) {
+		delete(p.idle, key)
+	} else if i > 0 {
+		p.idle[key] = streams[i:]
+	}
+}
@@ -0,0 +1,146 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+	"github.com/SkycoinProject/dmsg-http/devnet"
+)
+
+func TestPrewarm(t *testing.T) {
+	n, err := devnet.Start(devnet.Config{Servers: 2, Clients: 1})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, n.Close()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	require.NoError(t, n.Ready(ctx))
+
+	srvC := n.Clients()[0]
+	lis, err := srvC.Listen(testPort)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok")) //nolint:errcheck
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	pk, sk := cipher.GenerateKeyPair()
+	tr := dmsghttp.NewTransport(pk, sk, n.DiscClient(), dmsg.DefaultConfig())
+	defer func() { require.NoError(t, tr.DmsgClient.Close()) }()
+	require.NoError(t, tr.Ready(ctx))
+
+	addr := dmsg.Addr{PK: srvC.LocalPK(), Port: testPort}
+	url := "dmsg://" + addr.String() + "/"
+
+	t.Run("sessions and idle streams", func(t *testing.T) {
+		tr := tr
+		tr.Pool = dmsghttp.NewStreamPool(dmsghttp.StreamPoolConfig{Ports: []uint16{testPort}, Streams: 2})
+		defer func() { require.NoError(t, tr.Pool.Close()) }()
+
+		require.NoError(t, tr.Prewarm(ctx, addr.PK))
+		require.Equal(t, 2, tr.Pool.Idle(addr))
+
+		entry, err := tr.Discovery.Entry(ctx, addr.PK)
+		require.NoError(t, err)
+		hasSession := false
+		for _, srvPK := range entry.Client.DelegatedServers {
+			if _, ok := tr.DmsgClient.Session(srvPK); ok {
+				hasSession = true
+			}
+		}
+		require.True(t, hasSession)
+
+		// requests take idle streams first
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+		require.Equal(t, "ok", getBody(t, c, url))
+		require.Equal(t, 1, tr.Pool.Idle(addr))
+
+		// prewarming again tops the pool up
+		require.NoError(t, tr.Prewarm(ctx, addr.PK))
+		require.Equal(t, 2, tr.Pool.Idle(addr))
+		require.Equal(t, "ok", getBody(t, c, url))
+		require.Equal(t, "ok", getBody(t, c, url))
+		require.Equal(t, "ok", getBody(t, c, url))
+		require.Equal(t, 0, tr.Pool.Idle(addr))
+	})
+
+	t.Run("expired streams are dropped", func(t *testing.T) {
+		tr := tr
+		tr.Pool = dmsghttp.NewStreamPool(dmsghttp.StreamPoolConfig{Ports: []uint16{testPort}, TTL: 50 * time.Millisecond})
+		defer func() { require.NoError(t, tr.Pool.Close()) }()
+
+		require.NoError(t, tr.Prewarm(ctx, addr.PK))
+		require.Equal(t, 1, tr.Pool.Idle(addr))
+		time.Sleep(100 * time.Millisecond)
+		require.Equal(t, 0, tr.Pool.Idle(addr))
+		require.Equal(t, "ok", getBody(t, &http.Client{Transport: tr, Timeout: clientTimeout}, url))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		unknownPK, _ := cipher.GenerateKeyPair()
+		err := tr.Prewarm(ctx, addr.PK, unknownPK)
+		require.True(t, errors.Is(err, disc.ErrKeyNotFound), err)
+	})
+
+	t.Run("without a discovery", func(t *testing.T) {
+		pool := dmsghttp.NewStreamPool(dmsghttp.StreamPoolConfig{Ports: []uint16{testPort}})
+		defer func() { require.NoError(t, pool.Close()) }()
+		tr := dmsghttp.Transport{DmsgClient: tr.DmsgClient, Pool: pool}
+
+		require.NoError(t, tr.Prewarm(ctx, addr.PK))
+		require.Equal(t, 1, pool.Idle(addr))
+		require.Equal(t, "ok", getBody(t, &http.Client{Transport: tr, Timeout: clientTimeout}, url))
+		require.Equal(t, 0, pool.Idle(addr))
+	})
+
+	t.Run("streams closed by the remote are dropped", func(t *testing.T) {
+		const port = testPort + 1
+		lis, err := srvC.Listen(port)
+		require.NoError(t, err)
+		// the server closes connections which do not send a request in time, such as idle streams
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("ok")) //nolint:errcheck
+			}),
+			ReadHeaderTimeout: 50 * time.Millisecond,
+		}
+		go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+		defer func() { require.NoError(t, srv.Close()) }()
+
+		tr := tr
+		tr.Pool = dmsghttp.NewStreamPool(dmsghttp.StreamPoolConfig{Ports: []uint16{port}, Streams: 2})
+		defer func() { require.NoError(t, tr.Pool.Close()) }()
+		closedAddr := dmsg.Addr{PK: srvC.LocalPK(), Port: port}
+
+		require.NoError(t, tr.Prewarm(ctx, closedAddr.PK))
+		require.Equal(t, 2, tr.Pool.Idle(closedAddr))
+		time.Sleep(200 * time.Millisecond)
+
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+		require.Equal(t, "ok", getBody(t, c, "dmsg://"+closedAddr.String()+"/"))
+		require.Equal(t, 0, tr.Pool.Idle(closedAddr))
+	})
+
+	t.Run("ready waits for sessions", func(t *testing.T) {
+		rCtx, rCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer rCancel()
+		err := dmsghttp.Transport{DmsgClient: tr.DmsgClient, MinSessions: 3}.Ready(rCtx)
+		require.Equal(t, context.DeadlineExceeded, err)
+
+		// a client which is not served never gets ready
+		pk, sk := cipher.GenerateKeyPair()
+		idle := dmsg.NewClient(pk, sk, n.DiscClient(), dmsg.DefaultConfig())
+		err = dmsghttp.Transport{DmsgClient: idle}.Ready(rCtx)
+		require.Equal(t, context.DeadlineExceeded, err)
+	})
+}
@@ -0,0 +1,80 @@
+package dmsghttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// ProxyConfig configures NewProxy.
+type ProxyConfig struct {
+	// AllowedPKs restricts access to clients of the given public keys.
+	// All clients are allowed if empty.
+	AllowedPKs []cipher.PubKey
+}
+
+// NewProxy returns a handler which serves proxy-style requests for other dmsg origins, i.e. requests with an
+// absolute "dmsg://<pk>:<port>/..." URL as sent by a Transport with Proxy set, by passing them to rt.
+// With a Cache as rt, the proxy is a caching gateway shared by all of its clients.
+// Failed round trips are answered with 502 Bad Gateway, or 504 Gateway Timeout if they timed out.
+// IdentityHeader is removed from the requests, so that clients can not select the identities of rt.
+func NewProxy(rt http.RoundTripper, conf ProxyConfig) http.Handler {
+	p := &proxy{
+		rp: &httputil.ReverseProxy{
+			// the request already has the URL of the origin, so only the identity header is removed
+			Director:     func(r *http.Request) { r.Header.Del(IdentityHeader) },
+			Transport:    rt,
+			ErrorHandler: proxyError,
+		},
+	}
+	if len(conf.AllowedPKs) > 0 {
+		p.allowed = make(map[cipher.PubKey]struct{}, len(conf.AllowedPKs))
+		for _, pk := range conf.AllowedPKs {
+			p.allowed[pk] = struct{}{}
+		}
+	}
+	return p
+}
+
+// ServeProxy serves NewProxy(rt, conf) on the given port of the dmsg client.
+// It blocks until the context is canceled or serving fails.
+func ServeProxy(ctx context.Context, dmsgC *dmsg.Client, port uint16, rt http.RoundTripper, conf ProxyConfig) error {
+	return serveHandler(ctx, dmsgC, port, NewProxy(rt, conf))
+}
+
+type proxy struct {
+	rp      *httputil.ReverseProxy
+	allowed map[cipher.PubKey]struct{}
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.allowed != nil {
+		addr, err := RemoteAddr(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if _, ok := p.allowed[addr.PK]; !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.URL.Scheme != "dmsg" || r.URL.Host == "" {
+		http.Error(w, "proxy requests need an absolute dmsg:// URL", http.StatusBadRequest)
+		return
+	}
+	p.rp.ServeHTTP(w, r)
+}
+
+func proxyError(w http.ResponseWriter, _ *http.Request, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
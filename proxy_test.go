@@ -0,0 +1,90 @@
+package dmsghttp_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_proxy")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	lb, origin, h, closeOrigin := newCacheOrigin(t, http.Header{"Cache-Control": {"max-age=60"}})
+	defer closeOrigin()
+
+	alicePK, _ := cipher.GenerateKeyPair()
+	bobPK, _ := cipher.GenerateKeyPair()
+	strangerPK, _ := cipher.GenerateKeyPair()
+
+	gwPK, _ := cipher.GenerateKeyPair()
+	gw := dmsg.Addr{PK: gwPK, Port: testPort}
+	lis, err := lb.Listen(gwPK, testPort)
+	require.NoError(t, err)
+	store, err := dmsghttp.NewDiskCacheStore(dir, 0)
+	require.NoError(t, err)
+	cache := dmsghttp.NewCache(lb.Transport(gwPK), dmsghttp.CacheConfig{Store: store})
+	srv := &http.Server{Handler: dmsghttp.NewProxy(cache, dmsghttp.ProxyConfig{AllowedPKs: []cipher.PubKey{alicePK, bobPK}})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	client := func(pk cipher.PubKey) *http.Client {
+		tr := lb.Transport(pk)
+		tr.Proxy = gw
+		return &http.Client{Transport: tr, Timeout: clientTimeout}
+	}
+	url := "dmsg://" + origin.String() + "/"
+
+	// responses are shared between the clients of the gateway
+	resp, body := cacheGet(t, client(alicePK), url, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "v0 ", body)
+	h.set(1, http.Header{"Cache-Control": {"max-age=60"}})
+	_, body = cacheGet(t, client(bobPK), url, nil)
+	require.Equal(t, "v0 ", body)
+	requests, _ := h.stats()
+	require.Equal(t, 1, requests)
+
+	// the origin and the digest are recorded with the cached response
+	e, err := store.Get(origin.String() + "/")
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte("v0 "))
+	require.Equal(t, origin, e.Origin)
+	require.Equal(t, hex.EncodeToString(sum[:]), e.SHA256)
+
+	resp, _ = cacheGet(t, client(strangerPK), url, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// requests for the gateway itself are no proxy requests
+	resp, _ = cacheGet(t, &http.Client{Transport: lb.Transport(alicePK)}, "dmsg://"+gw.String()+"/", nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// clients can not select the identities of the gateway
+	id, _ := cipher.GenerateKeyPair()
+	req := httptest.NewRequest(http.MethodGet, url+"identity", nil)
+	req.Header.Set(dmsghttp.IdentityHeader, id.Hex())
+	rec := httptest.NewRecorder()
+	rt := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		require.Empty(t, r.Header.Get(dmsghttp.IdentityHeader))
+		return lb.Transport(gwPK).RoundTrip(r)
+	})
+	dmsghttp.NewProxy(rt, dmsghttp.ProxyConfig{}).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	lb.FailDial(origin, dmsg.ErrDiscEntryNotFound)
+	resp, body = cacheGet(t, client(alicePK), url+"other", nil)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.True(t, strings.Contains(body, dmsg.ErrDiscEntryNotFound.Error()), body)
+}
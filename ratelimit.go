@@ -0,0 +1,163 @@
+package dmsghttp
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// DefaultRateLimitKeys is the default number of token buckets kept by RateLimit.
+const DefaultRateLimitKeys = 10000
+
+// Rate is the rate of a token bucket: Requests per Per, with bursts of up to Burst requests.
+// The zero Rate does not limit.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+
+	// Burst is the capacity of the bucket. Requests is used if zero.
+	Burst int
+}
+
+func (r Rate) unlimited() bool {
+	return r.Requests <= 0 || r.Per <= 0
+}
+
+func (r Rate) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Requests
+}
+
+// perSecond returns the number of tokens added per second.
+func (r Rate) perSecond() float64 {
+	return float64(r.Requests) / r.Per.Seconds()
+}
+
+// RateLimitConfig configures RateLimit.
+type RateLimitConfig struct {
+	// Default is the rate of clients without an entry in PerPK.
+	Default Rate
+
+	// PerPK holds the rates of individual clients. They apply to all routes.
+	PerPK map[cipher.PubKey]Rate
+
+	// Routes overrides Default for requests with a URL path starting with a key of the map. The longest matching
+	// prefix is used and every route has buckets of its own.
+	Routes map[string]Rate
+
+	// MaxKeys is the number of buckets kept. The least recently used bucket is dropped when more are needed.
+	// DefaultRateLimitKeys is used if zero.
+	MaxKeys int
+}
+
+// RateLimit limits the rate of requests by the public key of the client, as dmsg clients do not have addresses of
+// their own. Requests not served over dmsg share the bucket of the null public key.
+// Responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers. Requests over the limit are
+// rejected with 429 Too Many Requests and a Retry-After header.
+func RateLimit(h http.Handler, conf RateLimitConfig) http.Handler {
+	if conf.MaxKeys == 0 {
+		conf.MaxKeys = DefaultRateLimitKeys
+	}
+	return &rateLimiter{h: h, conf: conf, buckets: newLRUCache(conf.MaxKeys)}
+}
+
+type rateLimiter struct {
+	h    http.Handler
+	conf RateLimitConfig
+
+	mx      sync.Mutex
+	buckets *lruCache
+}
+
+// bucketKey identifies the bucket of a client for a route.
+type bucketKey struct {
+	pk    cipher.PubKey
+	route string
+}
+
+// tokenBucket holds the tokens of a client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var pk cipher.PubKey
+	if addr, err := RemoteAddr(r); err == nil {
+		pk = addr.PK
+	}
+	rate, route := l.rate(pk, r.URL.Path)
+	if rate.unlimited() {
+		l.h.ServeHTTP(w, r)
+		return
+	}
+
+	ok, remaining, reset, retryAfter := l.take(bucketKey{pk: pk, route: route}, rate)
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(rate.burst()))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	l.h.ServeHTTP(w, r)
+}
+
+// rate returns the rate of pk for the given path, and the route it belongs to.
+func (l *rateLimiter) rate(pk cipher.PubKey, path string) (Rate, string) {
+	if rate, ok := l.conf.PerPK[pk]; ok {
+		return rate, ""
+	}
+	rate, route := l.conf.Default, ""
+	for prefix, rRate := range l.conf.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(route) {
+			rate, route = rRate, prefix
+		}
+	}
+	return rate, route
+}
+
+// take takes a token from the bucket of key. It returns whether a token was available, the number of remaining
+// tokens, the time until the bucket is full again and, if no token was available, the time until the next one.
+func (l *rateLimiter) take(key bucketKey, rate Rate) (ok bool, remaining int, reset, retryAfter time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := time.Now()
+	burst, perSecond := float64(rate.burst()), rate.perSecond()
+
+	b := &tokenBucket{tokens: burst, last: now}
+	if v, found := l.buckets.get(key); found {
+		b = v.(*tokenBucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+		b.last = now
+	} else {
+		l.buckets.add(key, b)
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = secondsDuration((1 - b.tokens) / perSecond)
+	}
+	reset = secondsDuration((burst - b.tokens) / perSecond)
+	return ok, int(b.tokens), reset, retryAfter
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
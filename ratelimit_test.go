@@ -0,0 +1,122 @@
+package dmsghttp_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestRateLimit(t *testing.T) {
+	newServer := func(t *testing.T, conf dmsghttp.RateLimitConfig) (*dmsghttp.Loopback, string, func()) {
+		lb := dmsghttp.NewLoopback()
+		pk, _ := cipher.GenerateKeyPair()
+		lis, err := lb.Listen(pk, testPort)
+		require.NoError(t, err)
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})
+		srv := &http.Server{Handler: dmsghttp.RateLimit(h, conf)}
+		go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+		return lb, "dmsg://" + dmsg.Addr{PK: pk, Port: testPort}.String(), func() { require.NoError(t, srv.Close()) }
+	}
+	get := func(t *testing.T, lb *dmsghttp.Loopback, pk cipher.PubKey, url string) *http.Response {
+		c := &http.Client{Transport: lb.Transport(pk), Timeout: clientTimeout}
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+	pkA, _ := cipher.GenerateKeyPair()
+	pkB, _ := cipher.GenerateKeyPair()
+
+	t.Run("default rate per key", func(t *testing.T) {
+		lb, url, closeSrv := newServer(t, dmsghttp.RateLimitConfig{Default: dmsghttp.Rate{Requests: 2, Per: time.Minute}})
+		defer closeSrv()
+
+		resp := get(t, lb, pkA, url+"/")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+		require.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+		require.Equal(t, "30", resp.Header.Get("RateLimit-Reset"))
+
+		resp = get(t, lb, pkA, url+"/")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+		resp = get(t, lb, pkA, url+"/")
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		require.Equal(t, "30", resp.Header.Get("Retry-After"))
+
+		require.Equal(t, http.StatusOK, get(t, lb, pkB, url+"/").StatusCode)
+	})
+
+	t.Run("per key rate", func(t *testing.T) {
+		lb, url, closeSrv := newServer(t, dmsghttp.RateLimitConfig{
+			Default: dmsghttp.Rate{Requests: 1, Per: time.Minute},
+			PerPK:   map[cipher.PubKey]dmsghttp.Rate{pkA: {Requests: 3, Per: time.Minute}},
+		})
+		defer closeSrv()
+
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/").StatusCode)
+		}
+		require.Equal(t, http.StatusTooManyRequests, get(t, lb, pkA, url+"/").StatusCode)
+		require.Equal(t, http.StatusOK, get(t, lb, pkB, url+"/").StatusCode)
+		require.Equal(t, http.StatusTooManyRequests, get(t, lb, pkB, url+"/").StatusCode)
+	})
+
+	t.Run("route override", func(t *testing.T) {
+		lb, url, closeSrv := newServer(t, dmsghttp.RateLimitConfig{
+			Default: dmsghttp.Rate{Requests: 2, Per: time.Minute},
+			Routes: map[string]dmsghttp.Rate{
+				"/api/":      {Requests: 1, Per: time.Minute},
+				"/api/bulk/": {Requests: 3, Per: time.Minute},
+			},
+		})
+		defer closeSrv()
+
+		require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/api/a").StatusCode)
+		require.Equal(t, http.StatusTooManyRequests, get(t, lb, pkA, url+"/api/b").StatusCode)
+
+		resp := get(t, lb, pkA, url+"/api/bulk/a")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "3", resp.Header.Get("RateLimit-Limit"))
+
+		require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/other").StatusCode)
+	})
+
+	t.Run("refill and burst", func(t *testing.T) {
+		lb, url, closeSrv := newServer(t, dmsghttp.RateLimitConfig{
+			Default: dmsghttp.Rate{Requests: 10, Per: time.Second, Burst: 1},
+		})
+		defer closeSrv()
+
+		require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/").StatusCode)
+		resp := get(t, lb, pkA, url+"/")
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+		time.Sleep(150 * time.Millisecond)
+		require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/").StatusCode)
+	})
+
+	t.Run("bounded buckets", func(t *testing.T) {
+		lb, url, closeSrv := newServer(t, dmsghttp.RateLimitConfig{
+			Default: dmsghttp.Rate{Requests: 1, Per: time.Hour},
+			MaxKeys: 1,
+		})
+		defer closeSrv()
+
+		require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/").StatusCode)
+		require.Equal(t, http.StatusTooManyRequests, get(t, lb, pkA, url+"/").StatusCode)
+
+		// the bucket of pkB replaces the one of pkA
+		require.Equal(t, http.StatusOK, get(t, lb, pkB, url+"/").StatusCode)
+		require.Equal(t, http.StatusOK, get(t, lb, pkA, url+"/").StatusCode)
+	})
+}
@@ -0,0 +1,411 @@
+package dmsghttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// RegistryPath is the URL path prefix under which a name registry serves its records, e.g. "/names/billing".
+const RegistryPath = "/names/"
+
+// maxRecordSize is the maximum size of a published name record.
+const maxRecordSize = 64 << 10
+
+// Registry errors.
+var (
+	ErrInvalidSignature = errors.New("invalid record signature")
+	ErrRecordExpired    = errors.New("name record expired")
+	ErrNameTaken        = errors.New("name is owned by another public key")
+	ErrStaleRecord      = errors.New("record is not newer than the published one")
+)
+
+// NameRecord maps a name to the public key of its owner.
+// Records are signed with the secret key of PK, which makes PK the owner of the name until the record expires.
+// An owner replaces its record with one of a higher Sequence, or of the same Sequence and a later expiry, so that
+// older records can not be replayed.
+type NameRecord struct {
+	Name     string            `json:"name"`
+	PK       cipher.PubKey     `json:"pk"`
+	Ports    []uint16          `json:"ports,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Sequence uint64            `json:"seq,omitempty"`
+	Expires  time.Time         `json:"expires"`
+	Sig      cipher.Sig        `json:"sig"`
+}
+
+// Addr returns the dmsg address of the record. The first port is used, if any.
+func (r NameRecord) Addr() dmsg.Addr {
+	addr := dmsg.Addr{PK: r.PK}
+	if len(r.Ports) > 0 {
+		addr.Port = r.Ports[0]
+	}
+	return addr
+}
+
+// Sign sets PK and Sig of the record using sk.
+func (r *NameRecord) Sign(sk cipher.SecKey) error {
+	pk, err := sk.PubKey()
+	if err != nil {
+		return err
+	}
+	r.PK = pk
+	payload, err := r.payload()
+	if err != nil {
+		return err
+	}
+	r.Sig, err = cipher.SignPayload(payload, sk)
+	return err
+}
+
+// newerThan reports whether the record supersedes old, a record of the same owner.
+func (r NameRecord) newerThan(old NameRecord) bool {
+	if r.Sequence != old.Sequence {
+		return r.Sequence > old.Sequence
+	}
+	return r.Expires.After(old.Expires)
+}
+
+// Verify checks that the record is signed by PK and has not expired.
+func (r NameRecord) Verify() error {
+	payload, err := r.payload()
+	if err != nil {
+		return err
+	}
+	if err := cipher.VerifyPubKeySignedPayload(r.PK, r.Sig, payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if !time.Now().Before(r.Expires) {
+		return ErrRecordExpired
+	}
+	return nil
+}
+
+// payload returns the signed representation of the record.
+func (r NameRecord) payload() ([]byte, error) {
+	r.Name = normalizeName(r.Name)
+	r.Expires = r.Expires.UTC()
+	r.Sig = cipher.Sig{}
+	return json.Marshal(r)
+}
+
+// NameStore persists the name records of a registry.
+type NameStore interface {
+	// Get returns the record of a name or an error wrapping ErrUnknownName.
+	Get(name string) (NameRecord, error)
+	// Put stores a record, replacing the previous record of the same name.
+	Put(rec NameRecord) error
+}
+
+// FileNameStore is a NameStore which keeps all records in a JSON file.
+type FileNameStore struct {
+	path string
+
+	mx      sync.RWMutex
+	records map[string]NameRecord
+}
+
+// NewFileNameStore opens the store at path. The file is created on the first Put if it does not exist.
+func NewFileNameStore(path string) (*FileNameStore, error) {
+	s := &FileNameStore{
+		path:    path,
+		records: make(map[string]NameRecord),
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.records); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Get implements NameStore.
+func (s *FileNameStore) Get(name string) (NameRecord, error) {
+	name = normalizeName(name)
+
+	s.mx.RLock()
+	rec, ok := s.records[name]
+	s.mx.RUnlock()
+	if !ok {
+		return NameRecord{}, unknownName(name)
+	}
+	return rec, nil
+}
+
+// Put implements NameStore. Expired records are dropped on every write.
+func (s *FileNameStore) Put(rec NameRecord) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	records := make(map[string]NameRecord, len(s.records)+1)
+	now := time.Now()
+	for name, old := range s.records {
+		if now.Before(old.Expires) {
+			records[name] = old
+		}
+	}
+	records[normalizeName(rec.Name)] = rec
+
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return err
+	}
+	s.records = records
+	return nil
+}
+
+// writeFileAtomic replaces the file at name with data, so readers never see a partial write.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()           //nolint:errcheck
+		_ = os.Remove(f.Name()) //nolint:errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name()) //nolint:errcheck
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+type registry struct {
+	store NameStore
+	mx    sync.Mutex
+}
+
+// NewRegistry returns a handler which serves the records of store under RegistryPath.
+// Records are fetched with GET and published with PUT. A published record has to be validly signed and may only
+// replace a newer record of the same owner, unless the previous record has expired.
+func NewRegistry(store NameStore) http.Handler {
+	return &registry{store: store}
+}
+
+// ServeRegistry serves a name registry on the given port of the dmsg client.
+// It blocks until the context is canceled or serving fails.
+func ServeRegistry(ctx context.Context, dmsgC *dmsg.Client, port uint16, store NameStore) error {
+	return serveHandler(ctx, dmsgC, port, NewRegistry(store))
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, RegistryPath) {
+		http.NotFound(w, r)
+		return
+	}
+	name := normalizeName(strings.TrimPrefix(r.URL.Path, RegistryPath))
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		reg.get(w, r, name)
+	case http.MethodPut:
+		reg.put(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (reg *registry) get(w http.ResponseWriter, r *http.Request, name string) {
+	rec, err := reg.store.Get(name)
+	if errors.Is(err, ErrUnknownName) || (err == nil && !time.Now().Before(rec.Expires)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(rec) //nolint:errcheck
+}
+
+func (reg *registry) put(w http.ResponseWriter, r *http.Request, name string) {
+	var rec NameRecord
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRecordSize)).Decode(&rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if normalizeName(rec.Name) != name {
+		http.Error(w, fmt.Sprintf("record name %q does not match %q", rec.Name, name), http.StatusBadRequest)
+		return
+	}
+	if err := rec.Verify(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reg.mx.Lock()
+	defer reg.mx.Unlock()
+
+	old, err := reg.store.Get(name)
+	switch {
+	case errors.Is(err, ErrUnknownName):
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case !time.Now().Before(old.Expires):
+	case old.PK != rec.PK:
+		http.Error(w, ErrNameTaken.Error(), http.StatusConflict)
+		return
+	case !rec.newerThan(old):
+		http.Error(w, ErrStaleRecord.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := reg.store.Put(rec); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegistryClient looks up and publishes records of a name registry.
+// It implements Resolver, verifying the signature of every record and caching results.
+type RegistryClient struct {
+	client *http.Client
+	addr   dmsg.Addr
+	ttl    time.Duration
+	cache  nameCache
+}
+
+// NewRegistryClient creates a client of the registry at addr which sends requests through c, typically an
+// http.Client using a Transport. Resolved names are cached for ttl, or until their record expires if that is earlier.
+// Unknown names are cached for ttl as well. Nothing is cached if ttl is zero.
+func NewRegistryClient(c *http.Client, addr dmsg.Addr, ttl time.Duration) *RegistryClient {
+	return &RegistryClient{
+		client: c,
+		addr:   addr,
+		ttl:    ttl,
+	}
+}
+
+// Resolve implements Resolver.
+func (c *RegistryClient) Resolve(ctx context.Context, name string) (dmsg.Addr, error) {
+	name = normalizeName(name)
+	now := time.Now()
+
+	if e, ok := c.cache.get(name, now); ok {
+		return e.addr, e.err
+	}
+
+	rec, err := c.Lookup(ctx, name)
+	switch {
+	case err == nil && c.ttl > 0:
+		expires := now.Add(c.ttl)
+		if rec.Expires.Before(expires) {
+			expires = rec.Expires
+		}
+		c.cache.set(name, cachedName{addr: rec.Addr(), expires: expires})
+	case errors.Is(err, ErrUnknownName) && c.ttl > 0:
+		c.cache.set(name, cachedName{err: err, expires: now.Add(c.ttl)})
+	}
+	if err != nil {
+		return dmsg.Addr{}, err
+	}
+	return rec.Addr(), nil
+}
+
+// Lookup fetches and verifies the record of a name, bypassing the cache.
+func (c *RegistryClient) Lookup(ctx context.Context, name string) (NameRecord, error) {
+	name = normalizeName(name)
+	req, err := http.NewRequest(http.MethodGet, sourceURL(c.addr, RegistryPath+name), nil)
+	if err != nil {
+		return NameRecord{}, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return NameRecord{}, err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return NameRecord{}, unknownName(name)
+	default:
+		return NameRecord{}, registryError(resp)
+	}
+
+	var rec NameRecord
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRecordSize)).Decode(&rec); err != nil {
+		return NameRecord{}, err
+	}
+	if normalizeName(rec.Name) != name {
+		return NameRecord{}, &NameError{Name: name, Err: fmt.Errorf("registry returned record of %q", rec.Name)}
+	}
+	if err := rec.Verify(); err != nil {
+		return NameRecord{}, &NameError{Name: name, Err: err}
+	}
+	return rec, nil
+}
+
+// Publish stores a signed record in the registry and drops its name from the cache.
+func (c *RegistryClient) Publish(ctx context.Context, rec NameRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	name := normalizeName(rec.Name)
+	req, err := http.NewRequest(http.MethodPut, sourceURL(c.addr, RegistryPath+name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck
+
+	c.cache.forget(name)
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:errcheck
+		if strings.TrimSpace(string(msg)) == ErrStaleRecord.Error() {
+			return ErrStaleRecord
+		}
+		return ErrNameTaken
+	default:
+		return registryError(resp)
+	}
+}
+
+func registryError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:errcheck
+	return fmt.Errorf("registry: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
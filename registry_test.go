@@ -0,0 +1,156 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestNameRecord(t *testing.T) {
+	_, sk := cipher.GenerateKeyPair()
+	rec := dmsghttp.NameRecord{
+		Name:     "billing.internal",
+		Ports:    []uint16{80, 443},
+		Metadata: map[string]string{"env": "prod"},
+		Expires:  time.Now().Add(time.Hour),
+	}
+	require.NoError(t, rec.Sign(sk))
+	require.NoError(t, rec.Verify())
+	require.Equal(t, uint16(80), rec.Addr().Port)
+
+	tampered := rec
+	tampered.Ports = []uint16{8080}
+	require.True(t, errors.Is(tampered.Verify(), dmsghttp.ErrInvalidSignature))
+
+	expired := rec
+	expired.Expires = time.Now().Add(-time.Minute)
+	require.NoError(t, expired.Sign(sk))
+	require.Equal(t, dmsghttp.ErrRecordExpired, expired.Verify())
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_registry")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	storePath := filepath.Join(dir, "names.json")
+	store, err := dmsghttp.NewFileNameStore(storePath)
+	require.NoError(t, err)
+
+	dmsgD := disc.NewMock()
+	dmsgS, dmsgSErr := createDmsgSrv(t, dmsgD)
+	defer func() {
+		require.NoError(t, dmsgS.Close())
+		for err := range dmsgSErr {
+			require.NoError(t, err)
+		}
+	}()
+
+	registryC := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, registryC.Close()) }()
+
+	list, err := registryC.Listen(testPort)
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: dmsghttp.NewRegistry(store)}
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- srv.Serve(list)
+		close(sErr)
+	}()
+	defer func() {
+		require.NoError(t, srv.Close())
+		require.Equal(t, http.ErrServerClosed, <-sErr)
+	}()
+
+	dmsgC := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgC.Close()) }()
+
+	c := &http.Client{Transport: dmsghttp.Transport{DmsgClient: dmsgC}, Timeout: clientTimeout}
+	registryAddr := dmsg.Addr{PK: registryC.LocalPK(), Port: testPort}
+	client := dmsghttp.NewRegistryClient(c, registryAddr, time.Minute)
+	ctx := context.Background()
+
+	ownerPK, ownerSK := cipher.GenerateKeyPair()
+	rec := dmsghttp.NameRecord{
+		Name:    "billing.internal",
+		Ports:   []uint16{80},
+		Expires: time.Now().Add(time.Hour),
+	}
+	require.NoError(t, rec.Sign(ownerSK))
+
+	_, err = client.Resolve(ctx, "billing.internal")
+	require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+
+	require.NoError(t, client.Publish(ctx, rec))
+
+	addr, err := client.Resolve(ctx, "Billing.Internal.")
+	require.NoError(t, err)
+	require.Equal(t, dmsg.Addr{PK: ownerPK, Port: 80}, addr)
+
+	t.Run("owner updates the record", func(t *testing.T) {
+		update := rec
+		update.Ports = []uint16{8080}
+		update.Sequence = 1
+		require.NoError(t, update.Sign(ownerSK))
+		require.NoError(t, client.Publish(ctx, update))
+
+		addr, err := client.Resolve(ctx, "billing.internal")
+		require.NoError(t, err)
+		require.Equal(t, uint16(8080), addr.Port)
+	})
+
+	t.Run("older records are refused", func(t *testing.T) {
+		// the original record is correctly signed, but replaying it would roll the update back
+		require.Equal(t, dmsghttp.ErrStaleRecord, client.Publish(ctx, rec))
+
+		same := rec
+		same.Sequence = 1
+		same.Ports = []uint16{9090}
+		require.NoError(t, same.Sign(ownerSK))
+		require.Equal(t, dmsghttp.ErrStaleRecord, client.Publish(ctx, same))
+
+		addr, err := client.Resolve(ctx, "billing.internal")
+		require.NoError(t, err)
+		require.Equal(t, uint16(8080), addr.Port)
+	})
+
+	t.Run("name is taken", func(t *testing.T) {
+		_, otherSK := cipher.GenerateKeyPair()
+		hijack := rec
+		require.NoError(t, hijack.Sign(otherSK))
+		require.Equal(t, dmsghttp.ErrNameTaken, client.Publish(ctx, hijack))
+	})
+
+	t.Run("invalid signature is refused", func(t *testing.T) {
+		forged := rec
+		forged.Name = "shop.internal"
+		require.Error(t, client.Publish(ctx, forged))
+
+		// records which bypassed the registry are rejected by the client
+		require.NoError(t, store.Put(forged))
+		_, err := client.Lookup(ctx, "shop.internal")
+		require.True(t, errors.Is(err, dmsghttp.ErrInvalidSignature))
+	})
+
+	t.Run("records are persisted", func(t *testing.T) {
+		reopened, err := dmsghttp.NewFileNameStore(storePath)
+		require.NoError(t, err)
+		stored, err := reopened.Get("billing.internal")
+		require.NoError(t, err)
+		require.NoError(t, stored.Verify())
+		require.Equal(t, []uint16{8080}, stored.Ports)
+	})
+}
@@ -0,0 +1,353 @@
+package dmsghttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+)
+
+// ErrUnknownName is returned by resolvers for names they have no address for.
+var ErrUnknownName = errors.New("unknown dmsg host name")
+
+// maxCachedNames is the number of cached names above which expired entries are pruned.
+const maxCachedNames = 1024
+
+// Resolver resolves human readable host names to dmsg addresses.
+// The port of the returned address may be 0 if the name does not define one.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (dmsg.Addr, error)
+}
+
+// NameError reports a name which could not be resolved.
+type NameError struct {
+	Name string
+	Err  error
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("cannot resolve %q: %v", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *NameError) Unwrap() error { return e.Err }
+
+func unknownName(name string) error {
+	return &NameError{Name: name, Err: ErrUnknownName}
+}
+
+// normalizeName lower-cases a host name and strips the trailing dot of fully qualified names.
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// StaticResolver resolves names from a fixed in-memory map. Names are matched case-insensitively and without a
+// trailing dot. Maps with normalized keys, as created by NewStaticResolver, are resolved with a single lookup.
+type StaticResolver map[string]dmsg.Addr
+
+// NewStaticResolver creates a StaticResolver of the given names, normalizing them once.
+func NewStaticResolver(names map[string]dmsg.Addr) StaticResolver {
+	r := make(StaticResolver, len(names))
+	for name, addr := range names {
+		r[normalizeName(name)] = addr
+	}
+	return r
+}
+
+// Resolve implements Resolver.
+func (r StaticResolver) Resolve(_ context.Context, name string) (dmsg.Addr, error) {
+	name = normalizeName(name)
+	if addr, ok := r[name]; ok {
+		return addr, nil
+	}
+	// Keys which are not normalized are matched by scanning.
+	for key, addr := range r {
+		if normalizeName(key) == name {
+			return addr, nil
+		}
+	}
+	return dmsg.Addr{}, unknownName(name)
+}
+
+// ChainResolver queries resolvers in order and returns the first address found.
+type ChainResolver []Resolver
+
+// Resolve implements Resolver.
+func (c ChainResolver) Resolve(ctx context.Context, name string) (dmsg.Addr, error) {
+	for _, r := range c {
+		addr, err := r.Resolve(ctx, name)
+		if err == nil {
+			return addr, nil
+		}
+		if !errors.Is(err, ErrUnknownName) {
+			return dmsg.Addr{}, err
+		}
+	}
+	return dmsg.Addr{}, unknownName(normalizeName(name))
+}
+
+// FileResolver resolves names from a file.
+type FileResolver struct {
+	path  string
+	parse func([]byte) (map[string]dmsg.Addr, error)
+
+	mx      sync.RWMutex
+	names   map[string]dmsg.Addr
+	modTime time.Time
+	size    int64
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewHostsFileResolver creates a resolver from a hosts-style file.
+// Every line holds an address followed by one or more names, e.g.
+//
+//	# billing service
+//	02a49bc0aa1b5b78f638e9189be4ed095bac5d6839c828465a8350f80ac07629c0:80 billing.internal billing
+//
+// The port may be omitted, in which case it has to be given in the URL.
+func NewHostsFileResolver(path string) (*FileResolver, error) {
+	return newFileResolver(path, parseHostsFile, 0)
+}
+
+// NewJSONFileResolver creates a resolver from a JSON file holding an object of names to addresses, e.g.
+//
+//	{"billing.internal": "02a49bc0aa1b5b78f638e9189be4ed095bac5d6839c828465a8350f80ac07629c0:80"}
+//
+// If reloadInterval is non-zero, the file is checked for changes in that interval and reloaded.
+func NewJSONFileResolver(path string, reloadInterval time.Duration) (*FileResolver, error) {
+	return newFileResolver(path, parseJSONNames, reloadInterval)
+}
+
+func newFileResolver(path string, parse func([]byte) (map[string]dmsg.Addr, error),
+	reloadInterval time.Duration) (*FileResolver, error) {
+
+	r := &FileResolver{
+		path:  path,
+		parse: parse,
+		done:  make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		go r.watch(reloadInterval)
+	}
+	return r, nil
+}
+
+// Resolve implements Resolver.
+func (r *FileResolver) Resolve(_ context.Context, name string) (dmsg.Addr, error) {
+	name = normalizeName(name)
+
+	r.mx.RLock()
+	addr, ok := r.names[name]
+	r.mx.RUnlock()
+	if !ok {
+		return dmsg.Addr{}, unknownName(name)
+	}
+	return addr, nil
+}
+
+// Reload reads the file again.
+// The previously loaded names are kept if the file cannot be read or parsed.
+func (r *FileResolver) Reload() error {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	names, err := r.parse(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", r.path, err)
+	}
+
+	r.mx.Lock()
+	r.names = names
+	r.modTime = fi.ModTime()
+	r.size = fi.Size()
+	r.mx.Unlock()
+	return nil
+}
+
+// Close stops watching the file for changes.
+func (r *FileResolver) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return nil
+}
+
+func (r *FileResolver) watch(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+			fi, err := os.Stat(r.path)
+			if err != nil {
+				continue
+			}
+			r.mx.RLock()
+			changed := !fi.ModTime().Equal(r.modTime) || fi.Size() != r.size
+			r.mx.RUnlock()
+			if changed {
+				_ = r.Reload() //nolint:errcheck
+			}
+		}
+	}
+}
+
+func parseHostsFile(b []byte) (map[string]dmsg.Addr, error) {
+	names := make(map[string]dmsg.Addr)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: no names for address %q", line, fields[0])
+		}
+		addr, err := parseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		for _, name := range fields[1:] {
+			names[normalizeName(name)] = addr
+		}
+	}
+	return names, sc.Err()
+}
+
+func parseJSONNames(b []byte) (map[string]dmsg.Addr, error) {
+	var raw map[string]string
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	names := make(map[string]dmsg.Addr, len(raw))
+	for name, s := range raw {
+		addr, err := parseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("name %q: %v", name, err)
+		}
+		names[normalizeName(name)] = addr
+	}
+	return names, nil
+}
+
+// parseAddr parses a dmsg address of the form "<pk>[:<port>]".
+func parseAddr(s string) (dmsg.Addr, error) {
+	var addr dmsg.Addr
+	if err := addr.Set(s); err != nil {
+		return dmsg.Addr{}, fmt.Errorf("invalid dmsg address %q: %v", s, err)
+	}
+	if addr.PK.Null() {
+		return dmsg.Addr{}, fmt.Errorf("invalid dmsg address %q: no public key", s)
+	}
+	return addr, nil
+}
+
+// CachingResolver caches the results of another resolver.
+type CachingResolver struct {
+	r      Resolver
+	ttl    time.Duration
+	negTTL time.Duration
+	cache  nameCache
+}
+
+type cachedName struct {
+	addr    dmsg.Addr
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver caches addresses resolved by r for ttl and unknown names for negTTL.
+// Unknown names are not cached if negTTL is zero. Other errors are never cached.
+func NewCachingResolver(r Resolver, ttl, negTTL time.Duration) *CachingResolver {
+	return &CachingResolver{
+		r:      r,
+		ttl:    ttl,
+		negTTL: negTTL,
+	}
+}
+
+// Resolve implements Resolver.
+func (c *CachingResolver) Resolve(ctx context.Context, name string) (dmsg.Addr, error) {
+	name = normalizeName(name)
+	now := time.Now()
+
+	if e, ok := c.cache.get(name, now); ok {
+		return e.addr, e.err
+	}
+
+	addr, err := c.r.Resolve(ctx, name)
+	switch {
+	case err == nil && c.ttl > 0:
+		c.cache.set(name, cachedName{addr: addr, expires: now.Add(c.ttl)})
+	case errors.Is(err, ErrUnknownName) && c.negTTL > 0:
+		c.cache.set(name, cachedName{err: err, expires: now.Add(c.negTTL)})
+	}
+	return addr, err
+}
+
+// Forget drops the cached result for a name.
+func (c *CachingResolver) Forget(name string) {
+	c.cache.forget(normalizeName(name))
+}
+
+// nameCache holds resolved names until they expire.
+type nameCache struct {
+	mx      sync.Mutex
+	entries map[string]cachedName
+}
+
+// get returns the entry of a name if it has not expired by now.
+func (c *nameCache) get(name string, now time.Time) (cachedName, bool) {
+	c.mx.Lock()
+	e, ok := c.entries[name]
+	c.mx.Unlock()
+	return e, ok && now.Before(e.expires)
+}
+
+func (c *nameCache) set(name string, e cachedName) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]cachedName)
+	}
+	if len(c.entries) >= maxCachedNames {
+		now := time.Now()
+		for n, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, n)
+			}
+		}
+	}
+	c.entries[name] = e
+}
+
+func (c *nameCache) forget(name string) {
+	c.mx.Lock()
+	delete(c.entries, name)
+	c.mx.Unlock()
+}
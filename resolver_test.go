@@ -0,0 +1,219 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestResolvers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmsghttp_resolver")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	pk1, _ := cipher.GenerateKeyPair()
+	pk2, _ := cipher.GenerateKeyPair()
+	ctx := context.Background()
+
+	t.Run("static", func(t *testing.T) {
+		r := dmsghttp.NewStaticResolver(map[string]dmsg.Addr{"Billing.Internal": {PK: pk1, Port: 80}})
+
+		addr, err := r.Resolve(ctx, "billing.internal.")
+		require.NoError(t, err)
+		require.Equal(t, dmsg.Addr{PK: pk1, Port: 80}, addr)
+
+		_, err = r.Resolve(ctx, "unknown.internal")
+		require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+		require.Contains(t, err.Error(), "unknown.internal")
+	})
+
+	t.Run("static map literal", func(t *testing.T) {
+		r := dmsghttp.StaticResolver{"Billing.Internal.": {PK: pk1, Port: 80}, "shop": {PK: pk2}}
+
+		addr, err := r.Resolve(ctx, "billing.internal")
+		require.NoError(t, err)
+		require.Equal(t, dmsg.Addr{PK: pk1, Port: 80}, addr)
+
+		addr, err = r.Resolve(ctx, "SHOP")
+		require.NoError(t, err)
+		require.Equal(t, dmsg.Addr{PK: pk2}, addr)
+
+		_, err = r.Resolve(ctx, "unknown.internal")
+		require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+	})
+
+	t.Run("hosts file", func(t *testing.T) {
+		name := filepath.Join(dir, "hosts")
+		hosts := fmt.Sprintf("# comment\n%s:80 billing.internal billing\n\n%s shop # no port\n", pk1, pk2)
+		require.NoError(t, ioutil.WriteFile(name, []byte(hosts), 0600))
+
+		r, err := dmsghttp.NewHostsFileResolver(name)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Close()) }()
+
+		for name, want := range map[string]dmsg.Addr{
+			"billing.internal": {PK: pk1, Port: 80},
+			"billing":          {PK: pk1, Port: 80},
+			"shop":             {PK: pk2},
+		} {
+			addr, err := r.Resolve(ctx, name)
+			require.NoError(t, err)
+			require.Equal(t, want, addr)
+		}
+
+		require.NoError(t, ioutil.WriteFile(name, []byte("not-a-pk name\n"), 0600))
+		require.Error(t, r.Reload())
+
+		// the previous names are kept
+		_, err = r.Resolve(ctx, "billing")
+		require.NoError(t, err)
+	})
+
+	t.Run("json file with hot reload", func(t *testing.T) {
+		name := filepath.Join(dir, "names.json")
+		require.NoError(t, ioutil.WriteFile(name, []byte(fmt.Sprintf(`{"billing.internal": "%s:80"}`, pk1)), 0600))
+
+		r, err := dmsghttp.NewJSONFileResolver(name, 10*time.Millisecond)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Close()) }()
+
+		addr, err := r.Resolve(ctx, "billing.internal")
+		require.NoError(t, err)
+		require.Equal(t, dmsg.Addr{PK: pk1, Port: 80}, addr)
+
+		require.NoError(t, ioutil.WriteFile(name, []byte(fmt.Sprintf(`{"billing.internal": "%s:8080"}`, pk2)), 0600))
+		require.Eventually(t, func() bool {
+			addr, err := r.Resolve(ctx, "billing.internal")
+			return err == nil && addr == dmsg.Addr{PK: pk2, Port: 8080}
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("caching", func(t *testing.T) {
+		var (
+			mx    sync.Mutex
+			calls int
+		)
+		static := dmsghttp.StaticResolver{"billing": {PK: pk1, Port: 80}}
+		counting := resolverFunc(func(ctx context.Context, name string) (dmsg.Addr, error) {
+			mx.Lock()
+			calls++
+			mx.Unlock()
+			return static.Resolve(ctx, name)
+		})
+
+		r := dmsghttp.NewCachingResolver(counting, time.Minute, time.Minute)
+		for i := 0; i < 3; i++ {
+			_, err := r.Resolve(ctx, "billing")
+			require.NoError(t, err)
+			_, err = r.Resolve(ctx, "unknown")
+			require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+		}
+		require.Equal(t, 2, calls)
+
+		r.Forget("billing")
+		_, err := r.Resolve(ctx, "billing")
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		r := dmsghttp.ChainResolver{
+			dmsghttp.StaticResolver{"a": {PK: pk1, Port: 1}},
+			dmsghttp.StaticResolver{"a": {PK: pk2, Port: 2}, "b": {PK: pk2, Port: 2}},
+		}
+		addr, err := r.Resolve(ctx, "a")
+		require.NoError(t, err)
+		require.Equal(t, pk1, addr.PK)
+		addr, err = r.Resolve(ctx, "b")
+		require.NoError(t, err)
+		require.Equal(t, pk2, addr.PK)
+		_, err = r.Resolve(ctx, "c")
+		require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+	})
+}
+
+// resolverFunc adapts a function to a dmsghttp.Resolver.
+type resolverFunc func(context.Context, string) (dmsg.Addr, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, name string) (dmsg.Addr, error) {
+	return f(ctx, name)
+}
+
+func TestTransportResolver(t *testing.T) {
+	dmsgD := disc.NewMock()
+	dmsgS, dmsgSErr := createDmsgSrv(t, dmsgD)
+	defer func() {
+		require.NoError(t, dmsgS.Close())
+		for err := range dmsgSErr {
+			require.NoError(t, err)
+		}
+	}()
+
+	dmsgServerClient := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgServerClient.Close()) }()
+
+	list, err := dmsgServerClient.Listen(testPort)
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("Hello World!")) //nolint:errcheck
+		}),
+	}
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- srv.Serve(list)
+		close(sErr)
+	}()
+	defer func() {
+		require.NoError(t, srv.Close())
+		require.Equal(t, http.ErrServerClosed, <-sErr)
+	}()
+
+	dmsgClient := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgClient.Close()) }()
+
+	tr := dmsghttp.Transport{
+		DmsgClient: dmsgClient,
+		Resolver: dmsghttp.StaticResolver{
+			"hello.internal":  {PK: dmsgServerClient.LocalPK(), Port: testPort},
+			"noport.internal": {PK: dmsgServerClient.LocalPK()},
+		},
+	}
+	c := &http.Client{Transport: tr, Timeout: clientTimeout}
+
+	require.Equal(t, "Hello World!", getBody(t, c, "dmsg://hello.internal/"))
+	require.Equal(t, "Hello World!", getBody(t, c, fmt.Sprintf("dmsg://noport.internal:%d/", testPort)))
+
+	_, err = c.Get("dmsg://noport.internal/")
+	require.Error(t, err)
+
+	_, err = c.Get("dmsg://unknown.internal/")
+	require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+
+	// request bodies are closed
+	body := newCloseTracker()
+	req, err := http.NewRequest(http.MethodPost, "dmsg://unknown.internal/", body)
+	require.NoError(t, err)
+	_, err = tr.RoundTrip(req)
+	require.True(t, errors.Is(err, dmsghttp.ErrUnknownName))
+	select {
+	case <-body.closed:
+	default:
+		t.Fatal("request body not closed")
+	}
+}
@@ -0,0 +1,86 @@
+package dmsghttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// RemoteAddr obtains the dmsg address of the client that issued a request served over a dmsg listener.
+func RemoteAddr(r *http.Request) (dmsg.Addr, error) {
+	var addr dmsg.Addr
+	if err := addr.Set(r.RemoteAddr); err != nil {
+		return dmsg.Addr{}, fmt.Errorf("invalid dmsg remote address %q: %v", r.RemoteAddr, err)
+	}
+	if addr.PK.Null() {
+		return dmsg.Addr{}, fmt.Errorf("invalid dmsg remote address %q: no public key", r.RemoteAddr)
+	}
+	return addr, nil
+}
+
+// BodyLimitConfig configures LimitBodySize.
+type BodyLimitConfig struct {
+	// Default is the maximum request body size of clients without an entry in PerPK, and of requests which were not
+	// served over dmsg. Zero means no limit.
+	Default int64
+
+	// PerPK holds the maximum request body sizes of individual clients. Zero means no limit.
+	PerPK map[cipher.PubKey]int64
+}
+
+// LimitBodySize limits the size of request bodies by the public key of the client.
+// Requests which announce a larger Content-Length are rejected with 413 Request Entity Too Large before their body is
+// read, which also keeps clients using "Expect: 100-continue" from sending it. Bodies of unknown length are cut off
+// at the limit, with the handler getting an error from reading the body.
+func LimitBodySize(h http.Handler, conf BodyLimitConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := conf.Default
+		if addr, err := RemoteAddr(r); err == nil {
+			if l, ok := conf.PerPK[addr.PK]; ok {
+				limit = l
+			}
+		}
+		if limit <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveHandler serves h on the given port of the dmsg client until the context is canceled or serving fails.
+func serveHandler(ctx context.Context, dmsgC *dmsg.Client, port uint16, h http.Handler) error {
+	lis, err := dmsgC.Listen(port)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: h}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(lis)
+		close(errCh)
+	}()
+
+	select {
+	case <-ctx.Done():
+		if err := srv.Close(); err != nil {
+			return err
+		}
+		<-errCh
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
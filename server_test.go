@@ -0,0 +1,83 @@
+package dmsghttp_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestLimitBodySize(t *testing.T) {
+	lb := dmsghttp.NewLoopback()
+	srvPK, _ := cipher.GenerateKeyPair()
+	limitedPK, _ := cipher.GenerateKeyPair()
+	otherPK, _ := cipher.GenerateKeyPair()
+
+	lis, err := lb.Listen(srvPK, testPort)
+	require.NoError(t, err)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		_, _ = w.Write(b) //nolint:errcheck
+	})
+	srv := &http.Server{Handler: dmsghttp.LimitBodySize(h, dmsghttp.BodyLimitConfig{
+		Default: 100,
+		PerPK:   map[cipher.PubKey]int64{limitedPK: 10},
+	})}
+	go func() { _ = srv.Serve(lis) }() //nolint:errcheck
+	defer func() { require.NoError(t, srv.Close()) }()
+
+	url := "dmsg://" + dmsg.Addr{PK: srvPK, Port: testPort}.String() + "/"
+	post := func(pk cipher.PubKey, body string, expect bool, knownLength bool) (*http.Response, string) {
+		tr := lb.Transport(pk)
+		tr.ExpectContinueTimeout = clientTimeout
+		c := &http.Client{Transport: tr, Timeout: clientTimeout}
+
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		require.NoError(t, err)
+		if !knownLength {
+			req.ContentLength = -1
+		}
+		if expect {
+			req.Header.Set("Expect", "100-continue")
+		}
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp, string(b)
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		resp, body := post(limitedPK, "0123456789", true, true)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "0123456789", body)
+
+		resp, body = post(otherPK, strings.Repeat("x", 100), false, false)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, body, 100)
+	})
+
+	t.Run("rejected before the body is sent", func(t *testing.T) {
+		start := time.Now()
+		resp, _ := post(limitedPK, strings.Repeat("x", 11), true, true)
+		require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		require.True(t, time.Since(start) < clientTimeout/2)
+	})
+
+	t.Run("unknown length cut off", func(t *testing.T) {
+		resp, _ := post(otherPK, strings.Repeat("x", 101), false, false)
+		require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+}
@@ -0,0 +1,250 @@
+package dmsghttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+// Snapshot errors.
+var (
+	ErrInvalidSnapshot   = errors.New("invalid discovery snapshot")
+	ErrUntrustedSnapshot = errors.New("discovery snapshot is not signed by a trusted key")
+)
+
+// Snapshot is a signed set of discovery entries, used to look up dmsg servers and clients without a discovery service.
+// Besides the signature of the snapshot itself, every entry carries the signature of its owner.
+type Snapshot struct {
+	Created time.Time     `json:"created"`
+	Entries []*disc.Entry `json:"entries"`
+	PK      cipher.PubKey `json:"pk"`
+	Sig     cipher.Sig    `json:"sig"`
+}
+
+// ExportSnapshot creates a snapshot of the servers available in dc and of the entries of the given clients, signed
+// with sk.
+func ExportSnapshot(ctx context.Context, dc disc.APIClient, clients []cipher.PubKey, sk cipher.SecKey) (*Snapshot, error) {
+	servers, err := dc.AvailableServers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain servers: %w", err)
+	}
+
+	s := &Snapshot{Created: time.Now().UTC()}
+	s.Entries = append(s.Entries, servers...)
+	for _, pk := range clients {
+		entry, err := dc.Entry(ctx, pk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain entry of %s: %w", pk, err)
+		}
+		s.Entries = append(s.Entries, entry)
+	}
+	if err := s.Sign(sk); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sign sets PK and Sig of the snapshot using sk.
+func (s *Snapshot) Sign(sk cipher.SecKey) error {
+	pk, err := sk.PubKey()
+	if err != nil {
+		return err
+	}
+	s.PK = pk
+	payload, err := s.payload()
+	if err != nil {
+		return err
+	}
+	s.Sig, err = cipher.SignPayload(payload, sk)
+	return err
+}
+
+// Verify checks the signatures of the snapshot and its entries.
+// If trusted keys are given, the snapshot has to be signed by one of them.
+func (s *Snapshot) Verify(trusted ...cipher.PubKey) error {
+	if len(trusted) > 0 {
+		ok := false
+		for _, pk := range trusted {
+			ok = ok || pk == s.PK
+		}
+		if !ok {
+			return ErrUntrustedSnapshot
+		}
+	}
+
+	payload, err := s.payload()
+	if err != nil {
+		return err
+	}
+	if err := cipher.VerifyPubKeySignedPayload(s.PK, s.Sig, payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	for _, entry := range s.Entries {
+		if entry == nil {
+			return fmt.Errorf("%w: empty entry", ErrInvalidSnapshot)
+		}
+		if err := entry.VerifySignature(); err != nil {
+			return fmt.Errorf("%w: entry of %s: %v", ErrInvalidSnapshot, entry.Static, err)
+		}
+	}
+	return nil
+}
+
+// payload returns the signed representation of the snapshot.
+func (s *Snapshot) payload() ([]byte, error) {
+	c := *s
+	c.Created = c.Created.UTC()
+	c.Sig = cipher.Sig{}
+	return json.Marshal(c)
+}
+
+// WriteSnapshot writes a snapshot to a JSON file.
+func WriteSnapshot(path string, s *Snapshot) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// ReadSnapshot reads and verifies a snapshot written by WriteSnapshot.
+// If trusted keys are given, the snapshot has to be signed by one of them.
+func ReadSnapshot(path string, trusted ...cipher.PubKey) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if err := s.Verify(trusted...); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SnapshotDiscovery is a disc.APIClient which serves lookups from a Snapshot.
+//
+// If a live discovery is given, it is used as long as it is reachable and the snapshot is only consulted when it is
+// not. Entries posted while the live discovery is unreachable, or by clients without a live discovery, are kept in
+// memory so the local dmsg client can register itself, but they are not visible to other peers.
+type SnapshotDiscovery struct {
+	live    disc.APIClient
+	entries map[cipher.PubKey]*disc.Entry
+	servers []*disc.Entry
+
+	mx    sync.RWMutex
+	local map[cipher.PubKey]*disc.Entry
+}
+
+// NewSnapshotDiscovery creates a discovery which falls back to s when live is unreachable.
+// live may be nil to only use the snapshot.
+func NewSnapshotDiscovery(s *Snapshot, live disc.APIClient) *SnapshotDiscovery {
+	d := &SnapshotDiscovery{
+		live:    live,
+		entries: make(map[cipher.PubKey]*disc.Entry, len(s.Entries)),
+		local:   make(map[cipher.PubKey]*disc.Entry),
+	}
+	for _, entry := range s.Entries {
+		d.entries[entry.Static] = entry
+		if entry.Server != nil {
+			d.servers = append(d.servers, entry)
+		}
+	}
+	return d
+}
+
+// Entry implements disc.APIClient.
+func (d *SnapshotDiscovery) Entry(ctx context.Context, pk cipher.PubKey) (*disc.Entry, error) {
+	if d.live != nil {
+		entry, err := d.live.Entry(ctx, pk)
+		if !isUnreachable(ctx, err) {
+			return entry, err
+		}
+	}
+
+	d.mx.RLock()
+	entry, ok := d.local[pk]
+	d.mx.RUnlock()
+	if !ok {
+		entry, ok = d.entries[pk]
+	}
+	if !ok {
+		return nil, disc.ErrKeyNotFound
+	}
+	return copyEntry(entry), nil
+}
+
+// PostEntry implements disc.APIClient.
+func (d *SnapshotDiscovery) PostEntry(ctx context.Context, entry *disc.Entry) error {
+	if d.live != nil {
+		if err := d.live.PostEntry(ctx, entry); !isUnreachable(ctx, err) {
+			return err
+		}
+	}
+	if err := entry.VerifySignature(); err != nil {
+		return disc.ErrUnauthorized
+	}
+	d.setLocal(entry)
+	return nil
+}
+
+// PutEntry implements disc.APIClient.
+func (d *SnapshotDiscovery) PutEntry(ctx context.Context, sk cipher.SecKey, entry *disc.Entry) error {
+	if d.live != nil {
+		if err := d.live.PutEntry(ctx, sk, entry); !isUnreachable(ctx, err) {
+			return err
+		}
+	}
+	entry.Sequence++
+	entry.Timestamp = time.Now().UnixNano()
+	if err := entry.Sign(sk); err != nil {
+		entry.Sequence--
+		return err
+	}
+	d.setLocal(entry)
+	return nil
+}
+
+// AvailableServers implements disc.APIClient.
+func (d *SnapshotDiscovery) AvailableServers(ctx context.Context) ([]*disc.Entry, error) {
+	if d.live != nil {
+		servers, err := d.live.AvailableServers(ctx)
+		if !isUnreachable(ctx, err) {
+			return servers, err
+		}
+	}
+	return copyEntries(d.servers), nil
+}
+
+func (d *SnapshotDiscovery) setLocal(entry *disc.Entry) {
+	d.mx.Lock()
+	d.local[entry.Static] = copyEntry(entry)
+	d.mx.Unlock()
+}
+
+// isUnreachable reports whether err means that a discovery could not serve the request, because it could not be
+// reached or failed with a server error, rather than it rejecting the request. Errors of a caller which gave up are
+// neither, so they are returned instead of falling back to the snapshot.
+func isUnreachable(ctx context.Context, err error) bool {
+	switch {
+	case err == nil || ctx.Err() != nil:
+		return false
+	case errors.Is(err, disc.ErrUnexpected):
+		// the discovery answered with a server error
+		return true
+	case isKeyNotFound(err) || errors.Is(err, disc.ErrUnauthorized) || errors.Is(err, disc.ErrBadInput):
+		return false
+	}
+	var vErr disc.EntryValidationError
+	// otherwise the discovery could not be reached, or the response did not come from it, e.g. a gateway's error page
+	return !errors.As(err, &vErr)
+}
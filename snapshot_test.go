@@ -0,0 +1,180 @@
+package dmsghttp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SkycoinProject/dmsg"
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+	"github.com/stretchr/testify/require"
+
+	dmsghttp "github.com/SkycoinProject/dmsg-http"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dmsghttp_snapshot")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	dmsgD := disc.NewMock()
+	srvPK, srvSK := cipher.GenerateKeyPair()
+	srvEntry := disc.NewServerEntry(srvPK, 0, "127.0.0.1:8081", 10)
+	require.NoError(t, srvEntry.Sign(srvSK))
+	require.NoError(t, dmsgD.PostEntry(ctx, srvEntry))
+
+	clientPK, clientSK := cipher.GenerateKeyPair()
+	clientEntry := disc.NewClientEntry(clientPK, 0, []cipher.PubKey{srvPK})
+	require.NoError(t, clientEntry.Sign(clientSK))
+	require.NoError(t, dmsgD.PostEntry(ctx, clientEntry))
+
+	signerPK, signerSK := cipher.GenerateKeyPair()
+	snap, err := dmsghttp.ExportSnapshot(ctx, dmsgD, []cipher.PubKey{clientPK}, signerSK)
+	require.NoError(t, err)
+	require.Equal(t, signerPK, snap.PK)
+
+	t.Run("round trip", func(t *testing.T) {
+		name := filepath.Join(dir, "snapshot.json")
+		require.NoError(t, dmsghttp.WriteSnapshot(name, snap))
+
+		read, err := dmsghttp.ReadSnapshot(name, signerPK)
+		require.NoError(t, err)
+		require.Len(t, read.Entries, len(snap.Entries))
+
+		otherPK, _ := cipher.GenerateKeyPair()
+		_, err = dmsghttp.ReadSnapshot(name, otherPK)
+		require.Equal(t, dmsghttp.ErrUntrustedSnapshot, err)
+	})
+
+	t.Run("tampered snapshot", func(t *testing.T) {
+		tampered := *snap
+		tampered.Entries = tampered.Entries[:1]
+		require.True(t, errors.Is(tampered.Verify(), dmsghttp.ErrInvalidSnapshot))
+	})
+
+	t.Run("snapshot only", func(t *testing.T) {
+		d := dmsghttp.NewSnapshotDiscovery(snap, nil)
+
+		entry, err := d.Entry(ctx, clientPK)
+		require.NoError(t, err)
+		require.Equal(t, []cipher.PubKey{srvPK}, entry.Client.DelegatedServers)
+
+		servers, err := d.AvailableServers(ctx)
+		require.NoError(t, err)
+		require.Len(t, servers, 1)
+		require.Equal(t, srvPK, servers[0].Static)
+
+		// a local client can register itself
+		pk, sk := cipher.GenerateKeyPair()
+		_, err = d.Entry(ctx, pk)
+		require.Equal(t, disc.ErrKeyNotFound, err)
+
+		own := disc.NewClientEntry(pk, 0, nil)
+		require.NoError(t, own.Sign(sk))
+		require.NoError(t, d.PostEntry(ctx, own))
+
+		own.Client.DelegatedServers = []cipher.PubKey{srvPK}
+		require.NoError(t, d.PutEntry(ctx, sk, own))
+		entry, err = d.Entry(ctx, pk)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), entry.Sequence)
+		require.NoError(t, entry.VerifySignature())
+	})
+
+	t.Run("layered over live discovery", func(t *testing.T) {
+		d := dmsghttp.NewSnapshotDiscovery(snap, brokenDisc{err: errors.New("connection refused")})
+		entry, err := d.Entry(ctx, clientPK)
+		require.NoError(t, err)
+		require.Equal(t, clientPK, entry.Static)
+
+		// a reachable live discovery takes precedence
+		d = dmsghttp.NewSnapshotDiscovery(snap, disc.NewMock())
+		_, err = d.Entry(ctx, clientPK)
+		require.Error(t, err)
+
+		// callers giving up do not fall back to the snapshot
+		d = dmsghttp.NewSnapshotDiscovery(snap, brokenDisc{})
+		cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = d.Entry(cancelCtx, clientPK)
+		require.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("server errors and rejections", func(t *testing.T) {
+		var status int32
+		live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			msg := disc.HTTPMessage{Message: "internal error", Code: http.StatusInternalServerError}
+			if atomic.LoadInt32(&status) == http.StatusUnauthorized {
+				msg = disc.HTTPMessage{Message: disc.ErrUnauthorized.Error(), Code: http.StatusUnauthorized}
+			}
+			w.WriteHeader(msg.Code)
+			require.NoError(t, json.NewEncoder(w).Encode(msg))
+		}))
+		defer live.Close()
+		d := dmsghttp.NewSnapshotDiscovery(snap, disc.NewHTTP(live.URL))
+
+		entry, err := d.Entry(ctx, clientPK)
+		require.NoError(t, err)
+		require.Equal(t, clientPK, entry.Static)
+
+		atomic.StoreInt32(&status, http.StatusUnauthorized)
+		_, err = d.Entry(ctx, clientPK)
+		require.Equal(t, disc.ErrUnauthorized, err)
+	})
+}
+
+func TestSnapshotDiscoveryOverDmsg(t *testing.T) {
+	dmsgD := disc.NewMock()
+	dmsgS, dmsgSErr := createDmsgSrv(t, dmsgD)
+	defer func() {
+		require.NoError(t, dmsgS.Close())
+		for err := range dmsgSErr {
+			require.NoError(t, err)
+		}
+	}()
+
+	dmsgServerClient := createDmsgClient(t, dmsgD)
+	defer func() { require.NoError(t, dmsgServerClient.Close()) }()
+
+	list, err := dmsgServerClient.Listen(testPort)
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("Hello World!")) //nolint:errcheck
+		}),
+	}
+	sErr := make(chan error, 1)
+	go func() {
+		sErr <- srv.Serve(list)
+		close(sErr)
+	}()
+	defer func() {
+		require.NoError(t, srv.Close())
+		require.Equal(t, http.ErrServerClosed, <-sErr)
+	}()
+
+	_, signerSK := cipher.GenerateKeyPair()
+	snap, err := dmsghttp.ExportSnapshot(context.Background(), dmsgD,
+		[]cipher.PubKey{dmsgServerClient.LocalPK()}, signerSK)
+	require.NoError(t, err)
+
+	// the discovery is down from here on
+	d := dmsghttp.NewSnapshotDiscovery(snap, brokenDisc{err: errors.New("connection refused")})
+	dmsgClient := createDmsgClient(t, d)
+	defer func() { require.NoError(t, dmsgClient.Close()) }()
+
+	c := &http.Client{Transport: dmsghttp.Transport{DmsgClient: dmsgClient}, Timeout: clientTimeout}
+	url := "dmsg://" + dmsg.Addr{PK: dmsgServerClient.LocalPK(), Port: testPort}.String() + "/"
+	require.Equal(t, "Hello World!", getBody(t, c, url))
+}
@@ -5,9 +5,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/SkycoinProject/dmsg"
 	"github.com/SkycoinProject/dmsg/cipher"
@@ -15,44 +19,392 @@ import (
 
 // Transport holds information about client who is initiating communication.
 type Transport struct {
+	// DmsgClient is the default identity, which dials requests not selecting another one.
 	DmsgClient *dmsg.Client
+
+	// Identities are further dmsg clients, keyed by their public keys, which requests select with WithIdentity or
+	// IdentityHeader.
+	Identities map[cipher.PubKey]*dmsg.Client
+
+	// Resolver resolves host names which are not public keys. Only public keys are accepted if nil.
+	Resolver Resolver
+
+	// Discovery is the discovery cache used by DmsgClient, if any.
+	// The cached entry of a server is dropped when dialing it fails, so the next request looks it up again.
+	Discovery *CachingDiscovery
+
+	// ExpectContinueTimeout is, like for http.Transport, the time to wait for a server's first response headers
+	// after writing the headers of a request with "Expect: 100-continue". The body is only sent once the server
+	// answers with 100 Continue or the timeout passes, and not at all if the server sends a final response first.
+	// Zero sends the body immediately.
+	ExpectContinueTimeout time.Duration
+
+	// Limiter limits the streams and requests to every peer, if not nil.
+	Limiter *PeerLimiter
+
+	// Proxy is the address of a gateway, such as cmd/dmsg-http-cache, which all requests are sent through if set.
+	// Host names are resolved before requests are passed to the gateway.
+	Proxy dmsg.Addr
+
+	// MinSessions is the number of sessions with dmsg servers Ready waits for. 1 if zero.
+	// The dmsg client only establishes as many sessions as the MinSessions of its dmsg.Config.
+	MinSessions int
+
+	// Pool holds idle streams opened by Prewarm, which requests take before dialing new streams, if not nil.
+	Pool *StreamPool
 }
 
 // RoundTrip implements golang's http package support for alternative transport protocols.
 // In this case dmsg is used instead of TCP to initiate the communication with the server.
 func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// process remote pub key and port from dmsg-addr request header
-	addrSplit := strings.Split(req.Host, ":")
-	if len(addrSplit) != 2 {
-		return nil, errors.New("invalid server Pub Key or Port")
+	serverAddress, err := t.resolveAddr(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
 	}
-	var pk cipher.PubKey
-	if err := pk.Set(addrSplit[0]); err != nil {
+	dmsgC, idReq, err := t.identity(req)
+	if err != nil {
+		closeBody(req)
 		return nil, err
 	}
+	t.DmsgClient, req = dmsgC, idReq
+	req, serverAddress, viaProxy := proxyRequest(req, serverAddress, t.Proxy)
+
+	dialNew := func(ctx context.Context) (net.Conn, error) {
+		stream, err := t.dialStream(ctx, serverAddress)
+		if err != nil {
+			if t.Discovery != nil && err != dmsg.ErrDiscEntryNotFound {
+				t.Discovery.Invalidate(serverAddress.PK)
+			}
+			return nil, err
+		}
+		return stream, nil
+	}
+	pooled := false
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if t.Pool != nil {
+			if stream, ok := t.Pool.get(t.DmsgClient.LocalPK(), serverAddress); ok {
+				pooled = true
+				return stream, nil
+			}
+		}
+		return dialNew(ctx)
+	}
+	resp, err := roundTripPeer(req, serverAddress, t.Limiter, t.ExpectContinueTimeout, viaProxy, dial)
+
+	// The remote may close a pooled stream between the probe and the request, in which case idempotent requests are
+	// sent again on a new stream.
+	if err == nil || !pooled || req.Context().Err() != nil || !idempotent(req) || !rewindable(req) {
+		return resp, err
+	}
+	if req.GetBody != nil {
+		body, bErr := req.GetBody()
+		if bErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return roundTripPeer(req, serverAddress, t.Limiter, t.ExpectContinueTimeout, viaProxy, dialNew)
+}
+
+// roundTripPeer sends req over a connection to addr obtained from dial, within the limits of l if not nil.
+// With viaProxy, addr is a gateway and req is written in proxy form.
+func roundTripPeer(req *http.Request, addr dmsg.Addr, l *PeerLimiter, continueTimeout time.Duration, viaProxy bool,
+	dial func(ctx context.Context) (net.Conn, error)) (*http.Response, error) {
+	ctx := req.Context()
+	release := func() {}
+	if l != nil {
+		releaseReq, releaseConn, err := l.acquire(ctx, addr.PK)
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		defer releaseReq()
+		release = releaseConn
+	}
 
-	rPort, err := strconv.Atoi(addrSplit[1])
+	conn, err := dial(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("invalid port: %v", err)
+		release()
+		closeBody(req)
+		return nil, dialError(addr, err)
 	}
-	port := uint16(rPort)
+	return roundTripConn(req, &limitedConn{Conn: conn, release: release}, continueTimeout, viaProxy)
+}
+
+// proxyRequest returns the request to send to proxy for a request to addr, and the address to dial.
+// Requests are returned unchanged if proxy is not set.
+func proxyRequest(req *http.Request, addr, proxy dmsg.Addr) (*http.Request, dmsg.Addr, bool) {
+	if proxy.PK.Null() {
+		return req, addr, false
+	}
+	pReq := req.Clone(req.Context())
+	pReq.URL.Scheme = "dmsg"
+	pReq.URL.Host = addr.String()
+	pReq.Host = pReq.URL.Host
+	return pReq, proxy, true
+}
 
-	serverAddress := dmsg.Addr{PK: pk, Port: port}
+// closeBody closes the body of a request which is not sent, as http.RoundTripper requires.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close() //nolint:errcheck
+	}
+}
 
-	var (
-		stream    *dmsg.Stream
-		streamErr error
-	)
+// roundTripConn writes req to conn, in proxy form with viaProxy, and reads the response. conn is closed once the
+// response body is closed, or once the context of req is done.
+func roundTripConn(req *http.Request, c net.Conn, continueTimeout time.Duration, viaProxy bool) (*http.Response,
+	error) {
+	conn := &onceCloseConn{Conn: c}
+	ctx := req.Context()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close() //nolint:errcheck
+		case <-done:
+		}
+	}()
 
-	stream, streamErr = t.DmsgClient.DialStream(context.Background(), serverAddress)
-	if streamErr != nil {
-		return nil, streamErr
+	wReq, body := req, (*requestBody)(nil)
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &requestBody{ReadCloser: req.Body}
+		if continueTimeout > 0 && expectsContinue(req) {
+			body.decided = make(chan struct{})
+			timer := time.AfterFunc(continueTimeout, func() { body.decide(true) })
+			defer timer.Stop()
+		}
+		wReq = new(http.Request)
+		*wReq = *req
+		wReq.Body = body
 	}
-	defer stream.Close() //nolint:errcheck
 
-	if err := req.Write(stream); err != nil {
+	fail := func(err error) (*http.Response, error) {
+		close(done)
+		_ = conn.Close() //nolint:errcheck
+		if body != nil {
+			body.decide(false)
+			if bErr := body.err(); bErr != nil {
+				err = bErr
+			}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		return nil, err
 	}
 
-	return http.ReadResponse(bufio.NewReader(stream), req)
+	// Like net/http, the request is written while reading the response, as servers may respond before reading the
+	// whole body.
+	go func() {
+		write := wReq.Write
+		if viaProxy {
+			write = wReq.WriteProxy
+		}
+		if err := write(conn); err != nil && body != nil && body.err() != nil {
+			// The server would wait for the rest of the body.
+			_ = conn.Close() //nolint:errcheck
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+	for {
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return fail(err)
+		}
+		// Interim responses such as 100 Continue are skipped, like net/http does.
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if resp.StatusCode == http.StatusContinue && body != nil {
+				body.decide(true)
+			}
+			continue
+		}
+		if body != nil {
+			body.decide(false)
+		}
+
+		// The connection has to stay open until the caller is done with the body.
+		resp.Body = &streamBody{ReadCloser: resp.Body, stream: conn, ctx: ctx, done: done}
+		return resp, nil
+	}
+}
+
+// expectsContinue reports whether req has a body to be sent only after a 100 Continue response.
+func expectsContinue(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+	for _, v := range strings.Split(req.Header.Get("Expect"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "100-continue") {
+			return true
+		}
+	}
+	return false
+}
+
+// errBodyNotSent is returned by requestBody when the server does not want the body.
+var errBodyNotSent = errors.New("request body not sent as the server responded before 100 Continue")
+
+// requestBody is the body of a request being written. It records errors of reading the body, and for requests
+// expecting 100 Continue, it blocks reading until it is decided whether to send the body.
+type requestBody struct {
+	io.ReadCloser
+
+	decided chan struct{} // nil if not expecting 100 Continue
+	once    sync.Once
+	send    bool
+
+	mx   sync.Mutex
+	rErr error
+}
+
+// decide decides whether to send a body which is expecting 100 Continue.
+func (b *requestBody) decide(send bool) {
+	if b.decided == nil {
+		return
+	}
+	b.once.Do(func() {
+		b.send = send
+		close(b.decided)
+	})
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.decided != nil {
+		<-b.decided
+		if !b.send {
+			return 0, errBodyNotSent
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.mx.Lock()
+		b.rErr = err
+		b.mx.Unlock()
+	}
+	return n, err
+}
+
+// err returns the error of reading the body, if any.
+func (b *requestBody) err() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.rErr
+}
+
+// dialStream dials a stream to addr, giving up once ctx is done.
+// dmsg only applies ctx to discovery lookups and session setup, the stream handshake itself may take up to
+// dmsg.HandshakeTimeout.
+func (t Transport) dialStream(ctx context.Context, addr dmsg.Addr) (*dmsg.Stream, error) {
+	type result struct {
+		stream *dmsg.Stream
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		stream, err := t.DmsgClient.DialStream(ctx, addr)
+		ch <- result{stream: stream, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.stream, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.err == nil {
+				_ = r.stream.Close() //nolint:errcheck
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// resolveAddr obtains the remote dmsg address of a request from its URL host, which is either "<pk>:<port>" or a name
+// known to the Resolver with an optional port. Like net/http, the Host header is only used if the URL has no host.
+func (t Transport) resolveAddr(req *http.Request) (dmsg.Addr, error) {
+	host, portStr := req.URL.Host, ""
+	if host == "" {
+		host = req.Host
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host, portStr = host[:i], host[i+1:]
+	}
+
+	var port uint16
+	if portStr != "" {
+		rPort, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return dmsg.Addr{}, fmt.Errorf("invalid port: %v", err)
+		}
+		port = uint16(rPort)
+	}
+
+	var pk cipher.PubKey
+	pkErr := pk.Set(host)
+	if pkErr == nil {
+		if port == 0 {
+			return dmsg.Addr{}, errors.New("invalid server Pub Key or Port")
+		}
+		return dmsg.Addr{PK: pk, Port: port}, nil
+	}
+	if t.Resolver == nil {
+		return dmsg.Addr{}, pkErr
+	}
+
+	addr, err := t.Resolver.Resolve(req.Context(), host)
+	if err != nil {
+		return dmsg.Addr{}, err
+	}
+	if port != 0 {
+		addr.Port = port
+	}
+	if addr.Port == 0 {
+		return dmsg.Addr{}, fmt.Errorf("no port for dmsg host %q", host)
+	}
+	return addr, nil
+}
+
+// streamBody closes the underlying dmsg stream once the response body is closed.
+type streamBody struct {
+	io.ReadCloser
+	stream net.Conn
+	ctx    context.Context
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		if ctxErr := b.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	b.once.Do(func() { close(b.done) })
+
+	// The stream is closed first, so that closing the body does not drain the rest of it over dmsg.
+	// The error of closing the body then only reflects the closed stream.
+	err := b.stream.Close()
+	_ = b.ReadCloser.Close() //nolint:errcheck
+	return err
+}
+
+// onceCloseConn closes the underlying connection only once, as both a done context and closing the response body
+// close it.
+type onceCloseConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *onceCloseConn) Close() error {
+	c.once.Do(func() { c.err = c.Conn.Close() })
+	return c.err
 }